@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"grpc-pedrocarlo/pkg/client"
+	"grpc-pedrocarlo/pkg/tracing"
+	"net"
+	"strings"
+)
+
+// Prefix of the environment variables of the settings
+const ENV_PREFIX = "FILESYNC_CLIENT_"
+
+// Settings of the client, see pkg/config for where they are read from
+type Config struct {
+	Server      string   `yaml:"server" usage:"address of the server"`
+	TLS         bool     `yaml:"tls" usage:"connect with TLS, checking the server certificate against the system roots or -tls-ca"`
+	TLSCA       string   `yaml:"tls-ca" usage:"PEM certificates of the authorities trusted to sign the server certificate, implies -tls"`
+	BaseDir     string   `yaml:"base-dir" usage:"folder of the downloads, temp files and transfer queue, created if missing"`
+	MessageSize int      `yaml:"message-size" usage:"bytes of file data sent in each message"`
+	Streams     int      `yaml:"streams" usage:"concurrent streams moving a large file, 0 picks them from the file size"`
+	SegmentSize int64    `yaml:"segment-size" usage:"bytes a stream moves before taking the next segment of a file, 0 picks it from the file size"`
+	Bandwidth   int64    `yaml:"bandwidth" usage:"bytes per second sent and received by all transfers together, 0 for no limit"`
+	Jobs        int      `yaml:"jobs" usage:"uploads and downloads run at once in the background, 0 runs them in the foreground one at a time"`
+	E2EFolders  []string `yaml:"e2e-folders" usage:"comma separated remote folders whose files are encrypted end to end, with their subfolders"`
+	E2EKeyFile  string   `yaml:"e2e-key-file" usage:"end-to-end master key, created if missing. The key can instead be derived from the passphrase in $FILESYNC_E2E_PASSPHRASE"`
+	E2ENames    bool     `yaml:"e2e-names" usage:"also encrypt the names of end-to-end encrypted files"`
+
+	TraceExporter    string  `yaml:"trace-exporter" usage:"where OpenTelemetry spans are sent: none, otlp (configured by $OTEL_EXPORTER_OTLP_ENDPOINT and the like), stdout or file"`
+	TraceFile        string  `yaml:"trace-file" usage:"file the spans are appended to as JSON with -trace-exporter file"`
+	TraceSampleRatio float64 `yaml:"trace-sample-ratio" usage:"share of the transfers and calls whose traces are recorded"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Server:      client.SERVER_ADDRESS,
+		BaseDir:     client.CLIENT_BASE_DIR,
+		MessageSize: client.MESSAGE_SIZE,
+		Jobs:        2,
+		E2EFolders:  []string{},
+
+		TraceExporter:    tracing.EXPORTER_NONE,
+		TraceFile:        "client-traces.json",
+		TraceSampleRatio: 1,
+	}
+}
+
+// Reports every invalid setting at once
+func (c *Config) validate() error {
+	errs := []error{}
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	_, _, err := net.SplitHostPort(c.Server)
+	check(err == nil, "server: %q is not a host:port address", c.Server)
+	check(c.BaseDir != "", "base-dir: must not be empty")
+	check(c.MessageSize >= 4<<10 && c.MessageSize <= 3<<20, "message-size: %d is not between 4 KiB and 3 MiB", c.MessageSize)
+	check(c.Streams >= 0, "streams: must not be negative")
+	check(c.SegmentSize >= 0, "segment-size: must not be negative")
+	check(c.Bandwidth >= 0, "bandwidth: must not be negative")
+	check(c.Jobs >= 0, "jobs: must not be negative")
+	for _, folder := range c.E2EFolders {
+		check(strings.HasPrefix(folder, "/"), "e2e-folders: %q is not an absolute remote folder", folder)
+	}
+	switch c.TraceExporter {
+	case tracing.EXPORTER_NONE, tracing.EXPORTER_OTLP, tracing.EXPORTER_STDOUT, tracing.EXPORTER_FILE:
+	default:
+		check(false, "trace-exporter: %q is not none, otlp, stdout or file", c.TraceExporter)
+	}
+	check(c.TraceExporter != tracing.EXPORTER_FILE || c.TraceFile != "", "trace-file: must be set with -trace-exporter file")
+	check(c.TraceSampleRatio >= 0 && c.TraceSampleRatio <= 1, "trace-sample-ratio: %v is not between 0 and 1", c.TraceSampleRatio)
+	return errors.Join(errs...)
+}
@@ -1,15 +1,121 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
 	"grpc-pedrocarlo/pkg/client"
+	"grpc-pedrocarlo/pkg/config"
 	"grpc-pedrocarlo/pkg/repl"
+	"grpc-pedrocarlo/pkg/tracing"
 	"grpc-pedrocarlo/pkg/utils"
+	"os"
 )
 
 func main() {
+	cfg := defaultConfig()
+	print_config := flag.Bool("print-config", false, "print the settings as a config file and exit")
+	err := config.Load(flag.CommandLine, os.Args[1:], ENV_PREFIX, &cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	err = cfg.validate()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *print_config {
+		err = config.Print(os.Stdout, &cfg)
+		if err != nil {
+			utils.Log_fatal_trace(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	shutdown_tracing, err := tracing.Setup(context.Background(), "filesync-client", cfg.TraceExporter, cfg.TraceFile, cfg.TraceSampleRatio)
+	if err != nil {
+		utils.Log_fatal_trace(err)
+		os.Exit(1)
+	}
+	client.SERVER_ADDRESS = cfg.Server
+	if cfg.TLS || cfg.TLSCA != "" {
+		client.TLS_CONFIG, err = loadTLS(cfg.TLSCA)
+		if err != nil {
+			utils.Log_fatal_trace(err)
+			os.Exit(1)
+		}
+	}
+	client.MESSAGE_SIZE = cfg.MessageSize
+	client.SetBaseDir(cfg.BaseDir)
 	file_client, err := client.CreateClient()
 	if err != nil {
 		utils.Log_fatal_trace(err)
+		os.Exit(1)
+	}
+	file_client.Transfers = client.TransferOptions{Streams: cfg.Streams, SegmentSize: cfg.SegmentSize}
+	file_client.SetBandwidth(cfg.Bandwidth)
+	if len(cfg.E2EFolders) > 0 {
+		file_client.Encryption, err = loadE2E(cfg.E2EFolders, cfg.E2EKeyFile, cfg.E2ENames)
+		if err != nil {
+			utils.Log_fatal_trace(err)
+			os.Exit(1)
+		}
+	}
+	if cfg.Jobs > 0 {
+		file_client.Queue, err = client.NewTransferManager(file_client, cfg.Jobs, client.TRANSFERS_FILE)
+		if err != nil {
+			utils.Log_fatal_trace(err)
+			os.Exit(1)
+		}
 	}
 	repl.Repl(file_client)
+	if file_client.Queue != nil {
+		// Unfinished transfers resume when the client starts again
+		file_client.Queue.Close()
+	}
+	err = shutdown_tracing(context.Background())
+	if err != nil {
+		utils.Log_fatal_trace(err)
+	}
+}
+
+func loadTLS(ca_file string) (*tls.Config, error) {
+	tls_config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if ca_file == "" {
+		return tls_config, nil
+	}
+	pem, err := os.ReadFile(ca_file)
+	if err != nil {
+		return nil, err
+	}
+	tls_config.RootCAs = x509.NewCertPool()
+	if !tls_config.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", ca_file)
+	}
+	return tls_config, nil
+}
+
+func loadE2E(folders []string, key_file string, names bool) (*client.E2E, error) {
+	passphrase := os.Getenv(client.E2E_PASSPHRASE_ENV)
+	var key []byte
+	var err error
+	switch {
+	case key_file != "" && passphrase != "":
+		return nil, errors.New("both -e2e-key-file and $" + client.E2E_PASSPHRASE_ENV + " are set")
+	case key_file != "":
+		key, err = client.LoadE2EKey(key_file)
+	case passphrase != "":
+		key, err = client.DeriveE2EKey(passphrase)
+	default:
+		return nil, errors.New("-e2e-folders needs -e2e-key-file or $" + client.E2E_PASSPHRASE_ENV)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return client.NewE2E(key, folders, names)
 }
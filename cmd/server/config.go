@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"grpc-pedrocarlo/pkg/db"
+	"grpc-pedrocarlo/pkg/server"
+	"grpc-pedrocarlo/pkg/storage"
+	"grpc-pedrocarlo/pkg/tracing"
+	"grpc-pedrocarlo/pkg/utils"
+	"grpc-pedrocarlo/pkg/zstd"
+	"math"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Prefix of the environment variables of the settings
+const ENV_PREFIX = "FILESYNC_"
+
+// Settings of the server, see pkg/config for where they are read from
+type Config struct {
+	Listen            string        `yaml:"listen" usage:"address the server listens on"`
+	AdminAddr         string        `yaml:"admin-addr" usage:"address serving the Admin service in plaintext, host:port or unix:<path>, disabled when empty. Anyone reaching it can drain the server and repair storage"`
+	TLSCert           string        `yaml:"tls-cert" usage:"PEM certificate served to clients, plaintext when empty"`
+	TLSKey            string        `yaml:"tls-key" usage:"PEM private key of -tls-cert"`
+	BaseDir           string        `yaml:"base-dir" usage:"folder of the stored files, temp files and default database, created if missing"`
+	Dsn               string        `yaml:"dsn" usage:"metadata store, sqlite3://<path> or postgres://<user>:<password>@<host>/<database>, defaults to sqlite3://<base-dir>/files.db"`
+	KeyFile           string        `yaml:"key-file" usage:"master keys wrapping the keys of stored files, created by the keys create command. It must be outside base-dir, new files are stored in plaintext when empty"`
+	MessageSize       int           `yaml:"message-size" usage:"bytes of file data sent in each message"`
+	ScrubRate         int64         `yaml:"scrub-rate" usage:"bytes per second re-hashed by the background scrubber, 0 disables it"`
+	ScrubInterval     time.Duration `yaml:"scrub-interval" usage:"minimum time between two scrubs of the same file"`
+	TmpMaxAge         time.Duration `yaml:"tmp-max-age" usage:"temp files and uploads untouched for this long are removed"`
+	TmpCleanInterval  time.Duration `yaml:"tmp-clean-interval" usage:"how often the temp folder is cleaned"`
+	ArchiveMaxEntries int           `yaml:"archive-max-entries" usage:"entries allowed in an uploaded archive"`
+	ArchiveMaxBytes   int64         `yaml:"archive-max-bytes" usage:"bytes an uploaded archive may extract to"`
+	StoreCompression  string        `yaml:"store-compression" usage:"codec tried on stored files, zstd or none"`
+	WireCompression   []string      `yaml:"wire-compression" usage:"compressors of sent messages in order of preference, empty disables compression"`
+	UserRps           float64       `yaml:"user-rps" usage:"requests per second allowed from one client address, 0 for no limit"`
+	ConnRps           float64       `yaml:"conn-rps" usage:"requests per second allowed on one connection, 0 for no limit"`
+	UserBandwidth     int64         `yaml:"user-bandwidth" usage:"bytes per second moved for one client address, 0 for no limit"`
+	ConnBandwidth     int64         `yaml:"conn-bandwidth" usage:"bytes per second moved on one connection, 0 for no limit"`
+	StreamIdleTimeout time.Duration `yaml:"stream-idle-timeout" usage:"streams with no message received or sent for this long are closed, 0 disables it"`
+	StreamMaxDuration time.Duration `yaml:"stream-max-duration" usage:"streams open for this long are closed, 0 disables it"`
+	UploadMaxBytes    int64         `yaml:"upload-max-bytes" usage:"bytes a client may send over one stream, and largest file it may upload over several, 0 for no limit"`
+	KeepaliveTime     time.Duration `yaml:"keepalive-time" usage:"idle connections are pinged after this long"`
+	KeepaliveTimeout  time.Duration `yaml:"keepalive-timeout" usage:"connections whose ping is not answered within this are closed"`
+	DebugAddr         string        `yaml:"debug-addr" usage:"address serving /debug/vars, disabled when empty"`
+	MetricsAddr       string        `yaml:"metrics-addr" usage:"address serving Prometheus metrics at /metrics, disabled when empty"`
+	LogLevel          string        `yaml:"log-level" usage:"messages logged, trace or error"`
+	TraceExporter     string        `yaml:"trace-exporter" usage:"where OpenTelemetry spans are sent: none, otlp (configured by $OTEL_EXPORTER_OTLP_ENDPOINT and the like), stdout or file"`
+	TraceFile         string        `yaml:"trace-file" usage:"file the spans are appended to as JSON with -trace-exporter file"`
+	TraceSampleRatio  float64       `yaml:"trace-sample-ratio" usage:"share of the traces started by the server that are recorded, calls from traced clients follow the client"`
+	ShutdownGrace     time.Duration `yaml:"shutdown-grace" usage:"on SIGTERM or Admin.Drain, how long calls in flight may run before they are canceled"`
+	HealthInterval    time.Duration `yaml:"health-interval" usage:"how often the database and storage are checked for the grpc.health.v1 service"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Listen:            "127.0.0.1:7070",
+		AdminAddr:         "127.0.0.1:7071",
+		BaseDir:           db.BASE_DIR,
+		MessageSize:       server.MESSAGE_SIZE,
+		ScrubRate:         4 << 20,
+		ScrubInterval:     7 * 24 * time.Hour,
+		TmpMaxAge:         24 * time.Hour,
+		TmpCleanInterval:  time.Hour,
+		ArchiveMaxEntries: server.DEFAULT_ARCHIVE_MAX_ENTRIES,
+		ArchiveMaxBytes:   server.DEFAULT_ARCHIVE_MAX_BYTES,
+		StoreCompression:  storage.CODEC_ZSTD,
+		WireCompression:   server.WIRE_COMPRESSION,
+		StreamIdleTimeout: server.DEFAULT_STREAM_IDLE_TIMEOUT,
+		StreamMaxDuration: server.DEFAULT_STREAM_MAX_DURATION,
+		UploadMaxBytes:    server.DEFAULT_UPLOAD_MAX_BYTES,
+		KeepaliveTime:     time.Minute,
+		KeepaliveTimeout:  20 * time.Second,
+		LogLevel:          utils.LOG_TRACE,
+		TraceExporter:     tracing.EXPORTER_NONE,
+		TraceFile:         "server-traces.json",
+		TraceSampleRatio:  1,
+		ShutdownGrace:     30 * time.Second,
+		HealthInterval:    10 * time.Second,
+	}
+}
+
+// Fills the settings left empty to follow base-dir
+func (c *Config) resolve() {
+	if c.Dsn == "" {
+		c.Dsn = "sqlite3://" + filepath.Join(c.BaseDir, "files.db")
+	}
+}
+
+// Reports every invalid setting at once
+func (c *Config) validate() error {
+	errs := []error{}
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	_, _, err := net.SplitHostPort(c.Listen)
+	check(err == nil, "listen: %q is not a host:port address", c.Listen)
+	if c.AdminAddr != "" && !strings.HasPrefix(c.AdminAddr, "unix:") {
+		_, _, err = net.SplitHostPort(c.AdminAddr)
+		check(err == nil, "admin-addr: %q is not a host:port address or unix:<path>", c.AdminAddr)
+	}
+	check(c.AdminAddr != c.Listen, "admin-addr: must differ from listen")
+	check((c.TLSCert == "") == (c.TLSKey == ""), "tls-cert, tls-key: must be set together")
+	check(c.BaseDir != "", "base-dir: must not be empty")
+	if c.KeyFile != "" {
+		check(!isInside(c.KeyFile, c.BaseDir), "key-file: %q must not be inside base-dir, where it would be stored with the files it protects", c.KeyFile)
+	}
+	check(c.MessageSize >= 4<<10 && c.MessageSize <= 3<<20, "message-size: %d is not between 4 KiB and 3 MiB", c.MessageSize)
+	check(c.ScrubRate >= 0, "scrub-rate: must not be negative")
+	check(c.ScrubInterval > 0, "scrub-interval: must be positive")
+	check(c.TmpMaxAge > 0, "tmp-max-age: must be positive")
+	check(c.TmpCleanInterval > 0, "tmp-clean-interval: must be positive")
+	check(c.ArchiveMaxEntries > 0, "archive-max-entries: must be positive")
+	check(c.ArchiveMaxBytes > 0, "archive-max-bytes: must be positive")
+	check(c.StoreCompression == storage.CODEC_ZSTD || c.StoreCompression == "none", "store-compression: %q is not zstd or none", c.StoreCompression)
+	for _, name := range c.WireCompression {
+		check(name == zstd.NAME || name == "gzip", "wire-compression: unknown compressor %q, expected zstd or gzip", name)
+	}
+	check(c.UserRps >= 0 && c.ConnRps >= 0, "user-rps, conn-rps: must not be negative")
+	check(c.UserBandwidth >= 0 && c.ConnBandwidth >= 0, "user-bandwidth, conn-bandwidth: must not be negative")
+	// Slower limits would fail every transfer on its first message
+	min_bandwidth := int64(math.Ceil(float64(c.MessageSize) / server.MAX_THROTTLE_WAIT.Seconds()))
+	check(c.UserBandwidth == 0 || c.UserBandwidth >= min_bandwidth, "user-bandwidth: %d is below %d, one message of message-size must pass in %s", c.UserBandwidth, min_bandwidth, server.MAX_THROTTLE_WAIT)
+	check(c.ConnBandwidth == 0 || c.ConnBandwidth >= min_bandwidth, "conn-bandwidth: %d is below %d, one message of message-size must pass in %s", c.ConnBandwidth, min_bandwidth, server.MAX_THROTTLE_WAIT)
+	check(c.StreamIdleTimeout >= 0 && c.StreamMaxDuration >= 0, "stream-idle-timeout, stream-max-duration: must not be negative")
+	check(c.UploadMaxBytes >= 0, "upload-max-bytes: must not be negative")
+	check(c.KeepaliveTime >= time.Second, "keepalive-time: must be at least 1s")
+	check(c.KeepaliveTimeout > 0, "keepalive-timeout: must be positive")
+	if c.DebugAddr != "" {
+		_, _, err = net.SplitHostPort(c.DebugAddr)
+		check(err == nil, "debug-addr: %q is not a host:port address", c.DebugAddr)
+	}
+	check(c.ShutdownGrace >= 0, "shutdown-grace: must not be negative")
+	check(c.HealthInterval > 0, "health-interval: must be positive")
+	switch c.TraceExporter {
+	case tracing.EXPORTER_NONE, tracing.EXPORTER_OTLP, tracing.EXPORTER_STDOUT, tracing.EXPORTER_FILE:
+	default:
+		check(false, "trace-exporter: %q is not none, otlp, stdout or file", c.TraceExporter)
+	}
+	check(c.TraceExporter != tracing.EXPORTER_FILE || c.TraceFile != "", "trace-file: must be set with -trace-exporter file")
+	check(c.TraceSampleRatio >= 0 && c.TraceSampleRatio <= 1, "trace-sample-ratio: %v is not between 0 and 1", c.TraceSampleRatio)
+	check(c.LogLevel == utils.LOG_TRACE || c.LogLevel == utils.LOG_ERROR, "log-level: %q is not %s or %s", c.LogLevel, utils.LOG_TRACE, utils.LOG_ERROR)
+	if c.MetricsAddr != "" {
+		_, _, err = net.SplitHostPort(c.MetricsAddr)
+		check(err == nil, "metrics-addr: %q is not a host:port address", c.MetricsAddr)
+	}
+	return errors.Join(errs...)
+}
+
+// Tells whether path is dir or is in it
+func isInside(path string, dir string) bool {
+	abs_path, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	abs_dir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(abs_dir, abs_path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"grpc-pedrocarlo/pkg/db"
+	"grpc-pedrocarlo/pkg/server"
+)
+
+func runFsck(conn *db.Store, args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	repair := flags.Bool("repair", false, "fix the problems that can be fixed")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	err = db.CreateDb(conn)
+	if err != nil {
+		return err
+	}
+	report, err := server.Fsck(conn, *repair)
+	if err != nil {
+		return err
+	}
+	for _, problem := range report.Problems {
+		status := ""
+		if problem.Repaired {
+			status = " (repaired)"
+		}
+		fmt.Printf("%-16s %s: %s%s\n", problem.Kind, problem.Path, problem.Detail, status)
+	}
+	fmt.Printf("checked %d files and %d folders, %d problems found\n", report.FilesChecked, report.FoldersChecked, len(report.Problems))
+	if unrepaired := report.Unrepaired(); unrepaired > 0 {
+		return fmt.Errorf("%d problems left unrepaired", unrepaired)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"grpc-pedrocarlo/pkg/db"
+	"grpc-pedrocarlo/pkg/server"
+)
+
+var errImportUsage = errors.New("usage: import <path> <remote_folder>")
+
+func runImport(conn *db.Store, args []string) error {
+	if len(args) != 2 {
+		return errImportUsage
+	}
+	err := db.CreateDb(conn)
+	if err != nil {
+		return err
+	}
+	report, err := server.ImportTree(conn, args[0], args[1], func(progress server.ImportProgress) {
+		fmt.Printf("[%d/%d] %-9s %s (%d bytes)\n", progress.Done, progress.Total, progress.Result, progress.Path, progress.Size)
+	})
+	if report != nil {
+		fmt.Printf("%d folders created, %d files added, %d updated, %d unchanged, %d skipped, %d bytes copied\n",
+			report.Folders, report.Added, report.Updated, report.Unchanged, report.Skipped, report.Bytes)
+	}
+	return err
+}
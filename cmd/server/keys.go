@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"grpc-pedrocarlo/pkg/db"
+	"grpc-pedrocarlo/pkg/storage"
+)
+
+var errKeysUsage = errors.New("usage: keys create <path>|rotate")
+
+func runKeys(conn *db.Store, args []string) error {
+	switch {
+	case len(args) == 2 && args[0] == "create":
+		key_id, err := storage.CreateKeyFile(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("created %s with master key %s, keep a backup of it away from the stored files\n", args[1], key_id)
+		return nil
+	case len(args) == 1 && args[0] == "rotate":
+	default:
+		return errKeysUsage
+	}
+	if storage.KEYS == nil {
+		return errors.New("no key file, -key-file is not set")
+	}
+	err := db.CreateDb(conn)
+	if err != nil {
+		return err
+	}
+	key_id, err := storage.KEYS.Rotate()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("new master key %s\n", key_id)
+	rewrapped, err := storage.RewrapKeys(conn, storage.KEYS)
+	fmt.Printf("%d data keys wrapped again\n", rewrapped)
+	return err
+}
@@ -1,36 +1,323 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"expvar"
+	"flag"
 	"fmt"
+	"grpc-pedrocarlo/pkg/config"
 	"grpc-pedrocarlo/pkg/db"
 	filesync "grpc-pedrocarlo/pkg/file"
+	"grpc-pedrocarlo/pkg/metrics"
 	"grpc-pedrocarlo/pkg/server"
+	"grpc-pedrocarlo/pkg/storage"
+	"grpc-pedrocarlo/pkg/tracing"
 	"grpc-pedrocarlo/pkg/utils"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/reflection"
 )
 
+// Subcommands of the server binary, run instead of serving when given
+var commands = map[string]func(conn *db.Store, args []string) error{
+	"migrate": runMigrate,
+	"fsck":    runFsck,
+	"import":  runImport,
+	"keys":    runKeys,
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: %s [flags] [command]\n\n", os.Args[0])
+	fmt.Fprintln(out, "commands:")
+	fmt.Fprintln(out, "    migrate status|up [version]|down [steps]")
+	fmt.Fprintln(out, "    fsck [--repair]")
+	fmt.Fprintln(out, "    import <path> <remote_folder>")
+	fmt.Fprintln(out, "    keys create <path>|rotate")
+	fmt.Fprintln(out, "\nflags:")
+	flag.PrintDefaults()
+}
+
 func main() {
-	ln, err := net.Listen("tcp", "127.0.0.1:7070")
+	cfg := defaultConfig()
+	print_config := flag.Bool("print-config", false, "print the settings as a config file and exit")
+	flag.Usage = usage
+	err := config.Load(flag.CommandLine, os.Args[1:], ENV_PREFIX, &cfg)
 	if err != nil {
-		utils.Log_fatal_trace(fmt.Errorf("failed to listen: %v", err))
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	cfg.resolve()
+	err = cfg.validate()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *print_config {
+		err = config.Print(os.Stdout, &cfg)
+		if err != nil {
+			utils.Log_fatal_trace(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	utils.SetLogLevel(cfg.LogLevel)
+	storage.COMPRESSION = storage.CODEC_ZSTD
+	if cfg.StoreCompression == "none" {
+		storage.COMPRESSION = storage.CODEC_NONE
+	}
+	server.WIRE_COMPRESSION = cfg.WireCompression
+	server.MESSAGE_SIZE = cfg.MessageSize
+	db.SetBaseDir(cfg.BaseDir)
+	err = db.CreateDirs()
+	if err != nil {
+		utils.Log_fatal_trace(err)
+		os.Exit(1)
 	}
-	grpcServer := grpc.NewServer([]grpc.ServerOption{}...)
 
-	conn, err := db.ConnectDb()
+	conn, err := db.ConnectDb(cfg.Dsn)
 	if err != nil {
 		utils.Log_fatal_trace(err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	// keys create makes the key file the other commands and the server need
+	creating_key_file := flag.Arg(0) == "keys" && flag.Arg(1) == "create"
+	if cfg.KeyFile != "" && !creating_key_file {
+		storage.KEYS, err = storage.LoadKeyring(cfg.KeyFile)
+		if err != nil {
+			utils.Log_fatal_trace(err)
+			os.Exit(1)
+		}
+	}
+
+	if flag.NArg() > 0 {
+		command, ok := commands[flag.Arg(0)]
+		if !ok {
+			usage()
+			os.Exit(2)
+		}
+		err = command(conn, flag.Args()[1:])
+		if err != nil {
+			utils.Log_fatal_trace(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	shutdown_tracing, err := tracing.Setup(context.Background(), "filesync-server", cfg.TraceExporter, cfg.TraceFile, cfg.TraceSampleRatio)
+	if err != nil {
+		utils.Log_fatal_trace(err)
+		os.Exit(1)
+	}
+
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		utils.Log_fatal_trace(fmt.Errorf("failed to listen: %v", err))
+		os.Exit(1)
+	}
+	reloads := &reloader{
+		args:           os.Args[1:],
+		started:        cfg,
+		cfg:            cfg,
+		limiter:        server.NewLimiter(limitsOf(&cfg)),
+		stream_limiter: server.NewStreamLimiter(streamLimitsOf(&cfg)),
 	}
+	creds := insecure.NewCredentials()
+	if cfg.TLSCert != "" {
+		reloads.certs, err = server.NewCertReloader(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			utils.Log_fatal_trace(err)
+			os.Exit(1)
+		}
+		creds = credentials.NewTLS(reloads.certs.TLSConfig())
+	}
+	drainer := server.NewDrainer(cfg.ShutdownGrace)
+	grpcServer := grpc.NewServer(
+		grpc.Creds(creds),
+		// Continues the traces of the clients
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		// Clients ping idle connections every 30s to notice a dead server,
+		// clients pinging more often are disconnected
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{MinTime: 20 * time.Second, PermitWithoutStream: true}),
+		// Dead clients are noticed the same way and their streams closed
+		grpc.KeepaliveParams(keepalive.ServerParameters{Time: cfg.KeepaliveTime, Timeout: cfg.KeepaliveTimeout}),
+		grpc.ChainUnaryInterceptor(drainer.UnaryInterceptor, server.MetricsUnaryInterceptor, reloads.limiter.UnaryInterceptor, server.UnaryCompressionInterceptor),
+		grpc.ChainStreamInterceptor(drainer.StreamInterceptor, server.MetricsStreamInterceptor, reloads.stream_limiter.StreamInterceptor, reloads.limiter.StreamInterceptor, server.StreamCompressionInterceptor),
+	)
+	drainer.Server = grpcServer
+
 	err = db.CreateDb(conn)
 	if err != nil {
 		utils.Log_fatal_trace(err)
+		os.Exit(1)
+	}
+	if storage.KEYS == nil {
+		// Encryption is opt-in, files stored encrypted before still need their keys
+		in_use, err := db.QueryKeyIdsInUse(conn)
+		if err != nil {
+			utils.Log_fatal_trace(err)
+			os.Exit(1)
+		}
+		if len(in_use) > 0 {
+			utils.Log_fatal_trace(errors.New("stored files are encrypted, -key-file must be set"))
+			os.Exit(1)
+		}
+	}
+
+	janitor := &server.Janitor{Dir: db.TEMP_DIR, MaxAge: cfg.TmpMaxAge, Interval: cfg.TmpCleanInterval, Db_conn: conn}
+	err = janitor.Recover()
+	if err != nil {
+		utils.Log_fatal_trace(err)
+		os.Exit(1)
 	}
+	// Stopped once the server is drained, before the database is closed
+	background_ctx, stop_background := context.WithCancel(context.Background())
+	var background sync.WaitGroup
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		janitor.Run(background_ctx)
+	}()
 
-	server := &server.FileSyncServer{Db_conn: conn}
-	filesync.RegisterFileSyncServer(grpcServer, server)
+	var scrubber *server.Scrubber
+	if cfg.ScrubRate > 0 {
+		scrubber = &server.Scrubber{Db_conn: conn, Rate: cfg.ScrubRate, Interval: cfg.ScrubInterval}
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			scrubber.Run(background_ctx)
+		}()
+	}
+	if cfg.DebugAddr != "" {
+		go func() {
+			utils.Log_trace(fmt.Sprintf("Serving debug variables on %s", cfg.DebugAddr))
+			// Not the default mux, which packages may add handlers to
+			mux := http.NewServeMux()
+			mux.Handle("/debug/vars", expvar.Handler())
+			err := http.ListenAndServe(cfg.DebugAddr, mux)
+			utils.Log_fatal_trace(err)
+		}()
+	}
+	prometheus.MustRegister(&server.StorageCollector{Db_conn: conn})
+	if scrubber != nil {
+		prometheus.MustRegister(&server.ScrubCollector{Scrubber: scrubber})
+	}
+	if cfg.MetricsAddr != "" {
+		go func() {
+			utils.Log_trace(fmt.Sprintf("Serving metrics on %s", cfg.MetricsAddr))
+			err := metrics.ListenAndServe(cfg.MetricsAddr)
+			utils.Log_fatal_trace(err)
+		}()
+	}
+
+	sync_server := &server.FileSyncServer{Db_conn: conn, ArchiveMaxEntries: cfg.ArchiveMaxEntries, ArchiveMaxBytes: cfg.ArchiveMaxBytes, Limits: reloads.limiter, StreamLimits: reloads.stream_limiter}
+	filesync.RegisterFileSyncServer(grpcServer, sync_server)
+	health_server := health.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, health_server)
+	checker := &server.HealthChecker{Health: health_server, Db_conn: conn, Interval: cfg.HealthInterval}
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		checker.Run(background_ctx)
+	}()
+	// Health checks fail as soon as draining starts
+	drainer.OnDrain = health_server.Shutdown
+	// Lets grpcurl and similar tools list and call the services without the .proto
+	reflection.Register(grpcServer)
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			reloads.reloadAndLog()
+		}
+	}()
+	terminations := make(chan os.Signal, 1)
+	signal.Notify(terminations, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-terminations
+		utils.Log_trace(fmt.Sprintf("Received %s, shutting down", sig))
+		drainer.Drain()
+		// A drain that is stuck can be cut short
+		sig = <-terminations
+		utils.Log_trace(fmt.Sprintf("Received %s again, exiting without draining", sig))
+		os.Exit(1)
+	}()
+	var admin_server *grpc.Server
+	if cfg.AdminAddr != "" {
+		admin_ln, err := listenAdmin(cfg.AdminAddr)
+		if err != nil {
+			utils.Log_fatal_trace(err)
+			os.Exit(1)
+		}
+		admin_server = grpc.NewServer(grpc.ChainUnaryInterceptor(server.MetricsUnaryInterceptor))
+		filesync.RegisterAdminServer(admin_server, &server.AdminServer{Db_conn: conn, Scrubber: scrubber, Reloader: reloads.reload, Drainer: drainer})
+		reflection.Register(admin_server)
+		go func() {
+			utils.Log_trace(fmt.Sprintf("Serving the Admin service on %s", cfg.AdminAddr))
+			err := admin_server.Serve(admin_ln)
+			if err != nil {
+				utils.Log_fatal_trace(err)
+			}
+		}()
+	}
 	utils.Log_trace(fmt.Sprintf("Starting server on address %s", ln.Addr().String()))
 	if err := grpcServer.Serve(ln); err != nil {
 		utils.Log_fatal_trace(fmt.Errorf("failed to listen: %v", err))
+		os.Exit(1)
+	}
+	// Serve returns as soon as draining starts
+	<-drainer.Done()
+	if admin_server != nil {
+		admin_server.GracefulStop()
+	}
+	stop_background()
+	background.Wait()
+	err = shutdown_tracing(context.Background())
+	if err != nil {
+		utils.Log_fatal_trace(err)
+	}
+	utils.Log_trace("Server stopped")
+}
+
+// Listens on a TCP address, or on a unix socket for unix:<path>. A socket
+// left over by a server that crashed is replaced.
+func listenAdmin(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Only the user running the server may connect
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		ln.Close()
+		return nil, err
 	}
+	return ln, nil
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"grpc-pedrocarlo/pkg/db"
+	"strconv"
+	"time"
+)
+
+var errMigrateUsage = errors.New("usage: migrate status|up [version]|down [steps]")
+
+func runMigrate(conn *db.Store, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errMigrateUsage
+	}
+	arg := 0
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			return errMigrateUsage
+		}
+		arg = n
+	}
+	switch args[0] {
+	case "status":
+		return printMigrationsStatus(conn)
+	case "up":
+		err := db.MigrateUp(conn, arg)
+		if err != nil {
+			return err
+		}
+	case "down":
+		if arg == 0 {
+			arg = 1
+		}
+		err := db.MigrateDown(conn, arg)
+		if err != nil {
+			return err
+		}
+	default:
+		return errMigrateUsage
+	}
+	return printMigrationsStatus(conn)
+}
+
+func printMigrationsStatus(conn *db.Store) error {
+	status, err := db.QueryMigrationsStatus(conn)
+	if err != nil {
+		return err
+	}
+	version, err := db.MigrationVersion(conn)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s schema at version %d\n", conn.Dialect.DriverName(), version)
+	for _, migration := range status {
+		applied := "pending"
+		if migration.Applied {
+			applied = "applied " + time.Unix(int64(migration.AppliedAt), 0).Format(time.RFC3339)
+		}
+		fmt.Printf("%04d %-40s %s\n", migration.Version, migration.Name, applied)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"grpc-pedrocarlo/pkg/config"
+	"grpc-pedrocarlo/pkg/server"
+	"grpc-pedrocarlo/pkg/utils"
+	"io"
+	"os"
+	"slices"
+	"sync"
+)
+
+// Settings applied while serving, the others are only read at startup
+var RELOADABLE = []string{
+	"user-rps", "conn-rps", "user-bandwidth", "conn-bandwidth",
+	"stream-idle-timeout", "stream-max-duration", "upload-max-bytes",
+	"log-level",
+}
+
+// Reads the configuration again on SIGHUP or Admin.Reload, from the same
+// file, environment and flags, and applies what can be applied in place.
+// Streams in flight are not interrupted: they keep their stream limits and
+// follow the new rate limits.
+type reloader struct {
+	args           []string
+	started        Config // Settings the server started with
+	limiter        *server.Limiter
+	stream_limiter *server.StreamLimiter
+	certs          *server.CertReloader // nil without TLS
+
+	mu  sync.Mutex
+	cfg Config // Settings of the last load
+}
+
+func (r *reloader) reloadable(key string, cfg *Config) bool {
+	if key == "tls-cert" || key == "tls-key" {
+		// Turning TLS on or off needs a restart, changing the files does not
+		return r.certs != nil && cfg.TLSCert != ""
+	}
+	return slices.Contains(RELOADABLE, key)
+}
+
+// Applies the configuration, nothing is applied when it is invalid
+func (r *reloader) reload() ([]string, []string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cfg := defaultConfig()
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.Bool("print-config", false, "")
+	err := config.Load(fs, r.args, ENV_PREFIX, &cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg.resolve()
+	err = cfg.validate()
+	if err != nil {
+		return nil, nil, err
+	}
+	if r.certs != nil && cfg.TLSCert != "" {
+		// Read every time, renewed certificates keep their file names
+		err = r.certs.Load(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	r.limiter.SetLimits(limitsOf(&cfg))
+	r.stream_limiter.SetLimits(streamLimitsOf(&cfg))
+	utils.SetLogLevel(cfg.LogLevel)
+	applied := []string{}
+	for _, key := range config.Changed(&r.cfg, &cfg) {
+		if r.reloadable(key, &cfg) {
+			applied = append(applied, key)
+		}
+	}
+	restart_required := []string{}
+	for _, key := range config.Changed(&r.started, &cfg) {
+		if !r.reloadable(key, &cfg) {
+			restart_required = append(restart_required, key)
+		}
+	}
+	r.cfg = cfg
+	return applied, restart_required, nil
+}
+
+// Reloads and logs the outcome, for SIGHUP
+func (r *reloader) reloadAndLog() {
+	applied, restart_required, err := r.reload()
+	if err != nil {
+		utils.Log_fatal_trace(fmt.Errorf("configuration not reloaded: %w", err))
+		return
+	}
+	utils.Log_trace(fmt.Sprintf("Reloaded configuration, changed %v", applied))
+	if len(restart_required) > 0 {
+		utils.Log_trace(fmt.Sprintf("Changes to %v are applied on restart", restart_required))
+	}
+}
+
+func limitsOf(cfg *Config) server.Limits {
+	return server.Limits{
+		UserRequests: cfg.UserRps,
+		ConnRequests: cfg.ConnRps,
+		UserBytes:    cfg.UserBandwidth,
+		ConnBytes:    cfg.ConnBandwidth,
+	}
+}
+
+func streamLimitsOf(cfg *Config) server.StreamLimits {
+	return server.StreamLimits{
+		IdleTimeout:    cfg.StreamIdleTimeout,
+		MaxDuration:    cfg.StreamMaxDuration,
+		MaxUploadBytes: cfg.UploadMaxBytes,
+	}
+}
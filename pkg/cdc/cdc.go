@@ -0,0 +1,131 @@
+// Splits data into content-defined chunks with FastCDC. Boundaries depend
+// only on the bytes around them, so inserting or removing bytes in a file
+// only changes the chunks around the edit and the others can be reused.
+package cdc
+
+import (
+	"io"
+	"math/bits"
+)
+
+// Default chunk sizes, a chunk is only smaller than MIN_SIZE at the end of
+// the data. Clients and servers must agree on them for chunks to be reused.
+const (
+	MIN_SIZE = 64 << 10
+	AVG_SIZE = 256 << 10
+	MAX_SIZE = 1 << 20
+)
+
+// Random values for each byte, generated with splitmix64 from a fixed seed
+// so every build cuts at the same places
+var gear = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x66696c6573796e63)
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// Mask with n bits set, taken from the high bits of the fingerprint which
+// depend on the last 64 bytes
+func mask(n int) uint64 {
+	return ^uint64(0) << (64 - n)
+}
+
+type Chunker struct {
+	r    io.Reader
+	min  int
+	avg  int
+	max  int
+	buf  []byte
+	pos  int // Start of the next chunk in buf
+	end  int // End of the data in buf
+	eof  bool
+	hard uint64 // Mask used before avg, makes cuts less likely
+	easy uint64 // Mask used after avg, makes cuts more likely
+}
+
+// Returns a chunker of r with the default sizes
+func NewChunker(r io.Reader) *Chunker {
+	return NewChunkerSize(r, MIN_SIZE, AVG_SIZE, MAX_SIZE)
+}
+
+// Returns a chunker of r, avg is rounded down to a power of two
+func NewChunkerSize(r io.Reader, min int, avg int, max int) *Chunker {
+	avg_bits := bits.Len(uint(avg)) - 1
+	return &Chunker{
+		r:    r,
+		min:  min,
+		avg:  avg,
+		max:  max,
+		buf:  make([]byte, 2*max),
+		hard: mask(avg_bits + 2),
+		easy: mask(avg_bits - 2),
+	}
+}
+
+// Returns the next chunk, only valid until the next call, or io.EOF after
+// the last one
+func (c *Chunker) Next() ([]byte, error) {
+	if c.end-c.pos < c.max && !c.eof {
+		err := c.fill()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.pos == c.end {
+		return nil, io.EOF
+	}
+	n := c.cut(c.buf[c.pos:c.end])
+	chunk := c.buf[c.pos : c.pos+n]
+	c.pos += n
+	return chunk, nil
+}
+
+func (c *Chunker) fill() error {
+	copy(c.buf, c.buf[c.pos:c.end])
+	c.end -= c.pos
+	c.pos = 0
+	for c.end < len(c.buf) && !c.eof {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the length of the chunk at the start of data
+func (c *Chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.min {
+		return n
+	}
+	if n > c.max {
+		n = c.max
+	}
+	normal := min(c.avg, n)
+	fingerprint := uint64(0)
+	i := c.min
+	for ; i < normal; i++ {
+		fingerprint = (fingerprint << 1) + gear[data[i]]
+		if fingerprint&c.hard == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fingerprint = (fingerprint << 1) + gear[data[i]]
+		if fingerprint&c.easy == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
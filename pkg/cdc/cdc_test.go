@@ -0,0 +1,107 @@
+package cdc
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func randomBytes(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func chunks(t *testing.T, chunker *Chunker) [][]byte {
+	t.Helper()
+	result := [][]byte{}
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			return result
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, bytes.Clone(chunk))
+	}
+}
+
+func TestChunkSizes(t *testing.T) {
+	tests := []struct {
+		name          string
+		data          []byte
+		min, avg, max int
+	}{
+		{"empty", nil, MIN_SIZE, AVG_SIZE, MAX_SIZE},
+		{"below min", randomBytes(1, MIN_SIZE-1), MIN_SIZE, AVG_SIZE, MAX_SIZE},
+		{"exactly min", randomBytes(2, MIN_SIZE), MIN_SIZE, AVG_SIZE, MAX_SIZE},
+		{"random", randomBytes(3, 8<<20), MIN_SIZE, AVG_SIZE, MAX_SIZE},
+		{"zeros", make([]byte, 5<<20), MIN_SIZE, AVG_SIZE, MAX_SIZE},
+		{"small sizes", randomBytes(4, 1<<20), 1 << 10, 4 << 10, 16 << 10},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := chunks(t, NewChunkerSize(bytes.NewReader(test.data), test.min, test.avg, test.max))
+			joined := bytes.Join(result, nil)
+			if !bytes.Equal(joined, test.data) {
+				t.Fatalf("chunks join to %d bytes, want the %d bytes chunked", len(joined), len(test.data))
+			}
+			for i, chunk := range result {
+				if len(chunk) > test.max {
+					t.Errorf("chunk %d has %d bytes, more than max %d", i, len(chunk), test.max)
+				}
+				if i < len(result)-1 && len(chunk) < test.min {
+					t.Errorf("chunk %d of %d has %d bytes, less than min %d", i, len(result), len(chunk), test.min)
+				}
+				if len(chunk) == 0 {
+					t.Errorf("chunk %d is empty", i)
+				}
+			}
+		})
+	}
+}
+
+func TestChunkBoundaries(t *testing.T) {
+	data := randomBytes(5, 16<<20)
+	first := chunks(t, NewChunker(bytes.NewReader(data)))
+	again := chunks(t, NewChunker(bytes.NewReader(data)))
+	if len(first) != len(again) {
+		t.Fatalf("chunking twice gave %d and %d chunks", len(first), len(again))
+	}
+	for i := range first {
+		if !bytes.Equal(first[i], again[i]) {
+			t.Fatalf("chunk %d differs between two runs", i)
+		}
+	}
+
+	// Boundaries only depend on the bytes around them, so an edit only
+	// changes the chunks around it
+	edits := []struct {
+		name   string
+		edited []byte
+	}{
+		{"insert at start", append([]byte("inserted bytes"), data...)},
+		{"insert in middle", append(append(bytes.Clone(data[:8<<20]), "inserted bytes"...), data[8<<20:]...)},
+		{"remove in middle", append(bytes.Clone(data[:8<<20]), data[8<<20+1000:]...)},
+	}
+	for _, edit := range edits {
+		t.Run(edit.name, func(t *testing.T) {
+			seen := map[string]bool{}
+			for _, chunk := range first {
+				seen[string(chunk)] = true
+			}
+			edited := chunks(t, NewChunker(bytes.NewReader(edit.edited)))
+			changed := 0
+			for _, chunk := range edited {
+				if !seen[string(chunk)] {
+					changed++
+				}
+			}
+			if changed > 3 {
+				t.Errorf("%d of %d chunks changed, want at most 3", changed, len(edited))
+			}
+		})
+	}
+}
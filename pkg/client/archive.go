@@ -0,0 +1,89 @@
+package client
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	filesync "grpc-pedrocarlo/pkg/file"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var errUnknownArchiveExtension = errors.New("unknown archive extension, expected .tar, .tar.gz, .tgz or .zip")
+
+// Returns the archive format the server expects for the file at path
+func ArchiveFormat(path string) (string, error) {
+	switch {
+	case strings.HasSuffix(path, ".tar.gz"), strings.HasSuffix(path, ".tgz"):
+		return "tar.gz", nil
+	case strings.HasSuffix(path, ".tar"):
+		return "tar", nil
+	case strings.HasSuffix(path, ".zip"):
+		return "zip", nil
+	}
+	return "", fmt.Errorf("%w: %s", errUnknownArchiveExtension, filepath.Base(path))
+}
+
+// Uploads the content of the local folder dir into folder. The folder is
+// packed as a tar.gz while it is streamed, nothing is written to disk.
+func (c *FileClient) UploadDirectory(ctx context.Context, dir string, folder string) (*filesync.ArchiveUploadResponse, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeTarGz(pw, dir))
+	}()
+	defer pr.Close()
+	return c.UploadArchive(ctx, pr, 0, "tar.gz", folder)
+}
+
+func writeTarGz(w io.Writer, dir string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		err = tw.WriteHeader(header)
+		if err != nil || info.IsDir() {
+			return err
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tw, file)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	return gz.Close()
+}
@@ -0,0 +1,70 @@
+package client
+
+import (
+	"context"
+	"grpc-pedrocarlo/pkg/ratelimit"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// Limits the bytes of the messages sent and received by the streams of a
+// client, all transfers together. Unlimited until a rate is set.
+type bandwidthLimit struct {
+	bucket *ratelimit.Bucket
+}
+
+func newBandwidthLimit() *bandwidthLimit {
+	return &bandwidthLimit{bucket: ratelimit.NewBucket(0, 0)}
+}
+
+func (b *bandwidthLimit) stream(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &throttledStream{ClientStream: stream, bucket: b.bucket}, nil
+}
+
+type throttledStream struct {
+	grpc.ClientStream
+	bucket *ratelimit.Bucket
+	wait   time.Duration // Owed for the last message received
+}
+
+func messageSize(m any) float64 {
+	if message, ok := m.(proto.Message); ok {
+		return float64(proto.Size(message))
+	}
+	return 0
+}
+
+func (s *throttledStream) SendMsg(m any) error {
+	err := s.bucket.Wait(s.Context(), messageSize(m))
+	if err != nil {
+		return err
+	}
+	return s.ClientStream.SendMsg(m)
+}
+
+// The wait for a message is served before receiving the next one, the
+// context of a stream is canceled once its last message was received
+func (s *throttledStream) RecvMsg(m any) error {
+	err := ratelimit.Sleep(s.Context(), s.wait)
+	if err != nil {
+		return err
+	}
+	err = s.ClientStream.RecvMsg(m)
+	if err != nil {
+		return err
+	}
+	s.wait = s.bucket.Reserve(messageSize(m))
+	return nil
+}
+
+// Limits all transfers of the client together to bytes_per_second, 0
+// removes the limit
+func (c *FileClient) SetBandwidth(bytes_per_second int64) {
+	c.bandwidth.bucket.SetRate(float64(bytes_per_second), 0)
+}
@@ -0,0 +1,350 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"grpc-pedrocarlo/pkg/cdc"
+	filesync "grpc-pedrocarlo/pkg/file"
+	"grpc-pedrocarlo/pkg/tracing"
+	"grpc-pedrocarlo/pkg/utils"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Most chunks listed in one message, the server refuses more
+const CHUNKS_PER_MESSAGE = 10000
+
+// Times the manifest of a file is committed before giving up on chunks the
+// server keeps removing
+const COMMIT_ATTEMPTS = 3
+
+var errChunkDifferent = errors.New("received chunk does not match its hash")
+
+// A chunk of a local file
+type chunkRef struct {
+	hash   string
+	offset int64
+	size   int64
+}
+
+// Splits r into content-defined chunks, also returns the hash of the whole data
+func chunkFile(r io.Reader) ([]chunkRef, string, error) {
+	chunker := cdc.NewChunker(r)
+	hasher := sha256.New()
+	refs := []chunkRef{}
+	offset := int64(0)
+	for {
+		data, err := chunker.Next()
+		if err == io.EOF {
+			return refs, hex.EncodeToString(hasher.Sum(nil)), nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		hasher.Write(data)
+		sum := sha256.Sum256(data)
+		refs = append(refs, chunkRef{hash: hex.EncodeToString(sum[:]), offset: offset, size: int64(len(data))})
+		offset += int64(len(data))
+	}
+}
+
+// Uploads the chunks of the file the server does not have yet, then commits
+// the list of its chunks
+func (c *FileClient) uploadChunked(ctx context.Context, file *os.File, folder string, filename string, progress *progressTracker) error {
+	_, span := tracing.StartChild(ctx, "chunk and hash file")
+	refs, filehash, err := chunkFile(file)
+	span.SetAttributes(attribute.Int("filesync.chunks", len(refs)))
+	tracing.End(span, err)
+	if err != nil {
+		return err
+	}
+	// Each distinct chunk is asked about and sent once
+	first := map[string]chunkRef{}
+	hashes := []string{}
+	for _, ref := range refs {
+		if _, ok := first[ref.hash]; !ok {
+			first[ref.hash] = ref
+			hashes = append(hashes, ref.hash)
+		}
+	}
+	// The janitor of the server may remove a chunk it reported stored before
+	// the manifest is committed, the missing chunks are then sent again
+	for attempt := 1; ; attempt++ {
+		missing, err := c.findMissingChunks(ctx, hashes)
+		if err != nil {
+			return err
+		}
+		utils.Log_trace(fmt.Sprintf("%s has %d chunks, %d distinct, %d missing on the server", filename, len(refs), len(hashes), len(missing)))
+		// Chunks sent again were already counted
+		attempt_progress := progress
+		if attempt > 1 {
+			attempt_progress = nil
+		}
+		// Chunks the server has count as sent
+		is_missing := map[string]bool{}
+		for _, hash := range missing {
+			is_missing[hash] = true
+		}
+		for _, ref := range refs {
+			if !is_missing[ref.hash] {
+				attempt_progress.add(ref.size)
+			}
+		}
+		if len(missing) > 0 {
+			err = c.uploadChunks(ctx, file, first, missing, attempt_progress)
+			if err != nil {
+				return err
+			}
+		}
+		err = c.commitManifest(ctx, folder, filename, filehash, refs)
+		if status.Code(err) == codes.FailedPrecondition && attempt < COMMIT_ATTEMPTS {
+			utils.Log_trace(fmt.Sprintf("Chunks of %s were removed by the server, sending them again: %v", filename, err))
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		utils.Log_trace(fmt.Sprintf("Finished upload of file %s", filename))
+		return nil
+	}
+}
+
+// Returns which of hashes the server does not store
+func (c *FileClient) findMissingChunks(ctx context.Context, hashes []string) ([]string, error) {
+	missing := []string{}
+	for start := 0; start < len(hashes); start += CHUNKS_PER_MESSAGE {
+		res, err := c.client.FindMissingChunks(
+			ctx,
+			&filesync.ChunkList{Hashes: hashes[start:min(start+CHUNKS_PER_MESSAGE, len(hashes))]})
+		if err != nil {
+			return nil, err
+		}
+		missing = append(missing, res.Hashes...)
+	}
+	return missing, nil
+}
+
+// Records the file as made of refs. Fails with FailedPrecondition when one of
+// the chunks is not stored.
+func (c *FileClient) commitManifest(ctx context.Context, folder string, filename string, filehash string, refs []chunkRef) error {
+	stream, err := c.client.CommitManifest(ctx)
+	if err != nil {
+		return err
+	}
+	manifest := &filesync.FileManifest{Folder: folder, Filename: filename, Filehash: filehash, Chunked: true}
+	for start := 0; start == 0 || start < len(refs); start += CHUNKS_PER_MESSAGE {
+		for _, ref := range refs[start:min(start+CHUNKS_PER_MESSAGE, len(refs))] {
+			manifest.Chunks = append(manifest.Chunks, &filesync.ChunkRef{Hash: ref.hash, Size: ref.size})
+		}
+		err = stream.Send(manifest)
+		if err != nil {
+			break
+		}
+		manifest = &filesync.FileManifest{}
+	}
+	_, err = stream.CloseAndRecv()
+	return err
+}
+
+// Splits hashes into groups of about segment_size bytes, each moved over
+// one stream
+func groupChunks(hashes []string, size func(hash string) int64, segment_size int64) [][]string {
+	groups := [][]string{}
+	group := []string{}
+	group_size := int64(0)
+	for _, hash := range hashes {
+		if len(group) > 0 && (group_size+size(hash) > segment_size || len(group) == CHUNKS_PER_MESSAGE) {
+			groups = append(groups, group)
+			group, group_size = []string{}, 0
+		}
+		group = append(group, hash)
+		group_size += size(hash)
+	}
+	if len(group) > 0 {
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// Sends the missing chunks read from file, over parallel streams for large
+// uploads
+func (c *FileClient) uploadChunks(ctx context.Context, file *os.File, refs map[string]chunkRef, missing []string, progress *progressTracker) error {
+	total := int64(0)
+	for _, hash := range missing {
+		total += refs[hash].size
+	}
+	streams, segment_size := c.Transfers.plan(total)
+	groups := groupChunks(missing, func(hash string) int64 { return refs[hash].size }, segment_size)
+	var mu sync.Mutex
+	stored, bytes := int32(0), int64(0)
+	err := runParallel(ctx, len(groups), streams, func(ctx context.Context, i int) error {
+		stream, err := c.client.UploadChunks(ctx)
+		if err != nil {
+			return err
+		}
+		for _, hash := range groups[i] {
+			ref := refs[hash]
+			data := make([]byte, ref.size)
+			_, err = file.ReadAt(data, ref.offset)
+			if err != nil {
+				stream.CloseSend()
+				return err
+			}
+			err = stream.Send(&filesync.ChunkData{Hash: hash, Data: data})
+			if err != nil {
+				// The server error is only available from CloseAndRecv
+				break
+			}
+			progress.add(ref.size)
+		}
+		res, err := stream.CloseAndRecv()
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		stored += res.Stored
+		bytes += res.Bytes
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	utils.Log_trace(fmt.Sprintf("Server stored %d new chunks, %d bytes, sent over %d streams", stored, bytes, streams))
+	return nil
+}
+
+// Downloads a file stored as chunks. Chunks found in the copy already in
+// DOWNLOADS_DIR, or earlier in the file, are not downloaded again, the
+// others are downloaded over parallel streams for large files.
+func (c *FileClient) downloadChunked(ctx context.Context, manifest *filesync.FileManifest, refs []*filesync.ChunkRef, progress *progressTracker) error {
+	new_path := filepath.Join(DOWNLOADS_DIR, manifest.Filename)
+	local := map[string]chunkRef{}
+	old_file, err := os.Open(new_path)
+	if err == nil {
+		defer old_file.Close()
+		old_refs, _, err := chunkFile(old_file)
+		if err != nil {
+			return err
+		}
+		for _, ref := range old_refs {
+			local[ref.hash] = ref
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	file, err := os.CreateTemp(TEMP_DIR, utils.TEMP_PATTERN)
+	if err != nil {
+		return err
+	}
+	path := file.Name()
+	utils.Log_trace(fmt.Sprintf("Created temp file: %s", path))
+	defer file.Close()
+	defer os.Remove(path)
+
+	// Offsets where each chunk goes, chunks are fetched or copied once
+	offsets := map[string][]int64{}
+	sizes := map[string]int64{}
+	order := []string{}
+	size := int64(0)
+	for _, ref := range refs {
+		if _, ok := offsets[ref.Hash]; !ok {
+			order = append(order, ref.Hash)
+			sizes[ref.Hash] = ref.Size
+		}
+		offsets[ref.Hash] = append(offsets[ref.Hash], size)
+		size += ref.Size
+	}
+	err = file.Truncate(size)
+	if err != nil {
+		return err
+	}
+	write := func(hash string, data []byte) error {
+		for _, offset := range offsets[hash] {
+			_, err := file.WriteAt(data, offset)
+			if err != nil {
+				return err
+			}
+			progress.add(int64(len(data)))
+		}
+		return nil
+	}
+	missing := []string{}
+	for _, hash := range order {
+		old, ok := local[hash]
+		if !ok || old.size != sizes[hash] {
+			missing = append(missing, hash)
+			continue
+		}
+		data := make([]byte, old.size)
+		_, err = old_file.ReadAt(data, old.offset)
+		if err == nil {
+			err = write(hash, data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	missing_size := int64(0)
+	for _, hash := range missing {
+		missing_size += sizes[hash]
+	}
+	streams, segment_size := c.Transfers.plan(missing_size)
+	groups := groupChunks(missing, func(hash string) int64 { return sizes[hash] }, segment_size)
+	err = runParallel(ctx, len(groups), streams, func(ctx context.Context, i int) error {
+		stream, err := c.client.DownloadChunks(ctx, &filesync.ChunkList{Hashes: groups[i]})
+		if err != nil {
+			return err
+		}
+		for _, hash := range groups[i] {
+			chunk, err := stream.Recv()
+			if err != nil {
+				return err
+			}
+			sum := sha256.Sum256(chunk.Data)
+			if chunk.Hash != hash || hex.EncodeToString(sum[:]) != hash {
+				return fmt.Errorf("%w: %s", errChunkDifferent, hash)
+			}
+			err = write(hash, chunk.Data)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	hasher := sha256.New()
+	_, span := tracing.StartChild(ctx, "hash file", attribute.Int64("filesync.bytes", size))
+	_, err = io.Copy(hasher, io.NewSectionReader(file, 0, size))
+	tracing.End(span, err)
+	if err != nil {
+		return err
+	}
+	if manifest.Filehash != hex.EncodeToString(hasher.Sum(nil)) {
+		return errHashDifferent
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path, new_path)
+	if err != nil {
+		return err
+	}
+	utils.Log_trace(fmt.Sprintf("Finished download of file %s, reused %d chunks, downloaded %d chunks, %d bytes over %d streams", manifest.Filename, len(refs)-len(missing), len(missing), missing_size, streams))
+	return nil
+}
@@ -3,9 +3,11 @@ package client
 import (
 	"context"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"grpc-pedrocarlo/pkg/tracing"
 	"grpc-pedrocarlo/pkg/utils"
 
 	filesync "grpc-pedrocarlo/pkg/file"
@@ -14,37 +16,124 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
 )
 
-const CLIENT_BASE_DIR = "client_files"
+var CLIENT_BASE_DIR = "client_files"
 
 var TEMP_DIR = filepath.Join(CLIENT_BASE_DIR, "tmp")
 var DOWNLOADS_DIR = filepath.Join(CLIENT_BASE_DIR, "downloads")
+
+// Address of the server
+var SERVER_ADDRESS = "127.0.0.1:7070"
+
+// TLS settings of the connection to the server, nil for plaintext
+var TLS_CONFIG *tls.Config
+
+// Bytes of file data sent in each message of a stream. Messages must stay
+// under the 4 MiB gRPC receive limit.
+var MESSAGE_SIZE = 1000000
+
+// Moves the client folders and the transfer queue under dir
+func SetBaseDir(dir string) {
+	CLIENT_BASE_DIR = dir
+	TEMP_DIR = filepath.Join(CLIENT_BASE_DIR, "tmp")
+	DOWNLOADS_DIR = filepath.Join(CLIENT_BASE_DIR, "downloads")
+	TRANSFERS_FILE = filepath.Join(CLIENT_BASE_DIR, "transfers.json")
+}
+
 var errHashDifferent = errors.New("files hashes are not the same")
 
+// Temp files older than this are left over by a client that crashed. Younger
+// ones may belong to another client running from the same folder.
+const TEMP_MAX_AGE = time.Hour
+
 type FileClient struct {
 	client         filesync.FileSyncClient
 	conn           *grpc.ClientConn
 	Curr_dir       string
 	Curr_dir_files map[string]*filesync.FileMetadata
+	Encryption     *E2E // End-to-end encryption, nil when disabled
+	Transfers      TransferOptions
+	Queue          *TransferManager // Background transfers, nil to run them in the foreground
+	bandwidth      *bandwidthLimit
+	names_mu       sync.Mutex        // Transfers of the queue run alongside the REPL
+	remote_names   map[string]string // Encrypted names of the files listed, by decrypted path
 }
 
-func Connect() (*grpc.ClientConn, error) {
-	return grpc.Dial("127.0.0.1:7070", []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock()}...)
+// Dials the server in the background. Calls wait for the connection and are
+// retried as SERVICE_CONFIG says, a lost connection is dialed again with
+// backoff.
+func Connect(opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	creds := insecure.NewCredentials()
+	if TLS_CONFIG != nil {
+		creds = credentials.NewTLS(TLS_CONFIG)
+	}
+	opts = append([]grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
+		grpc.WithDefaultServiceConfig(SERVICE_CONFIG),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                KEEPALIVE_TIME,
+			Timeout:             KEEPALIVE_TIMEOUT,
+			PermitWithoutStream: true,
+		}),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff:           backoff.Config{BaseDelay: 200 * time.Millisecond, Multiplier: 1.6, Jitter: 0.2, MaxDelay: 5 * time.Second},
+			MinConnectTimeout: 5 * time.Second,
+		}),
+		grpc.WithChainUnaryInterceptor(unaryDeadline),
+		grpc.WithChainStreamInterceptor(streamReady),
+	}, opts...)
+	return grpc.Dial(SERVER_ADDRESS, opts...)
 }
 
 func CreateClient() (*FileClient, error) {
-	conn, err := Connect()
+	for _, dir := range []string{TEMP_DIR, DOWNLOADS_DIR} {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+	stats, err := utils.CleanTempDir(TEMP_DIR, TEMP_MAX_AGE)
+	if err != nil {
+		return nil, err
+	}
+	if stats.Removed > 0 {
+		utils.Log_trace(fmt.Sprintf("Removed %d stale temp files, reclaimed %d bytes", stats.Removed, stats.Bytes))
+	}
+	compression := &compressionPicker{}
+	bandwidth := newBandwidthLimit()
+	conn, err := Connect(
+		grpc.WithChainUnaryInterceptor(compression.unary),
+		grpc.WithChainStreamInterceptor(compression.stream, bandwidth.stream),
+	)
 	if err != nil {
 		return nil, err
 	}
 	c := &FileClient{
-		client:   filesync.NewFileSyncClient(conn),
-		conn:     conn,
-		Curr_dir: "/",
+		client:       filesync.NewFileSyncClient(conn),
+		conn:         conn,
+		bandwidth:    bandwidth,
+		Curr_dir:     "/",
+		remote_names: map[string]string{},
+	}
+	err = compression.negotiate(c.client)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if compression.name != "" {
+		utils.Log_trace(fmt.Sprintf("Compressing messages with %s", compression.name))
 	}
 	return c, nil
 }
@@ -56,14 +145,13 @@ func (c *FileClient) CloseClient() {
 	}
 }
 
-func (c *FileClient) GetFileList(folder string) ([]*filesync.FileMetadata, error) {
-	// Change this to implement deadlines and other things
+func (c *FileClient) GetFileList(ctx context.Context, folder string) ([]*filesync.FileMetadata, error) {
 	folder_name := filepath.Base(folder)
 	if folder_name == "/" {
 		folder_name = ""
 	}
 	m, err := c.client.FileList(
-		context.Background(),
+		ctx,
 		&filesync.FileListRequest{
 			ParentFolder: filepath.Dir(folder),
 			FolderName:   folder_name,
@@ -71,55 +159,158 @@ func (c *FileClient) GetFileList(folder string) ([]*filesync.FileMetadata, error
 	if err != nil {
 		return nil, err
 	}
+	if c.Encryption.Covers(folder) && c.Encryption.Names {
+		for _, file := range m.Files {
+			if file.IsDir {
+				continue
+			}
+			name, ok := c.Encryption.DecryptName(file.Filename)
+			if ok {
+				c.names_mu.Lock()
+				c.remote_names[filepath.Join(file.Folder, name)] = file.Filename
+				c.names_mu.Unlock()
+				file.Filename = name
+			}
+		}
+	}
 	return m.Files, nil
 }
 
-func (c *FileClient) DownloadFile(file_meta *filesync.FileMetadata) error {
-	// Create a temp File with current timestamp as filename
+// Name of the file on the server, encrypted in folders with encrypted names
+func (c *FileClient) remoteName(folder string, filename string) (string, error) {
+	if !c.Encryption.Covers(folder) || !c.Encryption.Names {
+		return filename, nil
+	}
+	c.names_mu.Lock()
+	name, ok := c.remote_names[filepath.Join(folder, filename)]
+	c.names_mu.Unlock()
+	if ok {
+		return name, nil
+	}
+	return c.Encryption.EncryptName(filename)
+}
+
+// Downloads the file into DOWNLOADS_DIR. Files stored as chunks only get
+// the chunks missing from the copy already downloaded, large files are
+// split into segments downloaded over parallel streams, and files of
+// end-to-end encrypted folders are decrypted. Progress is reported to the
+// ProgressFunc of ctx, canceling ctx stops the download and removes what
+// was downloaded.
+func (c *FileClient) DownloadFile(ctx context.Context, file_meta *filesync.FileMetadata) error {
 	if file_meta == nil {
 		return errors.New("nil file_meta")
 	}
-	file, err := os.CreateTemp(TEMP_DIR, "*")
+	ctx, span := tracing.Start(ctx, "FileClient.DownloadFile",
+		attribute.String("filesync.folder", file_meta.Folder),
+		attribute.String("filesync.filename", file_meta.Filename))
+	err := c.downloadFile(ctx, file_meta)
+	tracing.End(span, err)
+	return err
+}
+
+func (c *FileClient) downloadFile(ctx context.Context, file_meta *filesync.FileMetadata) error {
+	remote_name, err := c.remoteName(file_meta.Folder, file_meta.Filename)
+	if err != nil {
+		return err
+	}
+	stream, err := c.client.GetManifest(
+		ctx,
+		&filesync.FileMetadata{Folder: file_meta.Folder, Filename: remote_name})
+	if err != nil {
+		return err
+	}
+	manifest, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	progress := newProgress(ctx, manifest.Size)
+	if !manifest.Chunked || c.Encryption.Covers(file_meta.Folder) {
+		streams, _ := c.Transfers.plan(manifest.Size)
+		if streams > 1 {
+			err = c.downloadSegmented(ctx, file_meta, remote_name, manifest, progress)
+		} else {
+			err = c.downloadStream(ctx, file_meta, remote_name, progress)
+		}
+		if err == nil {
+			progress.done()
+		}
+		return err
+	}
+	refs := manifest.Chunks
+	for {
+		next, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		refs = append(refs, next.Chunks...)
+	}
+	err = c.downloadChunked(ctx, manifest, refs, progress)
+	if err == nil {
+		progress.done()
+	}
+	return err
+}
+
+// Downloads the file as a single stream
+func (c *FileClient) downloadStream(ctx context.Context, file_meta *filesync.FileMetadata, remote_name string, progress *progressTracker) error {
+	stream, err := c.client.FileDownload(
+		ctx,
+		&filesync.FileMetadata{Folder: file_meta.Folder, Filename: remote_name})
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(TEMP_DIR, utils.TEMP_PATTERN)
+	if err != nil {
+		return err
+	}
 	path := file.Name()
 	utils.Log_trace(fmt.Sprintf("Created temp file: %s", path))
 	defer file.Close()
 	defer os.Remove(path)
-	if err != nil {
-		return err
 
-	}
+	// The server hash is the hash of what it stores, ciphertext when encrypted
+	hasher := sha256.New()
+	var out io.Writer = file
+	var decrypter *decryptWriter
 	var done bool = false
-	var stream filesync.FileSync_FileDownloadClient = nil
 	var res *filesync.FileBytesMessage
-	// TODO implement timeout here as well
-	for !done {
-		if stream == nil {
-			stream, err = c.client.FileDownload(context.Background(), file_meta)
-			if err != nil {
-				return err
-			}
-		}
+	for first := true; !done; first = false {
 		res, err = stream.Recv()
 		if err != nil {
 			return err
 		}
-		_, err = file.Write(res.Response.Chunk)
+		chunk := res.Response.Chunk
+		// Files of covered folders must decrypt, the server could swap
+		// them for other bytes with a matching hash otherwise
+		if first && c.Encryption.Covers(file_meta.Folder) {
+			decrypter = c.Encryption.newDecryptWriter(file)
+			out = decrypter
+		}
+		hasher.Write(chunk)
+		_, err = out.Write(chunk)
 		if err != nil {
 			return err
 		}
+		progress.add(int64(len(chunk)))
 		done = res.Response.Done
 	}
-	new_path := filepath.Join(DOWNLOADS_DIR, res.Filename)
-	// Check hash of file
-	hasher := sha256.New()
-	file.Seek(0, io.SeekStart)
-	io.Copy(hasher, file)
-	if err != nil {
-		return err
-	}
 	if res.Filehash != hex.EncodeToString(hasher.Sum(nil)) {
 		return errHashDifferent
 	}
+	if decrypter != nil {
+		err = decrypter.Close()
+		if err != nil {
+			return err
+		}
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	new_path := filepath.Join(DOWNLOADS_DIR, file_meta.Filename)
 	err = os.Rename(path, new_path)
 	if err != nil {
 		return err
@@ -128,59 +319,74 @@ func (c *FileClient) DownloadFile(file_meta *filesync.FileMetadata) error {
 	return nil
 }
 
-func (c *FileClient) UploadFile(file *os.File, folder string) error {
+// Uploads the file into folder. Only the chunks the server does not store
+// yet are sent. Files of end-to-end encrypted folders are encrypted on the
+// way and sent whole, their ciphertext shares no chunks with other files.
+// Large files are sent over parallel streams either way. Progress is
+// reported to the ProgressFunc of ctx, canceling ctx stops the upload and
+// the server drops what it received.
+func (c *FileClient) UploadFile(ctx context.Context, file *os.File, folder string) error {
 	if file == nil {
 		return errors.New("nil file")
 	}
-	hasher := sha256.New()
-	_, err := io.Copy(hasher, file)
-	if err != nil {
-		return err
-	}
-	hash := hex.EncodeToString(hasher.Sum(nil))
-	filename := filepath.Base(file.Name())
-	_, err = file.Seek(0, io.SeekStart)
-	if err != nil {
-		return err
-	}
+	ctx, span := tracing.Start(ctx, "FileClient.UploadFile",
+		attribute.String("filesync.folder", folder),
+		attribute.String("filesync.filename", filepath.Base(file.Name())))
+	err := c.uploadFile(ctx, file, folder)
+	tracing.End(span, err)
+	return err
+}
 
-	temp_file, err := os.CreateTemp(TEMP_DIR, "*")
-	path := temp_file.Name()
-	utils.Log_trace(fmt.Sprintf("Created temp file: %s", path))
-	defer temp_file.Close()
-	defer os.Remove(path)
+func (c *FileClient) uploadFile(ctx context.Context, file *os.File, folder string) error {
+	filename, err := c.remoteName(folder, filepath.Base(file.Name()))
 	if err != nil {
 		return err
 	}
-	_, err = io.Copy(temp_file, file)
+	info, err := file.Stat()
 	if err != nil {
 		return err
 	}
-	_, err = temp_file.Seek(0, io.SeekStart)
-	if err != nil {
-		return err
+	progress := newProgress(ctx, info.Size())
+	if !c.Encryption.Covers(folder) {
+		err = c.uploadChunked(ctx, file, folder, filename, progress)
+	} else if streams, _ := c.Transfers.plan(info.Size()); streams > 1 {
+		err = c.uploadEncryptedSegments(ctx, file, info.Size(), folder, filename, progress)
+	} else {
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		go func() {
+			pw.CloseWithError(c.Encryption.encrypt(pw, &progressReader{r: file, progress: progress}, info.Size()))
+		}()
+		err = c.uploadStream(ctx, pr, folder, filename)
+	}
+	if err == nil {
+		progress.done()
 	}
+	return err
+}
 
-	bytesRead := 0
-	mb := 1000000
-	buf := make([]byte, mb)
-	var done bool = false
-	stream, err := c.client.FileUpload(context.Background())
+// Uploads what is read from r as a single stream, hashing it on the way
+func (c *FileClient) uploadStream(ctx context.Context, r io.Reader, folder string, filename string) error {
+	stream, err := c.client.FileUpload(ctx)
 	if err != nil {
 		return err
 	}
+	hasher := sha256.New()
+	buf := make([]byte, MESSAGE_SIZE)
+	var done bool = false
 	for !done {
-		n, err := temp_file.Read(buf)
-		if err != nil {
-			if err == io.EOF {
-				done = true
-			} else {
-				return err
-			}
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			done = true
+		} else if err != nil {
+			stream.CloseSend()
+			return err
 		}
-		bytesRead += n
-		if done && n == 0 {
-			buf = make([]byte, 0)
+		hasher.Write(buf[:n])
+		// The server checks the hash of the last message
+		hash := ""
+		if done {
+			hash = hex.EncodeToString(hasher.Sum(nil))
 		}
 		err = stream.Send(&filesync.FileBytesMessage{
 			Folder:   folder,
@@ -189,10 +395,11 @@ func (c *FileClient) UploadFile(file *os.File, folder string) error {
 			Response: &filesync.FileResponse{Chunk: buf[:n], Done: done},
 		})
 		if err != nil {
-			stream.CloseSend()
-			return err
+			// The server error is only available from RecvMsg
+			break
 		}
 	}
+	stream.CloseSend()
 	m := &filesync.FileBytesMessage{}
 	err = stream.RecvMsg(m)
 	log.Println(m)
@@ -202,23 +409,134 @@ func (c *FileClient) UploadFile(file *os.File, folder string) error {
 	return nil
 }
 
-func (c *FileClient) Mkdir(folder string) (*filesync.FileMetadata, error) {
+// Downloads folder as a tar, tar.gz or zip archive into DOWNLOADS_DIR and
+// returns the path of the archive. The size of the archive is not known in
+// advance, the progress reported has no total.
+func (c *FileClient) DownloadArchive(ctx context.Context, folder string, format string) (string, error) {
+	ctx, span := tracing.Start(ctx, "FileClient.DownloadArchive",
+		attribute.String("filesync.folder", folder),
+		attribute.String("filesync.format", format))
+	path, err := c.downloadArchive(ctx, folder, format)
+	tracing.End(span, err)
+	return path, err
+}
+
+func (c *FileClient) downloadArchive(ctx context.Context, folder string, format string) (string, error) {
+	stream, err := c.client.DownloadArchive(
+		ctx,
+		&filesync.ArchiveRequest{Folder: folder, Format: format})
+	if err != nil {
+		return "", err
+	}
+	file, err := os.CreateTemp(TEMP_DIR, utils.TEMP_PATTERN)
+	if err != nil {
+		return "", err
+	}
+	path := file.Name()
+	defer file.Close()
+	defer os.Remove(path)
+	progress := newProgress(ctx, 0)
+	var done bool = false
+	for !done {
+		res, err := stream.Recv()
+		if err != nil {
+			return "", err
+		}
+		_, err = file.Write(res.Chunk)
+		if err != nil {
+			return "", err
+		}
+		progress.add(int64(len(res.Chunk)))
+		done = res.Done
+	}
+	err = file.Close()
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Base(folder)
+	if name == "/" {
+		name = "files"
+	}
+	new_path := filepath.Join(DOWNLOADS_DIR, name+"."+format)
+	err = os.Rename(path, new_path)
+	if err != nil {
+		return "", err
+	}
+	progress.done()
+	utils.Log_trace(fmt.Sprintf("Finished download of archive %s", new_path))
+	return new_path, nil
+}
+
+// Streams a tar, tar.gz or zip archive read from r to the server, which
+// extracts it into folder. The progress reported counts the bytes of the
+// archive, its total is size, 0 when unknown.
+func (c *FileClient) UploadArchive(ctx context.Context, r io.Reader, size int64, format string, folder string) (*filesync.ArchiveUploadResponse, error) {
+	if c.Encryption.Covers(folder) {
+		return nil, errE2EArchive
+	}
+	ctx, span := tracing.Start(ctx, "FileClient.UploadArchive",
+		attribute.String("filesync.folder", folder),
+		attribute.String("filesync.format", format))
+	res, err := c.uploadArchive(ctx, r, size, format, folder)
+	tracing.End(span, err)
+	return res, err
+}
+
+func (c *FileClient) uploadArchive(ctx context.Context, r io.Reader, size int64, format string, folder string) (*filesync.ArchiveUploadResponse, error) {
+	stream, err := c.client.UploadArchive(ctx)
+	if err != nil {
+		return nil, err
+	}
+	progress := newProgress(ctx, size)
+	buf := make([]byte, MESSAGE_SIZE)
+	var done bool = false
+	for !done {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			done = true
+		} else if err != nil {
+			stream.CloseSend()
+			return nil, err
+		}
+		err = stream.Send(&filesync.ArchiveUploadMessage{
+			Folder:   folder,
+			Format:   format,
+			Response: &filesync.FileResponse{Chunk: buf[:n], Done: done},
+		})
+		if err != nil {
+			// The server error is only available from CloseAndRecv
+			break
+		}
+		progress.add(int64(n))
+	}
+	res, err := stream.CloseAndRecv()
+	if err == nil {
+		progress.done()
+	}
+	return res, err
+}
+
+func (c *FileClient) Mkdir(ctx context.Context, folder string) (*filesync.FileMetadata, error) {
 	return c.client.MkDir(
-		context.Background(),
+		ctx,
 		&filesync.MkdirRequest{Folder: folder},
 	)
 }
 
-func (c *FileClient) RemoveFile(folder string, filename string) error {
-	_, err := c.client.RemoveFile(
-		context.Background(),
+func (c *FileClient) RemoveFile(ctx context.Context, folder string, filename string) error {
+	filename, err := c.remoteName(folder, filename)
+	if err != nil {
+		return err
+	}
+	_, err = c.client.RemoveFile(
+		ctx,
 		&filesync.RemoveFileRequest{Folder: folder, Filename: filename})
 	return err
 }
 
-func (c *FileClient) RemoveDir(folder string) error {
+func (c *FileClient) RemoveDir(ctx context.Context, folder string) error {
 	_, err := c.client.RemoveDir(
-		context.Background(),
+		ctx,
 		&filesync.RemoveDirRequest{Folder: folder})
 	return err
 }
@@ -0,0 +1,59 @@
+package client
+
+import (
+	"context"
+	filesync "grpc-pedrocarlo/pkg/file"
+	"grpc-pedrocarlo/pkg/zstd"
+	"strings"
+
+	"google.golang.org/grpc"
+	_ "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+)
+
+// Header the server uses to list the compressors it accepts
+const COMPRESSORS_HEADER = "filesync-compressors"
+
+// Compressors of the messages sent by the client, in order of preference.
+// The first one the server also accepts is used.
+var WIRE_COMPRESSION = []string{zstd.NAME, "gzip"}
+
+// Adds the negotiated compressor to every call, servers that did not
+// advertise any compressor get uncompressed messages
+type compressionPicker struct {
+	name string
+}
+
+// Asks the server which compressors it accepts and picks the preferred one
+func (p *compressionPicker) negotiate(client filesync.FileSyncClient) error {
+	var header metadata.MD
+	_, err := client.FileList(context.Background(), &filesync.FileListRequest{ParentFolder: "/"}, grpc.Header(&header))
+	if err != nil {
+		return err
+	}
+	accepted := strings.Split(strings.Join(header.Get(COMPRESSORS_HEADER), ","), ",")
+	for _, name := range WIRE_COMPRESSION {
+		for _, server_name := range accepted {
+			if name == server_name {
+				p.name = name
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+func (p *compressionPicker) options(opts []grpc.CallOption) []grpc.CallOption {
+	if p.name == "" {
+		return opts
+	}
+	return append(opts, grpc.UseCompressor(p.name))
+}
+
+func (p *compressionPicker) unary(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return invoker(ctx, method, req, reply, cc, p.options(opts)...)
+}
+
+func (p *compressionPicker) stream(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return streamer(ctx, desc, cc, method, p.options(opts)...)
+}
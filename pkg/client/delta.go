@@ -0,0 +1,121 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"grpc-pedrocarlo/pkg/delta"
+	filesync "grpc-pedrocarlo/pkg/file"
+	"grpc-pedrocarlo/pkg/utils"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Literal bytes held by a DeltaMessage before it is sent, it is also sent
+// once it holds CHUNKS_PER_MESSAGE ops
+const DELTA_MESSAGE_SIZE = 1 << 20
+
+var errBadSignature = errors.New("server sent a malformed signature")
+
+// Uploads the file into folder, sending only what changed since the version
+// stored on the server. Files of end-to-end encrypted folders are uploaded
+// whole, their ciphertext changes completely with every upload. The
+// progress reported counts the bytes of the file compared.
+func (c *FileClient) SyncFile(ctx context.Context, file *os.File, folder string) error {
+	if file == nil {
+		return errors.New("nil file")
+	}
+	if c.Encryption.Covers(folder) {
+		return c.UploadFile(ctx, file, folder)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	filename := filepath.Base(file.Name())
+	sig, base_hash, err := c.getSignature(ctx, folder, filename)
+	if err != nil {
+		return err
+	}
+
+	progress := newProgress(ctx, info.Size())
+	stream, err := c.client.UploadDelta(ctx)
+	if err != nil {
+		return err
+	}
+	message := &filesync.DeltaMessage{Folder: folder, Filename: filename, BaseHash: base_hash}
+	size := 0
+	literal, copied := int64(0), int64(0)
+	hasher := sha256.New()
+	err = delta.Diff(io.TeeReader(&progressReader{r: file, progress: progress}, hasher), sig, func(op delta.Op) error {
+		message.Ops = append(message.Ops, &filesync.DeltaOp{Data: op.Data, Block: op.Block, Blocks: op.Blocks})
+		literal += int64(len(op.Data))
+		copied += op.Blocks
+		size += len(op.Data)
+		if size < DELTA_MESSAGE_SIZE && len(message.Ops) < CHUNKS_PER_MESSAGE {
+			return nil
+		}
+		err := stream.Send(message)
+		message = &filesync.DeltaMessage{}
+		size = 0
+		return err
+	})
+	if err == nil {
+		// The server checks the hash of the last message
+		message.Filehash = hex.EncodeToString(hasher.Sum(nil))
+		err = stream.Send(message)
+	}
+	if err == io.EOF {
+		// The server error is only available from CloseAndRecv
+		err = nil
+	}
+	if err != nil {
+		stream.CloseSend()
+		return err
+	}
+	_, err = stream.CloseAndRecv()
+	if err != nil {
+		return err
+	}
+	progress.done()
+	utils.Log_trace(fmt.Sprintf("Synced %s, sent %d literal bytes and reused %d blocks of %d bytes", filename, literal, copied, sig.BlockSize))
+	return nil
+}
+
+// Signature of the version of the file stored on the server and its hash,
+// empty when there is none
+func (c *FileClient) getSignature(ctx context.Context, folder string, filename string) (*delta.Signature, string, error) {
+	stream, err := c.client.GetSignature(
+		ctx,
+		&filesync.SignatureRequest{Folder: folder, Filename: filename})
+	if err != nil {
+		return nil, "", err
+	}
+	first, err := stream.Recv()
+	if err != nil {
+		return nil, "", err
+	}
+	if first.BlockSize < delta.MIN_BLOCK_SIZE || first.BlockSize > delta.MAX_BLOCK_SIZE {
+		return nil, "", fmt.Errorf("%w: block size %d", errBadSignature, first.BlockSize)
+	}
+	sig := &delta.Signature{BlockSize: int(first.BlockSize), Size: first.Size}
+	for message := first; ; {
+		for _, block := range message.Blocks {
+			sig.Blocks = append(sig.Blocks, delta.Block{Weak: block.Weak, Strong: block.Strong})
+		}
+		message, err = stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	if int64(len(sig.Blocks)) != (sig.Size+int64(sig.BlockSize)-1)/int64(sig.BlockSize) {
+		return nil, "", fmt.Errorf("%w: %d blocks for %d bytes", errBadSignature, len(sig.Blocks), sig.Size)
+	}
+	return sig, first.Filehash, nil
+}
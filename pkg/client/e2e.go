@@ -0,0 +1,312 @@
+package client
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"grpc-pedrocarlo/pkg/utils"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted files start with a header holding E2E_MAGIC, a random salt and
+// the size of the plaintext, authenticated by every segment. The plaintext
+// follows in segments of up to E2E_SEGMENT_SIZE bytes sealed with AES-GCM,
+// then a last segment holding the SHA-256 of the plaintext. The key of each
+// file is derived from the master key and the salt.
+const (
+	E2E_MAGIC        = "FSC1"
+	E2E_SEGMENT_SIZE = 64 << 10
+	E2E_KEY_SIZE     = 32
+)
+
+// Environment variable holding the passphrase the master key is derived from
+const E2E_PASSPHRASE_ENV = "FILESYNC_E2E_PASSPHRASE"
+
+// Every client must derive the same key from the same passphrase, so the
+// salt is fixed, scrypt makes guessing passphrases expensive
+var e2ePassphraseSalt = []byte("grpc-pedrocarlo filesync e2e")
+
+const (
+	e2eSaltSize   = 16
+	e2eHeaderSize = len(E2E_MAGIC) + e2eSaltSize + 8
+)
+
+var (
+	errE2ECorrupted     = errors.New("encrypted file is corrupted or was encrypted with another key")
+	errE2EHashDifferent = errors.New("decrypted file hash is not the one it was encrypted with")
+	errE2ESizeChanged   = errors.New("file size changed while it was encrypted")
+	errE2EArchive       = errors.New("archives are extracted by the server, they can't be uploaded to an end-to-end encrypted folder")
+	errE2EBadKeyFile    = errors.New("malformed end-to-end key file")
+)
+
+// Client-side end-to-end encryption of the files in some remote folders.
+// The server only sees ciphertext, and the hashes it checks are hashes of
+// the ciphertext. With Names set, file names are encrypted as well, folder
+// names never are.
+type E2E struct {
+	Folders []string // Remote folders, with their subfolders, whose files are encrypted
+	Names   bool
+
+	key      []byte
+	name_key []byte
+	name_mac []byte
+}
+
+// Master key read from a key file holding it in base64, the file is created
+// with a new random key if missing
+func LoadE2EKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		key := make([]byte, E2E_KEY_SIZE)
+		_, err = rand.Read(key)
+		if err != nil {
+			return nil, err
+		}
+		utils.Log_trace(fmt.Sprintf("Creating end-to-end key file %s", path))
+		return key, os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != E2E_KEY_SIZE {
+		return nil, fmt.Errorf("%w %s: expected a %d bytes key in base64", errE2EBadKeyFile, path, E2E_KEY_SIZE)
+	}
+	return key, nil
+}
+
+// Master key derived from a passphrase
+func DeriveE2EKey(passphrase string) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), e2ePassphraseSalt, 1<<15, 8, 1, E2E_KEY_SIZE)
+}
+
+func NewE2E(key []byte, folders []string, names bool) (*E2E, error) {
+	e := &E2E{Folders: folders, Names: names, key: key}
+	for _, folder := range folders {
+		if !strings.HasPrefix(folder, "/") {
+			return nil, fmt.Errorf("end-to-end encrypted folder %q is not absolute", folder)
+		}
+	}
+	var err error
+	e.name_key, err = e.subkey(nil, "names")
+	if err != nil {
+		return nil, err
+	}
+	e.name_mac, err = e.subkey(nil, "name nonces")
+	return e, err
+}
+
+func (e *E2E) subkey(salt []byte, purpose string) ([]byte, error) {
+	key := make([]byte, E2E_KEY_SIZE)
+	_, err := io.ReadFull(hkdf.New(sha256.New, e.key, salt, []byte("filesync e2e "+purpose)), key)
+	return key, err
+}
+
+// Reports whether files in the remote folder are encrypted, false for a nil E2E
+func (e *E2E) Covers(folder string) bool {
+	if e == nil {
+		return false
+	}
+	folder = filepath.Clean(folder)
+	for _, covered := range e.Folders {
+		rel, err := filepath.Rel(filepath.Clean(covered), folder)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+			return true
+		}
+	}
+	return false
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypts a file name. The same name always gives the same encrypted name,
+// so files can be found by name without listing the folder.
+func (e *E2E) EncryptName(name string) (string, error) {
+	aead, err := newAEAD(e.name_key)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, e.name_mac)
+	mac.Write([]byte(name))
+	nonce := mac.Sum(nil)[:aead.NonceSize()]
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(name), nil)), nil
+}
+
+// Decrypts a file name, ok is false for names not encrypted with this key
+func (e *E2E) DecryptName(encrypted string) (name string, ok bool) {
+	aead, err := newAEAD(e.name_key)
+	if err != nil {
+		return "", false
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(encrypted)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", false
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", false
+	}
+	return string(plain), true
+}
+
+func e2eNonce(aead cipher.AEAD, index int64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], uint64(index))
+	return nonce
+}
+
+func e2eAdditionalData(header []byte, last bool) []byte {
+	if last {
+		return append(header[:len(header):len(header)], 1)
+	}
+	return append(header[:len(header):len(header)], 0)
+}
+
+// Encrypts the size bytes read from r into w
+func (e *E2E) encrypt(w io.Writer, r io.Reader, size int64) error {
+	header := make([]byte, e2eHeaderSize)
+	copy(header, E2E_MAGIC)
+	salt := header[len(E2E_MAGIC) : len(E2E_MAGIC)+e2eSaltSize]
+	_, err := rand.Read(salt)
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint64(header[len(E2E_MAGIC)+e2eSaltSize:], uint64(size))
+	key, err := e.subkey(salt, "content")
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(header)
+	if err != nil {
+		return err
+	}
+
+	hasher := sha256.New()
+	plain := make([]byte, E2E_SEGMENT_SIZE)
+	sealed := make([]byte, 0, E2E_SEGMENT_SIZE+aead.Overhead())
+	br := bufio.NewReaderSize(r, E2E_SEGMENT_SIZE)
+	index := int64(0)
+	for left := size; left > 0; left -= int64(len(plain)) {
+		plain = plain[:min(left, E2E_SEGMENT_SIZE)]
+		_, err := io.ReadFull(br, plain)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return errE2ESizeChanged
+		}
+		if err != nil {
+			return err
+		}
+		hasher.Write(plain)
+		sealed = aead.Seal(sealed[:0], e2eNonce(aead, index), plain, e2eAdditionalData(header, false))
+		_, err = w.Write(sealed)
+		if err != nil {
+			return err
+		}
+		index++
+	}
+	_, err = br.Peek(1)
+	if err != io.EOF {
+		return errE2ESizeChanged
+	}
+	sealed = aead.Seal(sealed[:0], e2eNonce(aead, index), hasher.Sum(nil), e2eAdditionalData(header, true))
+	_, err = w.Write(sealed)
+	return err
+}
+
+// Decrypts what is written to it into w. Close checks the file was complete
+// and that the plaintext hash is the one the file was encrypted with.
+type decryptWriter struct {
+	e      *E2E
+	w      io.Writer
+	buf    []byte
+	header []byte
+	aead   cipher.AEAD
+	left   int64 // Plaintext bytes not decrypted yet
+	index  int64
+	hasher hash.Hash
+}
+
+func (e *E2E) newDecryptWriter(w io.Writer) *decryptWriter {
+	return &decryptWriter{e: e, w: w, hasher: sha256.New()}
+}
+
+func (d *decryptWriter) Write(p []byte) (int, error) {
+	d.buf = append(d.buf, p...)
+	if d.aead == nil {
+		if len(d.buf) < e2eHeaderSize {
+			return len(p), nil
+		}
+		d.header = append([]byte{}, d.buf[:e2eHeaderSize]...)
+		d.buf = d.buf[e2eHeaderSize:]
+		if string(d.header[:len(E2E_MAGIC)]) != E2E_MAGIC {
+			return 0, errE2ECorrupted
+		}
+		key, err := d.e.subkey(d.header[len(E2E_MAGIC):len(E2E_MAGIC)+e2eSaltSize], "content")
+		if err != nil {
+			return 0, err
+		}
+		d.aead, err = newAEAD(key)
+		if err != nil {
+			return 0, err
+		}
+		d.left = int64(binary.BigEndian.Uint64(d.header[len(E2E_MAGIC)+e2eSaltSize:]))
+	}
+	for d.left > 0 {
+		sealed_size := int(min(d.left, E2E_SEGMENT_SIZE)) + d.aead.Overhead()
+		if len(d.buf) < sealed_size {
+			break
+		}
+		plain, err := d.aead.Open(nil, e2eNonce(d.aead, d.index), d.buf[:sealed_size], e2eAdditionalData(d.header, false))
+		if err != nil {
+			return 0, errE2ECorrupted
+		}
+		d.buf = d.buf[sealed_size:]
+		d.left -= int64(len(plain))
+		d.index++
+		d.hasher.Write(plain)
+		_, err = d.w.Write(plain)
+		if err != nil {
+			return 0, err
+		}
+	}
+	// Keeps the memory used bounded by a segment
+	d.buf = append(make([]byte, 0, E2E_SEGMENT_SIZE+d.aead.Overhead()), d.buf...)
+	return len(p), nil
+}
+
+func (d *decryptWriter) Close() error {
+	if d.aead == nil || d.left > 0 {
+		return errE2ECorrupted
+	}
+	sum, err := d.aead.Open(nil, e2eNonce(d.aead, d.index), d.buf, e2eAdditionalData(d.header, true))
+	if err != nil {
+		return errE2ECorrupted
+	}
+	if !hmac.Equal(sum, d.hasher.Sum(nil)) {
+		return errE2EHashDifferent
+	}
+	return nil
+}
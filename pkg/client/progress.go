@@ -0,0 +1,117 @@
+package client
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Minimum time between two progress reports of a transfer
+const PROGRESS_INTERVAL = 200 * time.Millisecond
+
+// State of a transfer given to a ProgressFunc
+type Progress struct {
+	Bytes int64         // Bytes transferred, or skipped because the other side had them
+	Total int64         // Size of the transfer, 0 when unknown
+	Rate  float64       // Bytes per second, smoothed over the last reports
+	ETA   time.Duration // Time left at the current rate, 0 when unknown
+	Done  bool          // Set on the last report of a successful transfer
+}
+
+type ProgressFunc func(Progress)
+
+type progressKey struct{}
+
+// Returns a context whose transfers report their progress to fn. Transfers
+// over parallel streams report from several goroutines, never at once.
+func WithProgress(ctx context.Context, fn ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+// Counts the bytes of one transfer and reports them to the ProgressFunc of
+// its context, if any. A nil tracker counts nothing.
+type progressTracker struct {
+	fn ProgressFunc
+
+	mu         sync.Mutex
+	progress   Progress
+	last       time.Time // Of the last report
+	last_bytes int64
+}
+
+func newProgress(ctx context.Context, total int64) *progressTracker {
+	fn, ok := ctx.Value(progressKey{}).(ProgressFunc)
+	if !ok || fn == nil {
+		return nil
+	}
+	now := time.Now()
+	p := &progressTracker{fn: fn, progress: Progress{Total: total}, last: now}
+	fn(p.progress)
+	return p
+}
+
+func (p *progressTracker) setTotal(total int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.progress.Total = total
+}
+
+func (p *progressTracker) add(n int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.progress.Bytes += n
+	now := time.Now()
+	if now.Sub(p.last) < PROGRESS_INTERVAL {
+		return
+	}
+	p.report(now)
+}
+
+// Must hold p.mu
+func (p *progressTracker) report(now time.Time) {
+	elapsed := now.Sub(p.last).Seconds()
+	if elapsed > 0 {
+		rate := float64(p.progress.Bytes-p.last_bytes) / elapsed
+		if p.progress.Rate == 0 {
+			p.progress.Rate = rate
+		} else {
+			p.progress.Rate = 0.7*p.progress.Rate + 0.3*rate
+		}
+	}
+	p.progress.ETA = 0
+	if p.progress.Total > 0 && p.progress.Rate > 0 && p.progress.Bytes < p.progress.Total {
+		p.progress.ETA = time.Duration(float64(p.progress.Total-p.progress.Bytes) / p.progress.Rate * float64(time.Second))
+	}
+	p.last, p.last_bytes = now, p.progress.Bytes
+	p.fn(p.progress)
+}
+
+// Reports the end of a successful transfer
+func (p *progressTracker) done() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.progress.Done = true
+	p.report(time.Now())
+}
+
+// Counts the bytes read through it
+type progressReader struct {
+	r        io.Reader
+	progress *progressTracker
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.progress.add(int64(n))
+	return n, err
+}
@@ -0,0 +1,103 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+)
+
+// Deadline of unary calls made without one
+const CALL_TIMEOUT = 30 * time.Second
+
+// How long a call waits for the connection to come back before failing
+const RECONNECT_TIMEOUT = 30 * time.Second
+
+// Pings sent on an idle connection, and how long an answer may take before
+// the connection is considered dead and dialed again
+const (
+	KEEPALIVE_TIME    = 30 * time.Second
+	KEEPALIVE_TIMEOUT = 10 * time.Second
+)
+
+// Calls are retried with exponential backoff, from 200ms to 5s, when the
+// server is unreachable or over its rate limits. The server tells how long to
+// wait in the grpc-retry-pushback-ms trailer. Calls that change something
+// are only retried when they were refused before being handled, a lost
+// answer to them can not be told apart from a failure.
+const SERVICE_CONFIG = `{
+	"methodConfig": [{
+		"name": [{"service": "file.FileSync"}, {"service": "file.Admin"}],
+		"retryPolicy": {
+			"maxAttempts": 5,
+			"initialBackoff": "0.2s",
+			"maxBackoff": "5s",
+			"backoffMultiplier": 2,
+			"retryableStatusCodes": ["UNAVAILABLE", "RESOURCE_EXHAUSTED"]
+		}
+	}, {
+		"name": [
+			{"service": "file.FileSync", "method": "FileUpload"},
+			{"service": "file.FileSync", "method": "MkDir"},
+			{"service": "file.FileSync", "method": "RemoveFile"},
+			{"service": "file.FileSync", "method": "RemoveDir"},
+			{"service": "file.FileSync", "method": "UploadArchive"},
+			{"service": "file.FileSync", "method": "CommitManifest"},
+			{"service": "file.FileSync", "method": "UploadDelta"},
+			{"service": "file.FileSync", "method": "CommitUpload"}
+		],
+		"retryPolicy": {
+			"maxAttempts": 5,
+			"initialBackoff": "0.2s",
+			"maxBackoff": "5s",
+			"backoffMultiplier": 2,
+			"retryableStatusCodes": ["RESOURCE_EXHAUSTED"]
+		}
+	}]
+}`
+
+// Waits up to RECONNECT_TIMEOUT for the connection to be ready, so calls
+// made while the server restarts are delayed instead of failing at once
+func awaitReady(ctx context.Context, cc *grpc.ClientConn) error {
+	ctx, cancel := context.WithTimeout(ctx, RECONNECT_TIMEOUT)
+	defer cancel()
+	for state := cc.GetState(); state != connectivity.Ready; state = cc.GetState() {
+		if state == connectivity.Idle {
+			cc.Connect()
+		}
+		if !cc.WaitForStateChange(ctx, state) {
+			if ctx.Err() == context.DeadlineExceeded {
+				return status.Error(codes.Unavailable, fmt.Sprintf("server unreachable for %s", RECONNECT_TIMEOUT))
+			}
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Interceptors giving unary calls a deadline and waiting for the connection
+// before every call
+func unaryDeadline(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, CALL_TIMEOUT)
+		defer cancel()
+	}
+	err := awaitReady(ctx, cc)
+	if err != nil {
+		return err
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+func streamReady(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	err := awaitReady(ctx, cc)
+	if err != nil {
+		return nil, err
+	}
+	return streamer(ctx, desc, cc, method, opts...)
+}
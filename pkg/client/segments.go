@@ -0,0 +1,326 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	filesync "grpc-pedrocarlo/pkg/file"
+	"grpc-pedrocarlo/pkg/tracing"
+	"grpc-pedrocarlo/pkg/utils"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Bounds of the segment size chosen from the file size, so each stream
+// moves a few segments and a slow one does not hold up the end
+const (
+	MIN_SEGMENT_SIZE = 4 << 20
+	MAX_SEGMENT_SIZE = 64 << 20
+)
+
+// Time given to the server to drop a failed segmented upload
+const ABORT_TIMEOUT = 10 * time.Second
+
+// Streams used for large files when TransferOptions.Streams is not set.
+// Files smaller than MIN_SEGMENTED_SIZE are moved over a single stream.
+const (
+	AUTO_STREAMS       = 8
+	MIN_SEGMENTED_SIZE = 16 << 20
+)
+
+// Tuning of segmented transfers, zero values are chosen from the file size
+type TransferOptions struct {
+	Streams     int   // Concurrent streams
+	SegmentSize int64 // Bytes moved by a stream before it takes the next segment
+}
+
+// Number of streams and segment size used to move size bytes
+func (o TransferOptions) plan(size int64) (int, int64) {
+	segment_size := o.SegmentSize
+	if segment_size <= 0 {
+		segment_size = min(max(size/(4*AUTO_STREAMS), MIN_SEGMENT_SIZE), MAX_SEGMENT_SIZE)
+	}
+	streams := o.Streams
+	if streams <= 0 {
+		streams = AUTO_STREAMS
+		if size < MIN_SEGMENTED_SIZE {
+			streams = 1
+		}
+	}
+	segments := max((size+segment_size-1)/segment_size, 1)
+	return int(min(int64(streams), segments)), segment_size
+}
+
+type segment struct {
+	offset int64
+	length int64
+}
+
+func splitSegments(size int64, segment_size int64) []segment {
+	segments := []segment{}
+	for offset := int64(0); offset < size; offset += segment_size {
+		segments = append(segments, segment{offset: offset, length: min(segment_size, size-offset)})
+	}
+	return segments
+}
+
+// Calls work for every index in [0, n) from streams goroutines. The context
+// given to work is canceled once one of them fails, and the first error is
+// returned.
+func runParallel(ctx context.Context, n int, streams int, work func(ctx context.Context, i int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var first_err error
+	for w := 0; w < max(streams, 1); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				err := work(ctx, i)
+				if err != nil {
+					once.Do(func() {
+						first_err = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+	for i := 0; i < n && ctx.Err() == nil; i++ {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+		}
+	}
+	close(indexes)
+	wg.Wait()
+	if first_err == nil {
+		// Canceled by the caller between two segments
+		first_err = ctx.Err()
+	}
+	return first_err
+}
+
+// Uploads size bytes of file over parallel streams, then asks the server to
+// store them as filename once its hash is checked. The segments are dropped
+// by the server when the upload fails or is canceled.
+func (c *FileClient) uploadSegments(ctx context.Context, file *os.File, size int64, filehash string, folder string, filename string, progress *progressTracker) error {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return err
+	}
+	upload_id := hex.EncodeToString(id)
+	streams, segment_size := c.Transfers.plan(size)
+	segments := splitSegments(size, segment_size)
+	utils.Log_trace(fmt.Sprintf("Uploading %s in %d segments over %d streams", filename, len(segments), streams))
+	err = runParallel(ctx, len(segments), streams, func(ctx context.Context, i int) error {
+		return c.uploadRange(ctx, file, upload_id, segments[i], progress)
+	})
+	if err != nil {
+		c.abortUpload(upload_id)
+		return err
+	}
+	_, err = c.client.CommitUpload(ctx, &filesync.CommitUploadRequest{
+		UploadId: upload_id,
+		Folder:   folder,
+		Filename: filename,
+		Filehash: filehash,
+		Size:     size,
+	})
+	if err != nil {
+		return err
+	}
+	utils.Log_trace(fmt.Sprintf("Finished upload of file %s", filename))
+	return nil
+}
+
+// Asks the server to drop the segments of an upload. ctx may be canceled
+// already, so the request gets a context of its own.
+func (c *FileClient) abortUpload(upload_id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), ABORT_TIMEOUT)
+	defer cancel()
+	_, err := c.client.AbortUpload(ctx, &filesync.AbortUploadRequest{UploadId: upload_id})
+	if err != nil {
+		utils.Log_trace(fmt.Sprintf("Could not abort upload %s: %v", upload_id, err))
+	}
+}
+
+func (c *FileClient) uploadRange(ctx context.Context, file *os.File, upload_id string, seg segment, progress *progressTracker) error {
+	stream, err := c.client.UploadRange(ctx)
+	if err != nil {
+		return err
+	}
+	r := io.NewSectionReader(file, seg.offset, seg.length)
+	buf := make([]byte, MESSAGE_SIZE)
+	for first := true; ; first = false {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF && !first {
+			break
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			stream.CloseSend()
+			return err
+		}
+		message := &filesync.RangeMessage{Chunk: buf[:n]}
+		if first {
+			message.UploadId, message.Offset = upload_id, seg.offset
+		}
+		err = stream.Send(message)
+		if err != nil {
+			// The server error is only available from CloseAndRecv
+			break
+		}
+		progress.add(int64(n))
+	}
+	res, err := stream.CloseAndRecv()
+	if err != nil {
+		return err
+	}
+	if res.Bytes != seg.offset+seg.length {
+		return fmt.Errorf("server wrote segment %d to %d instead of %d", seg.offset, res.Bytes, seg.offset+seg.length)
+	}
+	return nil
+}
+
+// Downloads size bytes of a file stored whole over parallel streams into
+// file, then checks the file has the hash the server sent
+func (c *FileClient) downloadSegments(ctx context.Context, file *os.File, size int64, filehash string, folder string, remote_name string, progress *progressTracker) error {
+	streams, segment_size := c.Transfers.plan(size)
+	segments := splitSegments(size, segment_size)
+	utils.Log_trace(fmt.Sprintf("Downloading %s in %d segments over %d streams", remote_name, len(segments), streams))
+	err := file.Truncate(size)
+	if err != nil {
+		return err
+	}
+	err = runParallel(ctx, len(segments), streams, func(ctx context.Context, i int) error {
+		return c.downloadRange(ctx, file, folder, remote_name, segments[i], progress)
+	})
+	if err != nil {
+		return err
+	}
+	hasher := sha256.New()
+	_, span := tracing.StartChild(ctx, "hash file", attribute.Int64("filesync.bytes", size))
+	_, err = io.Copy(hasher, io.NewSectionReader(file, 0, size))
+	tracing.End(span, err)
+	if err != nil {
+		return err
+	}
+	if filehash != hex.EncodeToString(hasher.Sum(nil)) {
+		return errHashDifferent
+	}
+	return nil
+}
+
+func (c *FileClient) downloadRange(ctx context.Context, file *os.File, folder string, remote_name string, seg segment, progress *progressTracker) error {
+	stream, err := c.client.DownloadRange(ctx, &filesync.RangeRequest{
+		Folder:   folder,
+		Filename: remote_name,
+		Offset:   seg.offset,
+		Length:   seg.length,
+	})
+	if err != nil {
+		return err
+	}
+	offset := seg.offset
+	for done := false; !done; {
+		res, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if offset+int64(len(res.Response.Chunk)) > seg.offset+seg.length {
+			return fmt.Errorf("server sent more than segment %d to %d", seg.offset, seg.offset+seg.length)
+		}
+		_, err = file.WriteAt(res.Response.Chunk, offset)
+		if err != nil {
+			return err
+		}
+		offset += int64(len(res.Response.Chunk))
+		progress.add(int64(len(res.Response.Chunk)))
+		done = res.Response.Done
+	}
+	if offset != seg.offset+seg.length {
+		return fmt.Errorf("server sent segment %d to %d instead of %d", seg.offset, offset, seg.offset+seg.length)
+	}
+	return nil
+}
+
+// Downloads a file stored whole over parallel streams into DOWNLOADS_DIR,
+// decrypting it afterwards when it is end-to-end encrypted
+func (c *FileClient) downloadSegmented(ctx context.Context, file_meta *filesync.FileMetadata, remote_name string, manifest *filesync.FileManifest, progress *progressTracker) error {
+	file, err := os.CreateTemp(TEMP_DIR, utils.TEMP_PATTERN)
+	if err != nil {
+		return err
+	}
+	path := file.Name()
+	utils.Log_trace(fmt.Sprintf("Created temp file: %s", path))
+	defer file.Close()
+	defer os.Remove(path)
+	err = c.downloadSegments(ctx, file, manifest.Size, manifest.Filehash, file_meta.Folder, remote_name, progress)
+	if err != nil {
+		return err
+	}
+	// Files of covered folders are never taken as plaintext
+	if c.Encryption.Covers(file_meta.Folder) {
+		plain, err := os.CreateTemp(TEMP_DIR, utils.TEMP_PATTERN)
+		if err != nil {
+			return err
+		}
+		defer plain.Close()
+		defer os.Remove(plain.Name())
+		decrypter := c.Encryption.newDecryptWriter(plain)
+		_, err = io.Copy(decrypter, io.NewSectionReader(file, 0, manifest.Size))
+		if err == nil {
+			err = decrypter.Close()
+		}
+		if err != nil {
+			return err
+		}
+		file.Close()
+		file, path = plain, plain.Name()
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path, filepath.Join(DOWNLOADS_DIR, file_meta.Filename))
+	if err != nil {
+		return err
+	}
+	utils.Log_trace(fmt.Sprintf("Finished download of file %s", file_meta.Filename))
+	return nil
+}
+
+// Encrypts the file into a temp file, then uploads it over parallel streams
+func (c *FileClient) uploadEncryptedSegments(ctx context.Context, file *os.File, size int64, folder string, filename string, progress *progressTracker) error {
+	encrypted, err := os.CreateTemp(TEMP_DIR, utils.TEMP_PATTERN)
+	if err != nil {
+		return err
+	}
+	defer encrypted.Close()
+	defer os.Remove(encrypted.Name())
+	hasher := sha256.New()
+	_, span := tracing.StartChild(ctx, "encrypt file", attribute.Int64("filesync.bytes", size))
+	err = c.Encryption.encrypt(io.MultiWriter(encrypted, hasher), file, size)
+	tracing.End(span, err)
+	if err != nil {
+		return err
+	}
+	info, err := encrypted.Stat()
+	if err != nil {
+		return err
+	}
+	// Progress counts the ciphertext sent, slightly larger than the file
+	progress.setTotal(info.Size())
+	return c.uploadSegments(ctx, encrypted, info.Size(), hex.EncodeToString(hasher.Sum(nil)), folder, filename, progress)
+}
@@ -0,0 +1,370 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	filesync "grpc-pedrocarlo/pkg/file"
+	"grpc-pedrocarlo/pkg/utils"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Jobs of the transfer queue not done yet, read back when the client starts
+var TRANSFERS_FILE = filepath.Join(CLIENT_BASE_DIR, "transfers.json")
+
+type JobKind string
+
+const (
+	JOB_UPLOAD   JobKind = "upload"
+	JOB_DOWNLOAD JobKind = "download"
+)
+
+type JobState string
+
+const (
+	JOB_QUEUED   JobState = "queued"
+	JOB_RUNNING  JobState = "running"
+	JOB_DONE     JobState = "done"
+	JOB_FAILED   JobState = "failed"
+	JOB_CANCELED JobState = "canceled"
+)
+
+var (
+	errJobNotFound  = errors.New("no such job")
+	errJobFinished  = errors.New("job already finished")
+	errJobNotFailed = errors.New("only failed or canceled jobs can be retried")
+	errQueueClosed  = errors.New("transfer queue is closed")
+)
+
+// A transfer of the queue. Upload jobs send the local file Path into Folder,
+// download jobs fetch Filename from Folder into DOWNLOADS_DIR.
+type Job struct {
+	Id       int      `json:"id"`
+	Kind     JobKind  `json:"kind"`
+	Path     string   `json:"path,omitempty"`
+	Folder   string   `json:"folder"`
+	Filename string   `json:"filename"`
+	State    JobState `json:"state"`
+	Error    string   `json:"error,omitempty"`
+	Attempts int      `json:"attempts"`
+	Progress Progress `json:"-"` // Of the last attempt
+}
+
+// Runs uploads and downloads in the background on a fixed number of
+// workers. Jobs are kept in TRANSFERS_FILE until they are done, so the jobs
+// left unfinished when the client stops are run again when it starts.
+// Chunked files then only move the chunks the other side is missing.
+type TransferManager struct {
+	c    *FileClient
+	path string
+
+	mu      sync.Mutex
+	jobs    []*Job
+	next_id int
+	cancels map[int]context.CancelFunc // Of the running jobs
+	changed chan struct{}              // Closed and replaced whenever a job changes state
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// Loads the jobs saved in path and starts workers running them
+func NewTransferManager(c *FileClient, workers int, path string) (*TransferManager, error) {
+	m := &TransferManager{
+		c:       c,
+		path:    path,
+		next_id: 1,
+		cancels: map[int]context.CancelFunc{},
+		changed: make(chan struct{}),
+	}
+	err := m.load()
+	if err != nil {
+		return nil, err
+	}
+	if pending := m.pending(); pending > 0 {
+		utils.Log_trace(fmt.Sprintf("Resuming %d transfers", pending))
+	}
+	for i := 0; i < max(workers, 1); i++ {
+		m.wg.Add(1)
+		go m.worker()
+	}
+	return m, nil
+}
+
+func (m *TransferManager) load() error {
+	data, err := os.ReadFile(m.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(data, &m.jobs)
+	if err != nil {
+		return fmt.Errorf("%s: %w", m.path, err)
+	}
+	for _, job := range m.jobs {
+		// Interrupted by the client stopping
+		if job.State == JOB_RUNNING {
+			job.State = JOB_QUEUED
+		}
+		m.next_id = max(m.next_id, job.Id+1)
+	}
+	return nil
+}
+
+// Writes the jobs not done yet atomically. Must hold m.mu.
+func (m *TransferManager) save() error {
+	jobs := []*Job{}
+	for _, job := range m.jobs {
+		if job.State != JOB_DONE {
+			jobs = append(jobs, job)
+		}
+	}
+	data, err := json.MarshalIndent(jobs, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp_file, err := os.CreateTemp(filepath.Dir(m.path), utils.TEMP_PATTERN)
+	if err != nil {
+		return err
+	}
+	defer temp_file.Close()
+	defer os.Remove(temp_file.Name())
+	_, err = temp_file.Write(data)
+	if err != nil {
+		return err
+	}
+	err = temp_file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp_file.Name(), m.path)
+}
+
+// Saves the jobs and wakes up whoever waits on them. Must hold m.mu.
+func (m *TransferManager) notify() {
+	err := m.save()
+	if err != nil {
+		utils.Log_trace(fmt.Sprintf("Could not save the transfer queue: %v", err))
+	}
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// Must hold m.mu
+func (m *TransferManager) pending() int {
+	n := 0
+	for _, job := range m.jobs {
+		if job.State == JOB_QUEUED || job.State == JOB_RUNNING {
+			n++
+		}
+	}
+	return n
+}
+
+// Must hold m.mu
+func (m *TransferManager) find(id int) (*Job, error) {
+	for _, job := range m.jobs {
+		if job.Id == id {
+			return job, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %d", errJobNotFound, id)
+}
+
+func (m *TransferManager) add(job *Job) (Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return Job{}, errQueueClosed
+	}
+	job.Id = m.next_id
+	job.State = JOB_QUEUED
+	m.next_id++
+	m.jobs = append(m.jobs, job)
+	m.notify()
+	return *job, nil
+}
+
+// Queues the upload of the local file at path into folder
+func (m *TransferManager) Upload(path string, folder string) (Job, error) {
+	abs_path, err := filepath.Abs(path)
+	if err != nil {
+		return Job{}, err
+	}
+	info, err := os.Stat(abs_path)
+	if err != nil {
+		return Job{}, err
+	}
+	if info.IsDir() {
+		return Job{}, fmt.Errorf("%s is a directory", path)
+	}
+	return m.add(&Job{Kind: JOB_UPLOAD, Path: abs_path, Folder: folder, Filename: filepath.Base(abs_path)})
+}
+
+// Queues the download of filename from folder
+func (m *TransferManager) Download(folder string, filename string) (Job, error) {
+	return m.add(&Job{Kind: JOB_DOWNLOAD, Folder: folder, Filename: filename})
+}
+
+// Returns a copy of every job, oldest first
+func (m *TransferManager) Jobs() []Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	jobs := make([]Job, len(m.jobs))
+	for i, job := range m.jobs {
+		jobs[i] = *job
+	}
+	return jobs
+}
+
+// Stops a queued or running job, what a running job moved is dropped
+func (m *TransferManager) Cancel(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, err := m.find(id)
+	if err != nil {
+		return err
+	}
+	switch job.State {
+	case JOB_QUEUED:
+		job.State = JOB_CANCELED
+		m.notify()
+	case JOB_RUNNING:
+		// The worker marks it canceled once the transfer stopped
+		m.cancels[id]()
+	default:
+		return fmt.Errorf("%w: %d is %s", errJobFinished, id, job.State)
+	}
+	return nil
+}
+
+// Queues a failed or canceled job again
+func (m *TransferManager) Retry(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return errQueueClosed
+	}
+	job, err := m.find(id)
+	if err != nil {
+		return err
+	}
+	if job.State != JOB_FAILED && job.State != JOB_CANCELED {
+		return fmt.Errorf("%w: %d is %s", errJobNotFailed, id, job.State)
+	}
+	job.State, job.Error, job.Progress = JOB_QUEUED, "", Progress{}
+	m.notify()
+	return nil
+}
+
+// Blocks until no job is queued or running, or ctx is done
+func (m *TransferManager) Wait(ctx context.Context) error {
+	for {
+		m.mu.Lock()
+		pending, changed := m.pending(), m.changed
+		m.mu.Unlock()
+		if pending == 0 {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Stops the workers. Running jobs are interrupted and stay queued, to be
+// run again by the next TransferManager reading the same file.
+func (m *TransferManager) Close() {
+	m.mu.Lock()
+	m.closed = true
+	for _, cancel := range m.cancels {
+		cancel()
+	}
+	close(m.changed)
+	m.changed = make(chan struct{})
+	m.mu.Unlock()
+	m.wg.Wait()
+}
+
+func (m *TransferManager) worker() {
+	defer m.wg.Done()
+	for {
+		m.mu.Lock()
+		job := m.next()
+		for job == nil && !m.closed {
+			changed := m.changed
+			m.mu.Unlock()
+			<-changed
+			m.mu.Lock()
+			job = m.next()
+		}
+		if m.closed {
+			m.mu.Unlock()
+			return
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		m.cancels[job.Id] = cancel
+		job.State, job.Progress = JOB_RUNNING, Progress{}
+		job.Attempts++
+		m.notify()
+		m.mu.Unlock()
+
+		utils.Log_trace(fmt.Sprintf("Running %s job %d of %s", job.Kind, job.Id, job.Filename))
+		err := m.run(ctx, job)
+		canceled := ctx.Err() != nil
+		cancel()
+
+		m.mu.Lock()
+		delete(m.cancels, job.Id)
+		switch {
+		case err == nil:
+			job.State = JOB_DONE
+		case canceled && m.closed:
+			job.State = JOB_QUEUED
+		case canceled:
+			job.State = JOB_CANCELED
+		default:
+			job.State, job.Error = JOB_FAILED, err.Error()
+		}
+		m.notify()
+		m.mu.Unlock()
+	}
+}
+
+// Oldest queued job. Must hold m.mu.
+func (m *TransferManager) next() *Job {
+	for _, job := range m.jobs {
+		if job.State == JOB_QUEUED {
+			return job
+		}
+	}
+	return nil
+}
+
+// The fields of a running job other than State and Progress do not change,
+// they are read without m.mu
+func (m *TransferManager) run(ctx context.Context, job *Job) error {
+	ctx = WithProgress(ctx, func(p Progress) {
+		m.mu.Lock()
+		job.Progress = p
+		m.mu.Unlock()
+	})
+	switch job.Kind {
+	case JOB_UPLOAD:
+		file, err := os.Open(job.Path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return m.c.UploadFile(ctx, file, job.Folder)
+	case JOB_DOWNLOAD:
+		return m.c.DownloadFile(ctx, &filesync.FileMetadata{Folder: job.Folder, Filename: job.Filename})
+	}
+	return fmt.Errorf("unknown job kind %q", job.Kind)
+}
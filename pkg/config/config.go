@@ -0,0 +1,223 @@
+// Fills a settings struct from, in increasing priority, its defaults, a YAML
+// file, environment variables and command line flags. Every exported field
+// with a yaml tag is a setting, its key names the flag too and, upper cased
+// with a prefix, the environment variable: key "scrub-rate" with prefix
+// "FILESYNC_" is read from $FILESYNC_SCRUB_RATE and -scrub-rate.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var errUnsupportedField = errors.New("unsupported setting type")
+
+type field struct {
+	key   string
+	usage string
+	value reflect.Value
+}
+
+// Settings of cfg, a pointer to a struct
+func fields(cfg any) []field {
+	v := reflect.ValueOf(cfg).Elem()
+	out := []field{}
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		key, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if !f.IsExported() || key == "" || key == "-" {
+			continue
+		}
+		out = append(out, field{key: key, usage: f.Tag.Get("usage"), value: v.Field(i)})
+	}
+	return out
+}
+
+// Sets v from its text form. Lists are comma separated.
+func set(v reflect.Value, s string) error {
+	switch {
+	case v.Type() == reflect.TypeOf(time.Duration(0)):
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Int || v.Kind() == reflect.Int64:
+		n, err := strconv.ParseInt(s, 0, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case v.Kind() == reflect.Float64:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		list := []string{}
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("%w: %s", errUnsupportedField, v.Type())
+	}
+	return nil
+}
+
+func format(v reflect.Value) string {
+	switch {
+	case v.Type() == reflect.TypeOf(time.Duration(0)):
+		return time.Duration(v.Int()).String()
+	case v.Kind() == reflect.Slice:
+		return strings.Join(v.Interface().([]string), ",")
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// Reads the YAML file at path into cfg. Keys that are not settings are
+// refused, so a misspelled key is not silently ignored.
+func LoadFile(path string, cfg any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err = decoder.Decode(cfg)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// Name of the environment variable of a setting
+func EnvName(prefix string, key string) string {
+	return prefix + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+}
+
+// Sets the settings of cfg whose environment variable is set
+func LoadEnv(prefix string, cfg any) error {
+	for _, f := range fields(cfg) {
+		name := EnvName(prefix, f.key)
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		err := set(f.value, s)
+		if err != nil {
+			return fmt.Errorf("$%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+type flagValue struct {
+	v reflect.Value
+}
+
+func (f flagValue) String() string {
+	if !f.v.IsValid() {
+		return ""
+	}
+	return format(f.v)
+}
+
+func (f flagValue) Set(s string) error {
+	return set(f.v, s)
+}
+
+func (f flagValue) IsBoolFlag() bool {
+	return f.v.Kind() == reflect.Bool
+}
+
+// Defines a flag for every setting of cfg, defaulting to its current value
+func BindFlags(fs *flag.FlagSet, cfg any) {
+	for _, f := range fields(cfg) {
+		fs.Var(flagValue{f.value}, f.key, f.usage)
+	}
+}
+
+// Config file named by -config or --config in args, or by $<prefix>CONFIG
+func filePath(args []string, prefix string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name, value, has_value := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "config" {
+			continue
+		}
+		if has_value {
+			return value
+		}
+		if i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return os.Getenv(prefix + "CONFIG")
+}
+
+// Fills cfg from the config file, the environment and the flags in args, in
+// that order, and parses the flags of fs
+func Load(fs *flag.FlagSet, args []string, prefix string, cfg any) error {
+	path := filePath(args, prefix)
+	if path != "" {
+		err := LoadFile(path, cfg)
+		if err != nil {
+			return err
+		}
+	}
+	err := LoadEnv(prefix, cfg)
+	if err != nil {
+		return err
+	}
+	BindFlags(fs, cfg)
+	fs.String("config", path, "YAML file of settings, overridden by $"+prefix+"<SETTING> variables and by flags")
+	return fs.Parse(args)
+}
+
+// Keys of the settings whose values differ between old and new, pointers to
+// structs of the same type
+func Changed(old any, new any) []string {
+	keys := []string{}
+	new_fields := fields(new)
+	for i, f := range fields(old) {
+		if !reflect.DeepEqual(f.value.Interface(), new_fields[i].value.Interface()) {
+			keys = append(keys, f.key)
+		}
+	}
+	return keys
+}
+
+// Writes cfg as a YAML config file
+func Print(w io.Writer, cfg any) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	err := encoder.Encode(cfg)
+	if err != nil {
+		return err
+	}
+	return encoder.Close()
+}
@@ -0,0 +1,268 @@
+package db
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"grpc-pedrocarlo/pkg/utils"
+	"io/fs"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Migrations live in migrations/<driver name>/ and are named
+// <version>_<name>.up.sql and <version>_<name>.down.sql. Versions are applied
+// in ascending order and must never be renumbered once released.
+//
+//go:embed migrations
+var migrationsFS embed.FS
+
+var errBadMigrationName = errors.New("bad migration file name")
+var errUnknownVersion = errors.New("unknown migration version")
+var errNoDownMigration = errors.New("migration cannot be reverted")
+var errVersionApplied = errors.New("migration version is below the current one")
+
+var migrationsTable = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version    INTEGER PRIMARY KEY,
+	applied_at INTEGER
+);
+`
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt int // Unix timestamp, 0 when not applied
+}
+
+// Returns the migrations of dialect ordered by version
+func Migrations(dialect Dialect) ([]Migration, error) {
+	dir := path.Join("migrations", dialect.DriverName())
+	entries, err := migrationsFS.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	by_version := make(map[int]*Migration)
+	for _, entry := range entries {
+		name := entry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("%w: %s", errBadMigrationName, name)
+		}
+		version_str, migration_name, ok := strings.Cut(strings.TrimSuffix(name, "."+direction+".sql"), "_")
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", errBadMigrationName, name)
+		}
+		version, err := strconv.Atoi(version_str)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errBadMigrationName, name)
+		}
+		content, err := fs.ReadFile(migrationsFS, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		migration, ok := by_version[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: migration_name}
+			by_version[version] = migration
+		}
+		if direction == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+	migrations := make([]Migration, 0, len(by_version))
+	for _, migration := range by_version {
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Returns the version of the last applied migration, 0 if none was applied
+func MigrationVersion(db *Store) (int, error) {
+	_, err := db.Exec(migrationsTable)
+	if err != nil {
+		return 0, err
+	}
+	var version int
+	err = db.Get(&version, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations")
+	return version, err
+}
+
+func QueryMigrationsStatus(db *Store) ([]MigrationStatus, error) {
+	migrations, err := Migrations(db.Dialect)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(migrationsTable)
+	if err != nil {
+		return nil, err
+	}
+	applied := []struct {
+		Version   int
+		AppliedAt int `db:"applied_at"`
+	}{}
+	err = db.Select(&applied, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	applied_at := make(map[int]int)
+	for _, row := range applied {
+		applied_at[row.Version] = row.AppliedAt
+	}
+	status := make([]MigrationStatus, 0, len(migrations))
+	for _, migration := range migrations {
+		t, ok := applied_at[migration.Version]
+		status = append(status, MigrationStatus{Migration: migration, Applied: ok, AppliedAt: t})
+	}
+	return status, nil
+}
+
+// Applies every migration up to and including target. A target of 0 or less
+// applies all known migrations, a target below the current version fails.
+// Servers starting together apply each migration once.
+func MigrateUp(db *Store, target int) error {
+	migrations, err := Migrations(db.Dialect)
+	if err != nil {
+		return err
+	}
+	if target > 0 && !hasVersion(migrations, target) {
+		return fmt.Errorf("%w: %d", errUnknownVersion, target)
+	}
+	for _, migration := range migrations {
+		if target > 0 && migration.Version > target {
+			break
+		}
+		tx, current, err := beginMigration(db)
+		if err != nil {
+			return err
+		}
+		if target > 0 && target < current {
+			tx.Rollback()
+			return fmt.Errorf("%w: %d, the schema is at version %d, use migrate down to revert", errVersionApplied, target, current)
+		}
+		if migration.Version <= current {
+			tx.Rollback()
+			continue
+		}
+		utils.Log_trace(fmt.Sprintf("Applying migration %04d_%s", migration.Version, migration.Name))
+		_, err = tx.Exec(migration.Up)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %04d_%s: %w", migration.Version, migration.Name, err)
+		}
+		_, err = tx.Exec("INSERT INTO schema_migrations (version, applied_at) VALUES ($1, $2)", migration.Version, int(time.Now().Unix()))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reverts the last steps applied migrations
+func MigrateDown(db *Store, steps int) error {
+	migrations, err := Migrations(db.Dialect)
+	if err != nil {
+		return err
+	}
+	for ; steps > 0; steps-- {
+		tx, current, err := beginMigration(db)
+		if err != nil {
+			return err
+		}
+		if current == 0 {
+			tx.Rollback()
+			return nil
+		}
+		i := slices.IndexFunc(migrations, func(m Migration) bool { return m.Version == current })
+		if i < 0 {
+			tx.Rollback()
+			return fmt.Errorf("%w: %d", errUnknownVersion, current)
+		}
+		migration := migrations[i]
+		if migration.Down == "" {
+			tx.Rollback()
+			return fmt.Errorf("%w: %04d_%s", errNoDownMigration, migration.Version, migration.Name)
+		}
+		utils.Log_trace(fmt.Sprintf("Reverting migration %04d_%s", migration.Version, migration.Name))
+		_, err = tx.Exec(migration.Down)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %04d_%s: %w", migration.Version, migration.Name, err)
+		}
+		_, err = tx.Exec("DELETE FROM schema_migrations WHERE version=$1", migration.Version)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Starts the transaction of one migration. Servers migrating the same
+// database wait for each other here, so the version it returns, read once
+// the lock is held, is not changed by another server until it ends.
+func beginMigration(db *Store) (*sqlx.Tx, int, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, 0, err
+	}
+	lock := db.Dialect.MigrationLock()
+	if lock != "" {
+		_, err = tx.Exec(lock)
+		if err != nil {
+			tx.Rollback()
+			return nil, 0, err
+		}
+	}
+	_, err = tx.Exec(migrationsTable)
+	if err != nil {
+		tx.Rollback()
+		return nil, 0, err
+	}
+	var version int
+	err = tx.Get(&version, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations")
+	if err != nil {
+		tx.Rollback()
+		return nil, 0, err
+	}
+	return tx, version, nil
+}
+
+func hasVersion(migrations []Migration, version int) bool {
+	for _, migration := range migrations {
+		if migration.Version == version {
+			return true
+		}
+	}
+	return false
+}
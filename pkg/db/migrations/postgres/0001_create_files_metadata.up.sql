@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS files_metadata (
+	id         SERIAL PRIMARY KEY,
+	is_dir     INTEGER DEFAULT 0,
+	folder     VARCHAR(250) DEFAULT '',
+	file_name  VARCHAR(250) DEFAULT '',
+	file_hash  VARCHAR(64)  DEFAULT '',
+	timestamp  INTEGER,
+	UNIQUE(folder, file_name)
+);
@@ -0,0 +1,2 @@
+ALTER TABLE files_metadata DROP COLUMN quarantined;
+ALTER TABLE files_metadata DROP COLUMN scrubbed_at;
@@ -0,0 +1,2 @@
+ALTER TABLE files_metadata DROP COLUMN file_size;
+ALTER TABLE files_metadata DROP COLUMN codec;
@@ -0,0 +1,2 @@
+ALTER TABLE files_metadata DROP COLUMN data_key;
+ALTER TABLE files_metadata DROP COLUMN key_id;
@@ -0,0 +1,2 @@
+ALTER TABLE files_metadata ADD COLUMN key_id VARCHAR(64) DEFAULT '';
+ALTER TABLE files_metadata ADD COLUMN data_key TEXT DEFAULT '';
@@ -0,0 +1,4 @@
+ALTER TABLE files_metadata DROP COLUMN chunked;
+DROP INDEX IF EXISTS file_chunks_chunk_hash;
+DROP TABLE IF EXISTS file_chunks;
+DROP TABLE IF EXISTS chunks;
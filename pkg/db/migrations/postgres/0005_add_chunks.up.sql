@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS chunks (
+	hash       VARCHAR(64) PRIMARY KEY,
+	file_size  BIGINT DEFAULT 0,
+	codec      VARCHAR(16) DEFAULT '',
+	key_id     VARCHAR(64) DEFAULT '',
+	data_key   TEXT DEFAULT '',
+	created_at BIGINT DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS file_chunks (
+	file_id    INTEGER NOT NULL REFERENCES files_metadata(id) ON DELETE CASCADE,
+	position   INTEGER NOT NULL,
+	chunk_hash VARCHAR(64) NOT NULL REFERENCES chunks(hash),
+	PRIMARY KEY (file_id, position)
+);
+CREATE INDEX IF NOT EXISTS file_chunks_chunk_hash ON file_chunks (chunk_hash);
+ALTER TABLE files_metadata ADD COLUMN chunked INTEGER DEFAULT 0;
@@ -0,0 +1,2 @@
+ALTER TABLE files_metadata ADD COLUMN scrubbed_at INTEGER DEFAULT 0;
+ALTER TABLE files_metadata ADD COLUMN quarantined INTEGER DEFAULT 0;
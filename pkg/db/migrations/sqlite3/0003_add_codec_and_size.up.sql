@@ -0,0 +1,2 @@
+ALTER TABLE files_metadata ADD COLUMN codec VARCHAR(16) DEFAULT '';
+ALTER TABLE files_metadata ADD COLUMN file_size INTEGER DEFAULT 0;
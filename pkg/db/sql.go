@@ -7,10 +7,11 @@ import (
 	"grpc-pedrocarlo/pkg/utils"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/mattn/go-sqlite3"
 )
 
 var (
@@ -18,42 +19,75 @@ var (
 	errFolderNotFound = errors.New("folder not found")
 )
 
-const BASE_DIR = "server_files"
+var BASE_DIR = "server_files"
 
 var TEMP_DIR = filepath.Join(BASE_DIR, "tmp")
 var DB_FILES_DIR = filepath.Join(BASE_DIR, "files")
 var DB_DIR = filepath.Join(BASE_DIR, "files.db")
+var LOST_FOUND_DIR = filepath.Join(BASE_DIR, "lost+found")
+var QUARANTINE_DIR = filepath.Join(BASE_DIR, "quarantine")
+var CHUNKS_DIR = filepath.Join(BASE_DIR, "chunks")
 
-const ROOT_FOLDER = "/"
+// Moves every server folder, and the default database, under dir
+func SetBaseDir(dir string) {
+	BASE_DIR = dir
+	TEMP_DIR = filepath.Join(BASE_DIR, "tmp")
+	DB_FILES_DIR = filepath.Join(BASE_DIR, "files")
+	DB_DIR = filepath.Join(BASE_DIR, "files.db")
+	LOST_FOUND_DIR = filepath.Join(BASE_DIR, "lost+found")
+	QUARANTINE_DIR = filepath.Join(BASE_DIR, "quarantine")
+	CHUNKS_DIR = filepath.Join(BASE_DIR, "chunks")
+	DEFAULT_DSN = "sqlite3://" + DB_DIR
+}
 
-// TODO for tests only
-// DROP TABLE IF EXISTS files_metadata;
-var schema = `
-CREATE TABLE IF NOT EXISTS files_metadata (
-	id		   INTEGER PRIMARY KEY,
-	is_dir 	   INTEGER DEFAULT 0,
-	folder 	   VARCHAR(250) DEFAULT '',
-    file_name  VARCHAR(250) DEFAULT '',
-    file_hash  VARCHAR(64)  DEFAULT '',
-	timestamp  INTEGER,
-	UNIQUE(folder, file_name)
-);
-`
+// Creates the folders the server writes to, the others are created when
+// something is first moved there
+func CreateDirs() error {
+	for _, dir := range []string{BASE_DIR, TEMP_DIR, DB_FILES_DIR, CHUNKS_DIR} {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const ROOT_FOLDER = "/"
 
 const TABLE_NAME string = "files_metadata"
 
 type FileMetadata struct {
-	Id        int // Primary key id
-	Is_dir    int
-	Folder    string
-	Filename  string `db:"file_name"`
-	Filehash  string `db:"file_hash"`
-	Timestamp int
+	Id          int // Primary key id
+	Is_dir      int
+	Folder      string
+	Filename    string `db:"file_name"`
+	Filehash    string `db:"file_hash"`
+	Timestamp   int
+	ScrubbedAt  int `db:"scrubbed_at"` // Last time the scrubber verified file_hash
+	Quarantined int // 1 when the stored bytes were found corrupted
+	Chunked     int // 1 when the file is stored as the chunks listed in file_chunks
+	StoredBlob
 }
 
-func CreateDb(db *sqlx.DB) error {
-	utils.Log_trace("Executing Schema")
-	_, err := db.Exec(schema)
+// How the bytes of a file or chunk are stored
+type StoredBlob struct {
+	Codec    string // Compression of the stored bytes, empty when stored as is
+	FileSize int64  `db:"file_size"` // Size before compression, 0 for files stored before it was recorded
+	KeyId    string `db:"key_id"`    // Master key wrapping DataKey
+	DataKey  string `db:"data_key"`  // Wrapped key the stored bytes are encrypted with, empty when stored in plaintext
+}
+
+// Content addressed piece of chunked files, stored in CHUNKS_DIR
+type ChunkMetadata struct {
+	Hash      string // SHA-256 of the chunk
+	CreatedAt int    `db:"created_at"`
+	StoredBlob
+}
+
+// Brings the schema up to date and creates the root folder
+func CreateDb(db *Store) error {
+	utils.Log_trace("Applying migrations")
+	err := MigrateUp(db, 0)
 	if err != nil {
 		return err
 	}
@@ -61,7 +95,7 @@ func CreateDb(db *sqlx.DB) error {
 	_, err = QueryFolder(db, ROOT_FOLDER, "")
 	if err != nil {
 		utils.Log_trace("Creating Root Folder")
-		_, err := db.Exec("INSERT INTO files_metadata (is_dir, folder, timestamp) VALUES (1, $1, $3)", "/", int(time.Now().Unix()))
+		_, err := db.Exec("INSERT INTO files_metadata (is_dir, folder, file_name, timestamp) VALUES (1, $1, '', $2) ON CONFLICT (folder, file_name) DO NOTHING", "/", int(time.Now().Unix()))
 		if err != nil {
 			return err
 		}
@@ -69,33 +103,160 @@ func CreateDb(db *sqlx.DB) error {
 	return nil
 }
 
-func ConnectDb() (*sqlx.DB, error) {
-	return sqlx.Connect("sqlite3", DB_DIR)
+// Connects to the metadata store described by dsn, see ParseDsn
+func ConnectDb(dsn string) (*Store, error) {
+	dialect, source, err := ParseDsn(dsn)
+	if err != nil {
+		return nil, err
+	}
+	timed, err := openTimed(dialect.DriverName(), source)
+	if err != nil {
+		return nil, err
+	}
+	conn := sqlx.NewDb(timed, dialect.DriverName())
+	err = conn.Ping()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Store{DB: conn, Dialect: dialect}, nil
 }
 
-// Insert or replace creates a new file id for row
+// Inserts the file or updates the existing row with the same folder and name
 // Does not commit transaction
 func InsertFile(tx *sqlx.Tx, file_meta *FileMetadata) error {
-	fmt.Printf("file_meta: %v\n", file_meta)
-	_, err := tx.NamedExec("INSERT OR IGNORE INTO files_metadata (folder, file_name, file_hash, timestamp) VALUES (:folder, :file_name, :file_hash, :timestamp)", file_meta)
-	_, err = tx.NamedExec("UPDATE files_metadata SET folder=:folder, file_name=:file_name, file_hash=:file_hash, timestamp=:timestamp WHERE folder=:folder AND file_name=:file_name", file_meta)
+	utils.Log_trace(fmt.Sprintf("Inserting file %s in %s", file_meta.Filename, file_meta.Folder))
+	_, err := tx.NamedExec(`INSERT INTO files_metadata (folder, file_name, file_hash, timestamp, chunked, codec, file_size, key_id, data_key) VALUES (:folder, :file_name, :file_hash, :timestamp, :chunked, :codec, :file_size, :key_id, :data_key)
+		ON CONFLICT (folder, file_name) DO UPDATE SET file_hash=excluded.file_hash, timestamp=excluded.timestamp, chunked=excluded.chunked, codec=excluded.codec, file_size=excluded.file_size, key_id=excluded.key_id, data_key=excluded.data_key, scrubbed_at=0, quarantined=0`, file_meta)
+	if err != nil {
+		return err
+	}
+	// Chunks of the file being replaced
+	_, err = tx.Exec("DELETE FROM file_chunks WHERE file_id IN (SELECT id FROM files_metadata WHERE folder=$1 AND file_name=$2)", file_meta.Folder, file_meta.Filename)
 	return err
 }
 
+// Records the chunks of the file with id, in order. Does not commit transaction
+func InsertFileChunks(tx *sqlx.Tx, file_id int, chunk_hashes []string) error {
+	for position, hash := range chunk_hashes {
+		_, err := tx.Exec("INSERT INTO file_chunks (file_id, position, chunk_hash) VALUES ($1, $2, $3)", file_id, position, hash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Inserts the chunk unless a chunk with the same hash exists, returns whether
+// it was inserted. Does not commit transaction
+func InsertChunk(tx *sqlx.Tx, chunk *ChunkMetadata) (bool, error) {
+	result, err := tx.NamedExec(`INSERT INTO chunks (hash, created_at, codec, file_size, key_id, data_key) VALUES (:hash, :created_at, :codec, :file_size, :key_id, :data_key)
+		ON CONFLICT (hash) DO NOTHING`, chunk)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func QueryChunk(db *Store, hash string) (*ChunkMetadata, error) {
+	var result ChunkMetadata
+	err := db.Get(&result, "SELECT * FROM chunks WHERE hash=$1", hash)
+	return &result, err
+}
+
+// Returns which of hashes are chunks that are stored
+func QueryExistingChunks(db *Store, hashes []string) (map[string]bool, error) {
+	existing := map[string]bool{}
+	// Stays below the number of parameters a statement may have
+	const batch = 500
+	for start := 0; start < len(hashes); start += batch {
+		query, args, err := sqlx.In("SELECT hash FROM chunks WHERE hash IN (?)", hashes[start:min(start+batch, len(hashes))])
+		if err != nil {
+			return nil, err
+		}
+		found := []string{}
+		err = db.Select(&found, db.Rebind(query), args...)
+		if err != nil {
+			return nil, err
+		}
+		for _, hash := range found {
+			existing[hash] = true
+		}
+	}
+	return existing, nil
+}
+
+// Returns the id of a file inside a transaction
+func QueryFileId(tx *sqlx.Tx, folder string, filename string) (int, error) {
+	var id int
+	err := tx.Get(&id, "SELECT id FROM files_metadata WHERE folder=$1 AND file_name=$2", folder, filename)
+	return id, err
+}
+
+// Returns how many chunks of the file with id are not stored
+func CountMissingFileChunks(tx *sqlx.Tx, file_id int) (int, error) {
+	var count int
+	err := tx.Get(&count, "SELECT COUNT(*) FROM file_chunks WHERE file_id=$1 AND NOT EXISTS (SELECT 1 FROM chunks WHERE hash=file_chunks.chunk_hash)", file_id)
+	return count, err
+}
+
+// Returns the chunks of the file with id, in order
+func QueryFileChunks(db *Store, file_id int) ([]ChunkMetadata, error) {
+	chunks := []ChunkMetadata{}
+	err := db.Select(&chunks, "SELECT chunks.* FROM file_chunks JOIN chunks ON chunks.hash=file_chunks.chunk_hash WHERE file_chunks.file_id=$1 ORDER BY file_chunks.position", file_id)
+	return chunks, err
+}
+
+// Returns the hashes of the chunks of the file with id that have no chunk row
+func QueryMissingFileChunks(db *Store, file_id int) ([]string, error) {
+	hashes := []string{}
+	err := db.Select(&hashes, "SELECT chunk_hash FROM file_chunks WHERE file_id=$1 AND NOT EXISTS (SELECT 1 FROM chunks WHERE hash=file_chunks.chunk_hash) ORDER BY position", file_id)
+	return hashes, err
+}
+
+func QueryAllChunks(db *Store) ([]ChunkMetadata, error) {
+	chunks := []ChunkMetadata{}
+	err := db.Select(&chunks, "SELECT * FROM chunks ORDER BY hash")
+	return chunks, err
+}
+
+// Returns chunks created before that no file uses
+func QueryUnusedChunks(db *Store, before int) ([]ChunkMetadata, error) {
+	chunks := []ChunkMetadata{}
+	err := db.Select(&chunks, "SELECT * FROM chunks WHERE created_at<$1 AND NOT EXISTS (SELECT 1 FROM file_chunks WHERE chunk_hash=chunks.hash)", before)
+	return chunks, err
+}
+
+// Removes the chunk, only if no file uses it. Returns whether it was removed
+// Does not commit transaction
+func RemoveUnusedChunk(tx *sqlx.Tx, hash string) (bool, error) {
+	result, err := tx.Exec("DELETE FROM chunks WHERE hash=$1 AND NOT EXISTS (SELECT 1 FROM file_chunks WHERE chunk_hash=$1)", hash)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
 func InsertFolder(tx *sqlx.Tx, dir string) error {
 	// folder := filepath.Join(curr_dir, new_dir_name)
 	t := int(time.Now().Unix())
-	_, err := tx.Exec("INSERT OR IGNORE INTO files_metadata (is_dir, folder, file_name, timestamp) VALUES (1, $1, $2, $3)", filepath.Dir(dir), filepath.Base(dir), &t)
+	folder, name := filepath.Dir(dir), filepath.Base(dir)
+	if dir == ROOT_FOLDER {
+		folder, name = ROOT_FOLDER, ""
+	}
+	_, err := tx.Exec("INSERT INTO files_metadata (is_dir, folder, file_name, timestamp) VALUES (1, $1, $2, $3) ON CONFLICT (folder, file_name) DO NOTHING", folder, name, &t)
 	return err
 }
 
-func QueryAllFiles(db *sqlx.DB) ([]FileMetadata, error) {
+func QueryAllFiles(db *Store) ([]FileMetadata, error) {
 	files := []FileMetadata{}
 	err := db.Select(&files, "SELECT * FROM files_metadata ORDER BY timestamp DESC")
 	return files, err
 }
 
-func QueryFile(db *sqlx.DB, folder string, filename string) ([]FileMetadata, error) {
+func QueryFile(db *Store, folder string, filename string) ([]FileMetadata, error) {
 	if filename == "" {
 		return nil, errEmptyFilename
 	}
@@ -104,7 +265,7 @@ func QueryFile(db *sqlx.DB, folder string, filename string) ([]FileMetadata, err
 	return files[:0], err
 }
 
-func QueryFolder(db *sqlx.DB, parent_folder string, folder_name string) (*FileMetadata, error) {
+func QueryFolder(db *Store, parent_folder string, folder_name string) (*FileMetadata, error) {
 	var result FileMetadata
 	err := db.Get(&result, "SELECT * FROM files_metadata WHERE is_dir=1 AND folder=$1 and file_name=$2 ORDER BY timestamp DESC", filepath.Dir(parent_folder), folder_name)
 	if err != nil {
@@ -113,8 +274,102 @@ func QueryFolder(db *sqlx.DB, parent_folder string, folder_name string) (*FileMe
 	return &result, err
 }
 
+// Returns the row of filename in folder
+func QueryFileMetadata(db *Store, folder string, filename string) (*FileMetadata, error) {
+	if filename == "" {
+		return nil, errEmptyFilename
+	}
+	var result FileMetadata
+	err := db.Get(&result, "SELECT * FROM files_metadata WHERE is_dir=0 AND folder=$1 AND file_name=$2", folder, filename)
+	return &result, err
+}
+
+// Returns the row of the folder at path, "/" being the root folder
+func QueryFolderByPath(db *Store, path string) (*FileMetadata, error) {
+	folder, name := filepath.Dir(path), filepath.Base(path)
+	if path == ROOT_FOLDER {
+		folder, name = ROOT_FOLDER, ""
+	}
+	var result FileMetadata
+	err := db.Get(&result, "SELECT * FROM files_metadata WHERE is_dir=1 AND folder=$1 AND file_name=$2", folder, name)
+	if err != nil {
+		err = errFolderNotFound
+	}
+	return &result, err
+}
+
+// Returns every folder and file below the folder at path, parents first
+func QueryFolderTree(db *Store, path string) ([]FileMetadata, error) {
+	files := []FileMetadata{}
+	// Compared exactly, LIKE ignores case on SQLite
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	err := db.Select(&files, `SELECT * FROM files_metadata WHERE file_name!='' AND (folder=$1 OR substr(folder, 1, $3)=$2)
+		ORDER BY folder, is_dir DESC, file_name`, path, prefix, utf8.RuneCountInString(prefix))
+	return files, err
+}
+
+func QueryFileById(db *Store, id int) (*FileMetadata, error) {
+	var result FileMetadata
+	err := db.Get(&result, "SELECT * FROM files_metadata WHERE id=$1", id)
+	return &result, err
+}
+
+// Returns files not quarantined that were not scrubbed since before
+func QueryScrubCandidates(db *Store, before int, limit int) ([]FileMetadata, error) {
+	files := []FileMetadata{}
+	err := db.Select(&files, "SELECT * FROM files_metadata WHERE is_dir=0 AND quarantined=0 AND scrubbed_at<$1 ORDER BY scrubbed_at ASC LIMIT $2", before, limit)
+	return files, err
+}
+
+// Returns encrypted files whose data key is not wrapped by key_id
+func QueryFilesNotWrappedBy(db *Store, key_id string) ([]FileMetadata, error) {
+	files := []FileMetadata{}
+	err := db.Select(&files, "SELECT * FROM files_metadata WHERE is_dir=0 AND data_key!='' AND key_id!=$1 ORDER BY id", key_id)
+	return files, err
+}
+
+// Returns chunks whose data key is not wrapped by key_id
+func QueryChunksNotWrappedBy(db *Store, key_id string) ([]ChunkMetadata, error) {
+	chunks := []ChunkMetadata{}
+	err := db.Select(&chunks, "SELECT * FROM chunks WHERE data_key!='' AND key_id!=$1 ORDER BY hash", key_id)
+	return chunks, err
+}
+
+// Returns the ids of the master keys wrapping at least one data key
+func QueryKeyIdsInUse(db *Store) ([]string, error) {
+	ids := []string{}
+	err := db.Select(&ids, "SELECT DISTINCT key_id FROM files_metadata WHERE data_key!='' UNION SELECT DISTINCT key_id FROM chunks WHERE data_key!=''")
+	return ids, err
+}
+
+// Counts of what is stored. Sizes are before compression.
+type StorageTotals struct {
+	Files       int64 `db:"files"`
+	FileBytes   int64 `db:"file_bytes"`
+	Chunks      int64 `db:"chunks"`
+	ChunkBytes  int64 `db:"chunk_bytes"`
+	Quarantined int64 `db:"quarantined"`
+}
+
+func QueryStorageTotals(db *Store) (StorageTotals, error) {
+	totals := StorageTotals{}
+	err := db.Get(&totals, `SELECT
+		(SELECT COUNT(*) FROM files_metadata WHERE is_dir=0) AS files,
+		(SELECT COALESCE(SUM(file_size), 0) FROM files_metadata WHERE is_dir=0) AS file_bytes,
+		(SELECT COUNT(*) FROM chunks) AS chunks,
+		(SELECT COALESCE(SUM(file_size), 0) FROM chunks) AS chunk_bytes,
+		(SELECT COUNT(*) FROM files_metadata WHERE is_dir=0 AND quarantined=1) AS quarantined`)
+	return totals, err
+}
+
+func QueryQuarantinedFiles(db *Store) ([]FileMetadata, error) {
+	files := []FileMetadata{}
+	err := db.Select(&files, "SELECT * FROM files_metadata WHERE is_dir=0 AND quarantined=1 ORDER BY timestamp DESC")
+	return files, err
+}
+
 // Returns folders and files inside a folder
-func QueryFilesFolder(db *sqlx.DB, parent_folder string, folder_name string) ([]FileMetadata, error) {
+func QueryFilesFolder(db *Store, parent_folder string, folder_name string) ([]FileMetadata, error) {
 	files := []FileMetadata{}
 	err := db.Select(&files, "SELECT * FROM files_metadata WHERE folder=$1 AND file_name!='' ORDER BY timestamp DESC", filepath.Join(parent_folder, folder_name))
 	return files, err
@@ -127,11 +382,15 @@ func QueryFilesFolder(db *sqlx.DB, parent_folder string, folder_name string) ([]
 // }
 
 // Removes files filename in folder. Does not commit transaction
-func RemoveFile(db *sqlx.DB, tx *sqlx.Tx, folder string, filename string) error {
+func RemoveFile(db *Store, tx *sqlx.Tx, folder string, filename string) error {
 	files_meta, err := QueryFile(db, folder, filename)
 	if err != nil {
 		return err
 	}
+	_, err = tx.Exec("DELETE FROM file_chunks WHERE file_id IN (SELECT id FROM files_metadata WHERE folder=$1 AND file_name=$2)", &folder, &filename)
+	if err != nil {
+		return err
+	}
 	_, err = tx.Exec("DELETE FROM files_metadata WHERE folder=$1 AND file_name=$2", &folder, &filename)
 	for _, file_meta := range files_meta {
 		err := os.Remove(GetFilePath(&file_meta))
@@ -142,7 +401,60 @@ func RemoveFile(db *sqlx.DB, tx *sqlx.Tx, folder string, filename string) error
 	return err
 }
 
-func RemoveFolder(db *sqlx.DB, tx *sqlx.Tx, folder string) error {
+// Removes a single row by id. Does not commit transaction
+func RemoveRow(tx *sqlx.Tx, id int) error {
+	_, err := tx.Exec("DELETE FROM file_chunks WHERE file_id=$1", id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM files_metadata WHERE id=$1", id)
+	return err
+}
+
+func UpdateScrubbedAt(db *Store, id int, scrubbed_at int) error {
+	_, err := db.Exec("UPDATE files_metadata SET scrubbed_at=$1 WHERE id=$2", scrubbed_at, id)
+	return err
+}
+
+// Marks the file as quarantined, only if its hash and timestamp are still
+// file_hash and timestamp. Returns false when the file was replaced in the
+// meantime. Does not commit transaction
+func QuarantineFile(tx *sqlx.Tx, id int, file_hash string, timestamp int) (bool, error) {
+	result, err := tx.Exec("UPDATE files_metadata SET quarantined=1 WHERE id=$1 AND file_hash=$2 AND timestamp=$3", id, file_hash, timestamp)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// Replaces the wrapped data key of a file, only if it is still data_key.
+// Returns false when the file was replaced in the meantime.
+func UpdateDataKey(db *Store, id int, data_key string, new_key_id string, new_data_key string) (bool, error) {
+	result, err := db.Exec("UPDATE files_metadata SET key_id=$1, data_key=$2 WHERE id=$3 AND data_key=$4", new_key_id, new_data_key, id, data_key)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// Replaces the wrapped data key of a chunk
+func UpdateChunkDataKey(db *Store, hash string, data_key string, new_key_id string, new_data_key string) (bool, error) {
+	result, err := db.Exec("UPDATE chunks SET key_id=$1, data_key=$2 WHERE hash=$3 AND data_key=$4", new_key_id, new_data_key, hash, data_key)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// Returns the path of the stored chunk
+func GetChunkPath(hash string) string {
+	return filepath.Join(CHUNKS_DIR, hash[:2], hash)
+}
+
+func RemoveFolder(db *Store, tx *sqlx.Tx, folder string) error {
 	folder_meta, err := QueryFolder(db, filepath.Dir(folder), filepath.Base(folder))
 	if err != nil {
 		return err
@@ -152,7 +464,7 @@ func RemoveFolder(db *sqlx.DB, tx *sqlx.Tx, folder string) error {
 }
 
 // Updates all files with file id to new filename
-func UpdateFileName(db *sqlx.DB, tx *sqlx.Tx, folder string, curr_name string, new_name string) error {
+func UpdateFileName(db *Store, tx *sqlx.Tx, folder string, curr_name string, new_name string) error {
 	files_meta, err := QueryFile(db, folder, curr_name)
 	if err != nil {
 		return err
@@ -193,7 +505,7 @@ func Test() {
 	// exec the schema or fail; multi-statement Exec behavior varies between
 	// database drivers;  pq will exec them all, sqlite3 won't, ymmv
 	utils.Log_trace("Executing Schema")
-	_, err = db.Exec(schema)
+	err = MigrateUp(&Store{DB: db, Dialect: sqliteDialect{}}, 0)
 	if err != nil {
 		utils.Log_fatal_trace(err)
 	}
@@ -0,0 +1,180 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"grpc-pedrocarlo/pkg/metrics"
+	"grpc-pedrocarlo/pkg/tracing"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Connects through driver, recording how long statements take in
+// metrics.DB_QUERY_DURATION and tracing them when the context they run in
+// is traced. Covers statements run in transactions too.
+type timedConnector struct {
+	driver driver.Driver
+	source string
+	system string // Database name in traces
+}
+
+func (c timedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.source)
+	if err != nil {
+		return nil, err
+	}
+	return &timedConn{Conn: conn, system: c.system}, nil
+}
+
+func (c timedConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// Opens source with the registered driver, statements are timed
+func openTimed(driver_name string, source string) (*sql.DB, error) {
+	plain, err := sql.Open(driver_name, source)
+	if err != nil {
+		return nil, err
+	}
+	d := plain.Driver()
+	plain.Close()
+	system := driver_name
+	switch driver_name {
+	case "sqlite3":
+		system = "sqlite"
+	case "postgres":
+		system = "postgresql"
+	}
+	return sql.OpenDB(timedConnector{driver: d, source: source, system: system}), nil
+}
+
+// Forwards to the driver connection, falling back like database/sql does
+// for the interfaces it does not implement
+type timedConn struct {
+	driver.Conn
+	system string
+	// Of the transaction in progress. database/sql runs the statements of a
+	// transaction without a context when they are not given one.
+	tx_ctx context.Context
+}
+
+// Starts timing a statement, the returned function ends it
+func (c *timedConn) observe(ctx context.Context, query string) func(err error) {
+	operation, _, _ := strings.Cut(strings.TrimSpace(query), " ")
+	operation = strings.ToLower(operation)
+	if c.tx_ctx != nil && !trace.SpanContextFromContext(ctx).IsValid() {
+		ctx = c.tx_ctx
+	}
+	_, span := tracing.StartChild(ctx, "db."+operation,
+		attribute.String("db.system", c.system),
+		attribute.String("db.statement", query))
+	start := time.Now()
+	return func(err error) {
+		metrics.DB_QUERY_DURATION.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+		tracing.End(span, err)
+	}
+}
+
+func (c *timedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	done := c.observe(ctx, query)
+	result, err := execer.ExecContext(ctx, query, args)
+	done(err)
+	return result, err
+}
+
+func (c *timedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	done := c.observe(ctx, query)
+	rows, err := queryer.QueryContext(ctx, query, args)
+	done(err)
+	return rows, err
+}
+
+func (c *timedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return preparer.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+// The span of a transaction lasts until it is committed or rolled back, with
+// sqlite that is how long it may hold the database lock
+func (c *timedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	ctx, span := tracing.StartChild(ctx, "db.transaction", attribute.String("db.system", c.system))
+	var tx driver.Tx
+	var err error
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		tx, err = beginner.BeginTx(ctx, opts)
+	} else {
+		tx, err = c.Conn.Begin()
+	}
+	if err != nil {
+		tracing.End(span, err)
+		return nil, err
+	}
+	c.tx_ctx = ctx
+	return &timedTx{Tx: tx, conn: c, span: span}, nil
+}
+
+func (c *timedConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *timedConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *timedConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+func (c *timedConn) CheckNamedValue(value *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return driver.ErrSkip
+}
+
+// Commits are timed too, with sqlite they are where the disk is synced
+type timedTx struct {
+	driver.Tx
+	conn *timedConn
+	span trace.Span
+}
+
+func (tx *timedTx) Commit() error {
+	done := tx.conn.observe(tx.conn.tx_ctx, "commit")
+	err := tx.Tx.Commit()
+	done(err)
+	tx.conn.tx_ctx = nil
+	tracing.End(tx.span, err)
+	return err
+}
+
+func (tx *timedTx) Rollback() error {
+	err := tx.Tx.Rollback()
+	tx.conn.tx_ctx = nil
+	tx.span.SetAttributes(attribute.Bool("db.rollback", true))
+	tracing.End(tx.span, err)
+	return err
+}
@@ -0,0 +1,339 @@
+// Computes rsync-style deltas. The receiver of a file signs the version it
+// has, block by block, with a weak rolling checksum and a strong hash. The
+// sender slides a window over its version, looking up the weak checksum of
+// the window at every byte, and sends either references to matching blocks
+// or the literal bytes that match nothing.
+package delta
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Bounds of the block size, which grows with the square root of the file
+// size so large files don't get too many signatures
+const (
+	MIN_BLOCK_SIZE = 2 << 10
+	MAX_BLOCK_SIZE = 64 << 10
+)
+
+// Longest literal in one Op
+const MAX_LITERAL = 256 << 10
+
+// Bytes of the SHA-256 kept as strong hash. A false match is caught by the
+// hash of the whole file, which the receiver checks.
+const STRONG_SIZE = 16
+
+var (
+	errBadOp    = errors.New("delta refers to blocks outside the base file")
+	errTooLarge = errors.New("patched file is larger than allowed")
+)
+
+type Block struct {
+	Weak   uint32
+	Strong []byte
+}
+
+// Signature of a file, only its last block may be shorter than BlockSize
+type Signature struct {
+	BlockSize int
+	Size      int64
+	Blocks    []Block
+}
+
+// One step of a delta, either literal Data or Blocks blocks of the base
+// file starting at Block
+type Op struct {
+	Data   []byte
+	Block  int64
+	Blocks int64
+}
+
+// Block size used to sign a file of size bytes
+func BlockSize(size int64) int {
+	block_size := int(math.Sqrt(float64(size)))
+	// Rounded up to KiB
+	block_size = (block_size + 1023) &^ 1023
+	return min(max(block_size, MIN_BLOCK_SIZE), MAX_BLOCK_SIZE)
+}
+
+// rsync weak checksum of a window, updated in constant time as the window
+// slides by one byte
+type rolling struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRolling(window []byte) rolling {
+	r := rolling{n: uint32(len(window))}
+	for i, c := range window {
+		r.a += uint32(c)
+		r.b += uint32(len(window)-i) * uint32(c)
+	}
+	return r
+}
+
+func (r *rolling) roll(out byte, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.n*uint32(out)
+}
+
+func (r rolling) sum() uint32 {
+	return r.a&0xffff | r.b<<16
+}
+
+func strong(block []byte) []byte {
+	sum := sha256.Sum256(block)
+	return sum[:STRONG_SIZE]
+}
+
+// Signs what is read from r with blocks of block_size bytes
+func Sign(r io.Reader, block_size int) (*Signature, error) {
+	sig := &Signature{BlockSize: block_size}
+	buf := make([]byte, block_size)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			weak := newRolling(buf[:n])
+			sig.Blocks = append(sig.Blocks, Block{Weak: weak.sum(), Strong: strong(buf[:n])})
+			sig.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Finds the delta turning the file signed by sig into what is read from r,
+// emit gets the ops in order. Consecutive blocks are merged into one Op.
+func Diff(r io.Reader, sig *Signature, emit func(Op) error) error {
+	d := &differ{r: r, sig: sig, emit: emit, index: map[uint32][]int64{}}
+	for i, block := range sig.Blocks {
+		// The short last block is only looked for at the end
+		if i < len(sig.Blocks)-1 || sig.Size%int64(sig.BlockSize) == 0 {
+			d.index[block.Weak] = append(d.index[block.Weak], int64(i))
+		}
+	}
+	return d.run()
+}
+
+type differ struct {
+	r     io.Reader
+	sig   *Signature
+	emit  func(Op) error
+	index map[uint32][]int64 // Block indexes by weak checksum
+
+	buf     []byte
+	literal int // Start of the literal not emitted yet in buf
+	pos     int // Start of the window in buf
+	end     int
+	eof     bool
+	pending Op // Blocks matched but not emitted yet
+}
+
+func (d *differ) run() error {
+	block_size := d.sig.BlockSize
+	d.buf = make([]byte, 2*MAX_LITERAL+block_size)
+	var weak rolling
+	valid := false // Whether weak is the checksum of the window
+	for {
+		if d.end-d.pos <= block_size && !d.eof {
+			err := d.fill()
+			if err != nil {
+				return err
+			}
+		}
+		if d.end-d.pos < block_size {
+			break
+		}
+		window := d.buf[d.pos : d.pos+block_size]
+		if !valid {
+			weak = newRolling(window)
+			valid = true
+		}
+		if block, ok := d.match(weak.sum(), window); ok {
+			err := d.copyBlock(block)
+			if err != nil {
+				return err
+			}
+			d.pos += block_size
+			d.literal = d.pos
+			valid = false
+			continue
+		}
+		if d.pos+block_size == d.end {
+			// Only at the end of the data, fill would have read more otherwise
+			d.pos++
+			valid = false
+			continue
+		}
+		weak.roll(d.buf[d.pos], d.buf[d.pos+block_size])
+		d.pos++
+		if d.pos-d.literal >= MAX_LITERAL {
+			err := d.flushLiteral()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// What is left is shorter than a block, it may be the short last block
+	last := len(d.sig.Blocks) - 1
+	tail := d.buf[d.pos:d.end]
+	if last >= 0 && d.sig.Size%int64(d.sig.BlockSize) == int64(len(tail)) && len(tail) > 0 {
+		block := d.sig.Blocks[last]
+		if newRolling(tail).sum() == block.Weak && bytes.Equal(strong(tail), block.Strong) {
+			err := d.copyBlock(int64(last))
+			if err != nil {
+				return err
+			}
+			d.pos = d.end
+			d.literal = d.pos
+		}
+	}
+	d.pos = d.end
+	err := d.flushLiteral()
+	if err != nil {
+		return err
+	}
+	return d.flushBlocks()
+}
+
+func (d *differ) match(weak uint32, window []byte) (int64, bool) {
+	candidates, ok := d.index[weak]
+	if !ok {
+		return 0, false
+	}
+	sum := strong(window)
+	for _, i := range candidates {
+		if bytes.Equal(sum, d.sig.Blocks[i].Strong) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Reads more data, keeping the literal not emitted yet and the window
+func (d *differ) fill() error {
+	if d.literal > 0 {
+		copy(d.buf, d.buf[d.literal:d.end])
+		d.pos -= d.literal
+		d.end -= d.literal
+		d.literal = 0
+	}
+	for d.end < len(d.buf) && !d.eof {
+		n, err := d.r.Read(d.buf[d.end:])
+		d.end += n
+		if err == io.EOF {
+			d.eof = true
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *differ) copyBlock(block int64) error {
+	err := d.flushLiteral()
+	if err != nil {
+		return err
+	}
+	if d.pending.Blocks > 0 && d.pending.Block+d.pending.Blocks == block {
+		d.pending.Blocks++
+		return nil
+	}
+	err = d.flushBlocks()
+	d.pending = Op{Block: block, Blocks: 1}
+	return err
+}
+
+func (d *differ) flushBlocks() error {
+	if d.pending.Blocks == 0 {
+		return nil
+	}
+	op := d.pending
+	d.pending = Op{}
+	return d.emit(op)
+}
+
+func (d *differ) flushLiteral() error {
+	if d.pos == d.literal {
+		return nil
+	}
+	err := d.flushBlocks()
+	if err != nil {
+		return err
+	}
+	for d.literal < d.pos {
+		n := min(d.pos-d.literal, MAX_LITERAL)
+		err = d.emit(Op{Data: append([]byte{}, d.buf[d.literal:d.literal+n]...)})
+		if err != nil {
+			return err
+		}
+		d.literal += n
+	}
+	return nil
+}
+
+// Applies ops to a base file of size bytes signed with block_size
+type Patcher struct {
+	MaxSize    int64 // Bytes the patched file may reach, 0 for no limit
+	w          io.Writer
+	base       io.ReaderAt
+	block_size int
+	size       int64
+	buf        []byte
+	written    int64
+}
+
+func NewPatcher(w io.Writer, base io.ReaderAt, block_size int, size int64) *Patcher {
+	return &Patcher{w: w, base: base, block_size: block_size, size: size, buf: make([]byte, block_size)}
+}
+
+// Checks that n more bytes keep the patched file within MaxSize
+func (p *Patcher) grow(n int64) error {
+	if p.MaxSize > 0 && n > p.MaxSize-p.written {
+		return fmt.Errorf("%w: more than %d bytes", errTooLarge, p.MaxSize)
+	}
+	p.written += n
+	return nil
+}
+
+func (p *Patcher) Apply(op Op) error {
+	if op.Blocks == 0 {
+		err := p.grow(int64(len(op.Data)))
+		if err != nil {
+			return err
+		}
+		_, err = p.w.Write(op.Data)
+		return err
+	}
+	blocks := (p.size + int64(p.block_size) - 1) / int64(p.block_size)
+	// Compared without adding, huge values would overflow
+	if op.Block < 0 || op.Blocks < 0 || op.Block > blocks || op.Blocks > blocks-op.Block {
+		return fmt.Errorf("%w: %d blocks from block %d of %d", errBadOp, op.Blocks, op.Block, blocks)
+	}
+	// Only the last block of the base may be short
+	err := p.grow(min((op.Block+op.Blocks)*int64(p.block_size), p.size) - op.Block*int64(p.block_size))
+	if err != nil {
+		return err
+	}
+	for i := op.Block; i < op.Block+op.Blocks; i++ {
+		n, err := p.base.ReadAt(p.buf, i*int64(p.block_size))
+		if err != nil && !(err == io.EOF && i == blocks-1) {
+			return err
+		}
+		_, err = p.w.Write(p.buf[:n])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
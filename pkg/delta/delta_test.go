@@ -0,0 +1,128 @@
+package delta
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func randomBytes(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// Diffs target against base and applies the delta to base, returns the
+// patched file and how many literal bytes the delta held
+func roundTrip(t *testing.T, base []byte, target []byte, block_size int) ([]byte, int) {
+	t.Helper()
+	sig, err := Sign(bytes.NewReader(base), block_size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig.Size != int64(len(base)) {
+		t.Fatalf("signature of %d bytes, want %d", sig.Size, len(base))
+	}
+	patched := &bytes.Buffer{}
+	patcher := NewPatcher(patched, bytes.NewReader(base), block_size, int64(len(base)))
+	literal := 0
+	err = Diff(bytes.NewReader(target), sig, func(op Op) error {
+		if len(op.Data) > MAX_LITERAL {
+			t.Errorf("literal of %d bytes, more than %d", len(op.Data), MAX_LITERAL)
+		}
+		literal += len(op.Data)
+		return patcher.Apply(op)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return patched.Bytes(), literal
+}
+
+func TestDiffApply(t *testing.T) {
+	const block_size = MIN_BLOCK_SIZE
+	base := randomBytes(1, 100*block_size+123)
+	tests := []struct {
+		name        string
+		base        []byte
+		target      []byte
+		max_literal int // Literal bytes expected at most, -1 for any
+	}{
+		{"identical", base, base, 0},
+		{"empty base", nil, base[:5000], -1},
+		{"empty target", base, nil, 0},
+		{"both empty", nil, nil, 0},
+		// The short last block of the base is only matched at the end
+		{"append", base, concat(base, []byte("appended")), block_size + 8},
+		{"prepend", base, concat([]byte("prepended"), base), 9},
+		{"insert in middle", base, concat(base[:50*block_size+7], []byte("inserted"), base[50*block_size+7:]), 2*block_size + 8},
+		{"remove in middle", base, concat(base[:20*block_size], base[30*block_size+5:]), 2 * block_size},
+		{"swap halves", base, concat(base[50*block_size:], base[:50*block_size]), 2 * block_size},
+		{"unrelated", base, randomBytes(2, 300*1024), -1},
+		{"larger than a literal", nil, randomBytes(3, 3*MAX_LITERAL+10), -1},
+		{"short last block", base[:block_size+10], base[:block_size+10], 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			patched, literal := roundTrip(t, test.base, test.target, block_size)
+			if !bytes.Equal(patched, test.target) {
+				t.Fatalf("patched file has %d bytes and differs from the %d bytes target", len(patched), len(test.target))
+			}
+			if test.max_literal >= 0 && literal > test.max_literal {
+				t.Errorf("delta has %d literal bytes, want at most %d", literal, test.max_literal)
+			}
+		})
+	}
+}
+
+func TestBlockSize(t *testing.T) {
+	tests := []struct {
+		size int64
+		want int
+	}{
+		{0, MIN_BLOCK_SIZE},
+		{1 << 20, MIN_BLOCK_SIZE},
+		{100 << 20, 10 << 10},
+		{1 << 40, MAX_BLOCK_SIZE},
+	}
+	for _, test := range tests {
+		got := BlockSize(test.size)
+		if got != test.want {
+			t.Errorf("BlockSize(%d) = %d, want %d", test.size, got, test.want)
+		}
+	}
+}
+
+func TestPatcherRejects(t *testing.T) {
+	const block_size = 1024
+	base := randomBytes(4, 10*block_size+1)
+	tests := []struct {
+		name     string
+		max_size int64
+		op       Op
+		want     error
+	}{
+		{"block past the end", 0, Op{Block: 12, Blocks: 1}, errBadOp},
+		{"blocks past the end", 0, Op{Block: 5, Blocks: 7}, errBadOp},
+		{"negative block", 0, Op{Block: -1, Blocks: 1}, errBadOp},
+		{"overflowing blocks", 0, Op{Block: 1, Blocks: 1<<63 - 1}, errBadOp},
+		{"literal over max size", 100, Op{Data: make([]byte, 101)}, errTooLarge},
+		{"blocks over max size", 2 * block_size, Op{Block: 0, Blocks: 3}, errTooLarge},
+		{"last block within max size", 1, Op{Block: 10, Blocks: 1}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			patcher := NewPatcher(&bytes.Buffer{}, bytes.NewReader(base), block_size, int64(len(base)))
+			patcher.MaxSize = test.max_size
+			err := patcher.Apply(test.op)
+			if !errors.Is(err, test.want) {
+				t.Errorf("Apply(%+v) = %v, want %v", test.op, err, test.want)
+			}
+		})
+	}
+}
@@ -28,6 +28,19 @@ type FileSyncClient interface {
 	MkDir(ctx context.Context, in *MkdirRequest, opts ...grpc.CallOption) (*FileMetadata, error)
 	RemoveFile(ctx context.Context, in *RemoveFileRequest, opts ...grpc.CallOption) (*RemoveFileResponse, error)
 	RemoveDir(ctx context.Context, in *RemoveDirRequest, opts ...grpc.CallOption) (*RemoveDirResponse, error)
+	DownloadArchive(ctx context.Context, in *ArchiveRequest, opts ...grpc.CallOption) (FileSync_DownloadArchiveClient, error)
+	UploadArchive(ctx context.Context, opts ...grpc.CallOption) (FileSync_UploadArchiveClient, error)
+	FindMissingChunks(ctx context.Context, in *ChunkList, opts ...grpc.CallOption) (*ChunkList, error)
+	UploadChunks(ctx context.Context, opts ...grpc.CallOption) (FileSync_UploadChunksClient, error)
+	CommitManifest(ctx context.Context, opts ...grpc.CallOption) (FileSync_CommitManifestClient, error)
+	GetManifest(ctx context.Context, in *FileMetadata, opts ...grpc.CallOption) (FileSync_GetManifestClient, error)
+	DownloadChunks(ctx context.Context, in *ChunkList, opts ...grpc.CallOption) (FileSync_DownloadChunksClient, error)
+	GetSignature(ctx context.Context, in *SignatureRequest, opts ...grpc.CallOption) (FileSync_GetSignatureClient, error)
+	UploadDelta(ctx context.Context, opts ...grpc.CallOption) (FileSync_UploadDeltaClient, error)
+	DownloadRange(ctx context.Context, in *RangeRequest, opts ...grpc.CallOption) (FileSync_DownloadRangeClient, error)
+	UploadRange(ctx context.Context, opts ...grpc.CallOption) (FileSync_UploadRangeClient, error)
+	CommitUpload(ctx context.Context, in *CommitUploadRequest, opts ...grpc.CallOption) (*FileMetadata, error)
+	AbortUpload(ctx context.Context, in *AbortUploadRequest, opts ...grpc.CallOption) (*AbortUploadResponse, error)
 }
 
 type fileSyncClient struct {
@@ -140,6 +153,363 @@ func (c *fileSyncClient) RemoveDir(ctx context.Context, in *RemoveDirRequest, op
 	return out, nil
 }
 
+func (c *fileSyncClient) DownloadArchive(ctx context.Context, in *ArchiveRequest, opts ...grpc.CallOption) (FileSync_DownloadArchiveClient, error) {
+	stream, err := c.cc.NewStream(ctx, &FileSync_ServiceDesc.Streams[2], "/file.FileSync/DownloadArchive", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &fileSyncDownloadArchiveClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type FileSync_DownloadArchiveClient interface {
+	Recv() (*FileResponse, error)
+	grpc.ClientStream
+}
+
+type fileSyncDownloadArchiveClient struct {
+	grpc.ClientStream
+}
+
+func (x *fileSyncDownloadArchiveClient) Recv() (*FileResponse, error) {
+	m := new(FileResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *fileSyncClient) UploadArchive(ctx context.Context, opts ...grpc.CallOption) (FileSync_UploadArchiveClient, error) {
+	stream, err := c.cc.NewStream(ctx, &FileSync_ServiceDesc.Streams[3], "/file.FileSync/UploadArchive", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &fileSyncUploadArchiveClient{stream}
+	return x, nil
+}
+
+type FileSync_UploadArchiveClient interface {
+	Send(*ArchiveUploadMessage) error
+	CloseAndRecv() (*ArchiveUploadResponse, error)
+	grpc.ClientStream
+}
+
+type fileSyncUploadArchiveClient struct {
+	grpc.ClientStream
+}
+
+func (x *fileSyncUploadArchiveClient) Send(m *ArchiveUploadMessage) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *fileSyncUploadArchiveClient) CloseAndRecv() (*ArchiveUploadResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(ArchiveUploadResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *fileSyncClient) FindMissingChunks(ctx context.Context, in *ChunkList, opts ...grpc.CallOption) (*ChunkList, error) {
+	out := new(ChunkList)
+	err := c.cc.Invoke(ctx, "/file.FileSync/FindMissingChunks", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fileSyncClient) UploadChunks(ctx context.Context, opts ...grpc.CallOption) (FileSync_UploadChunksClient, error) {
+	stream, err := c.cc.NewStream(ctx, &FileSync_ServiceDesc.Streams[4], "/file.FileSync/UploadChunks", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &fileSyncUploadChunksClient{stream}
+	return x, nil
+}
+
+type FileSync_UploadChunksClient interface {
+	Send(*ChunkData) error
+	CloseAndRecv() (*UploadChunksResponse, error)
+	grpc.ClientStream
+}
+
+type fileSyncUploadChunksClient struct {
+	grpc.ClientStream
+}
+
+func (x *fileSyncUploadChunksClient) Send(m *ChunkData) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *fileSyncUploadChunksClient) CloseAndRecv() (*UploadChunksResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(UploadChunksResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *fileSyncClient) CommitManifest(ctx context.Context, opts ...grpc.CallOption) (FileSync_CommitManifestClient, error) {
+	stream, err := c.cc.NewStream(ctx, &FileSync_ServiceDesc.Streams[5], "/file.FileSync/CommitManifest", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &fileSyncCommitManifestClient{stream}
+	return x, nil
+}
+
+type FileSync_CommitManifestClient interface {
+	Send(*FileManifest) error
+	CloseAndRecv() (*FileMetadata, error)
+	grpc.ClientStream
+}
+
+type fileSyncCommitManifestClient struct {
+	grpc.ClientStream
+}
+
+func (x *fileSyncCommitManifestClient) Send(m *FileManifest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *fileSyncCommitManifestClient) CloseAndRecv() (*FileMetadata, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(FileMetadata)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *fileSyncClient) GetManifest(ctx context.Context, in *FileMetadata, opts ...grpc.CallOption) (FileSync_GetManifestClient, error) {
+	stream, err := c.cc.NewStream(ctx, &FileSync_ServiceDesc.Streams[6], "/file.FileSync/GetManifest", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &fileSyncGetManifestClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type FileSync_GetManifestClient interface {
+	Recv() (*FileManifest, error)
+	grpc.ClientStream
+}
+
+type fileSyncGetManifestClient struct {
+	grpc.ClientStream
+}
+
+func (x *fileSyncGetManifestClient) Recv() (*FileManifest, error) {
+	m := new(FileManifest)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *fileSyncClient) DownloadChunks(ctx context.Context, in *ChunkList, opts ...grpc.CallOption) (FileSync_DownloadChunksClient, error) {
+	stream, err := c.cc.NewStream(ctx, &FileSync_ServiceDesc.Streams[7], "/file.FileSync/DownloadChunks", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &fileSyncDownloadChunksClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type FileSync_DownloadChunksClient interface {
+	Recv() (*ChunkData, error)
+	grpc.ClientStream
+}
+
+type fileSyncDownloadChunksClient struct {
+	grpc.ClientStream
+}
+
+func (x *fileSyncDownloadChunksClient) Recv() (*ChunkData, error) {
+	m := new(ChunkData)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *fileSyncClient) GetSignature(ctx context.Context, in *SignatureRequest, opts ...grpc.CallOption) (FileSync_GetSignatureClient, error) {
+	stream, err := c.cc.NewStream(ctx, &FileSync_ServiceDesc.Streams[8], "/file.FileSync/GetSignature", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &fileSyncGetSignatureClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type FileSync_GetSignatureClient interface {
+	Recv() (*FileSignature, error)
+	grpc.ClientStream
+}
+
+type fileSyncGetSignatureClient struct {
+	grpc.ClientStream
+}
+
+func (x *fileSyncGetSignatureClient) Recv() (*FileSignature, error) {
+	m := new(FileSignature)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *fileSyncClient) UploadDelta(ctx context.Context, opts ...grpc.CallOption) (FileSync_UploadDeltaClient, error) {
+	stream, err := c.cc.NewStream(ctx, &FileSync_ServiceDesc.Streams[9], "/file.FileSync/UploadDelta", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &fileSyncUploadDeltaClient{stream}
+	return x, nil
+}
+
+type FileSync_UploadDeltaClient interface {
+	Send(*DeltaMessage) error
+	CloseAndRecv() (*FileMetadata, error)
+	grpc.ClientStream
+}
+
+type fileSyncUploadDeltaClient struct {
+	grpc.ClientStream
+}
+
+func (x *fileSyncUploadDeltaClient) Send(m *DeltaMessage) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *fileSyncUploadDeltaClient) CloseAndRecv() (*FileMetadata, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(FileMetadata)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *fileSyncClient) DownloadRange(ctx context.Context, in *RangeRequest, opts ...grpc.CallOption) (FileSync_DownloadRangeClient, error) {
+	stream, err := c.cc.NewStream(ctx, &FileSync_ServiceDesc.Streams[10], "/file.FileSync/DownloadRange", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &fileSyncDownloadRangeClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type FileSync_DownloadRangeClient interface {
+	Recv() (*FileBytesMessage, error)
+	grpc.ClientStream
+}
+
+type fileSyncDownloadRangeClient struct {
+	grpc.ClientStream
+}
+
+func (x *fileSyncDownloadRangeClient) Recv() (*FileBytesMessage, error) {
+	m := new(FileBytesMessage)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *fileSyncClient) UploadRange(ctx context.Context, opts ...grpc.CallOption) (FileSync_UploadRangeClient, error) {
+	stream, err := c.cc.NewStream(ctx, &FileSync_ServiceDesc.Streams[11], "/file.FileSync/UploadRange", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &fileSyncUploadRangeClient{stream}
+	return x, nil
+}
+
+type FileSync_UploadRangeClient interface {
+	Send(*RangeMessage) error
+	CloseAndRecv() (*RangeResponse, error)
+	grpc.ClientStream
+}
+
+type fileSyncUploadRangeClient struct {
+	grpc.ClientStream
+}
+
+func (x *fileSyncUploadRangeClient) Send(m *RangeMessage) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *fileSyncUploadRangeClient) CloseAndRecv() (*RangeResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(RangeResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *fileSyncClient) CommitUpload(ctx context.Context, in *CommitUploadRequest, opts ...grpc.CallOption) (*FileMetadata, error) {
+	out := new(FileMetadata)
+	err := c.cc.Invoke(ctx, "/file.FileSync/CommitUpload", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fileSyncClient) AbortUpload(ctx context.Context, in *AbortUploadRequest, opts ...grpc.CallOption) (*AbortUploadResponse, error) {
+	out := new(AbortUploadResponse)
+	err := c.cc.Invoke(ctx, "/file.FileSync/AbortUpload", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // FileSyncServer is the server API for FileSync service.
 // All implementations must embed UnimplementedFileSyncServer
 // for forward compatibility
@@ -150,159 +520,500 @@ type FileSyncServer interface {
 	MkDir(context.Context, *MkdirRequest) (*FileMetadata, error)
 	RemoveFile(context.Context, *RemoveFileRequest) (*RemoveFileResponse, error)
 	RemoveDir(context.Context, *RemoveDirRequest) (*RemoveDirResponse, error)
+	DownloadArchive(*ArchiveRequest, FileSync_DownloadArchiveServer) error
+	UploadArchive(FileSync_UploadArchiveServer) error
+	FindMissingChunks(context.Context, *ChunkList) (*ChunkList, error)
+	UploadChunks(FileSync_UploadChunksServer) error
+	CommitManifest(FileSync_CommitManifestServer) error
+	GetManifest(*FileMetadata, FileSync_GetManifestServer) error
+	DownloadChunks(*ChunkList, FileSync_DownloadChunksServer) error
+	GetSignature(*SignatureRequest, FileSync_GetSignatureServer) error
+	UploadDelta(FileSync_UploadDeltaServer) error
+	DownloadRange(*RangeRequest, FileSync_DownloadRangeServer) error
+	UploadRange(FileSync_UploadRangeServer) error
+	CommitUpload(context.Context, *CommitUploadRequest) (*FileMetadata, error)
+	AbortUpload(context.Context, *AbortUploadRequest) (*AbortUploadResponse, error)
+	mustEmbedUnimplementedFileSyncServer()
+}
+
+// UnimplementedFileSyncServer must be embedded to have forward compatible implementations.
+type UnimplementedFileSyncServer struct {
+}
+
+func (UnimplementedFileSyncServer) FileList(context.Context, *FileListRequest) (*FileListResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method FileList not implemented")
+}
+func (UnimplementedFileSyncServer) FileDownload(*FileMetadata, FileSync_FileDownloadServer) error {
+	return status.Errorf(codes.Unimplemented, "method FileDownload not implemented")
+}
+func (UnimplementedFileSyncServer) FileUpload(FileSync_FileUploadServer) error {
+	return status.Errorf(codes.Unimplemented, "method FileUpload not implemented")
+}
+func (UnimplementedFileSyncServer) MkDir(context.Context, *MkdirRequest) (*FileMetadata, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method MkDir not implemented")
+}
+func (UnimplementedFileSyncServer) RemoveFile(context.Context, *RemoveFileRequest) (*RemoveFileResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RemoveFile not implemented")
+}
+func (UnimplementedFileSyncServer) RemoveDir(context.Context, *RemoveDirRequest) (*RemoveDirResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RemoveDir not implemented")
+}
+func (UnimplementedFileSyncServer) DownloadArchive(*ArchiveRequest, FileSync_DownloadArchiveServer) error {
+	return status.Errorf(codes.Unimplemented, "method DownloadArchive not implemented")
+}
+func (UnimplementedFileSyncServer) UploadArchive(FileSync_UploadArchiveServer) error {
+	return status.Errorf(codes.Unimplemented, "method UploadArchive not implemented")
+}
+func (UnimplementedFileSyncServer) FindMissingChunks(context.Context, *ChunkList) (*ChunkList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method FindMissingChunks not implemented")
+}
+func (UnimplementedFileSyncServer) UploadChunks(FileSync_UploadChunksServer) error {
+	return status.Errorf(codes.Unimplemented, "method UploadChunks not implemented")
+}
+func (UnimplementedFileSyncServer) CommitManifest(FileSync_CommitManifestServer) error {
+	return status.Errorf(codes.Unimplemented, "method CommitManifest not implemented")
+}
+func (UnimplementedFileSyncServer) GetManifest(*FileMetadata, FileSync_GetManifestServer) error {
+	return status.Errorf(codes.Unimplemented, "method GetManifest not implemented")
+}
+func (UnimplementedFileSyncServer) DownloadChunks(*ChunkList, FileSync_DownloadChunksServer) error {
+	return status.Errorf(codes.Unimplemented, "method DownloadChunks not implemented")
+}
+func (UnimplementedFileSyncServer) GetSignature(*SignatureRequest, FileSync_GetSignatureServer) error {
+	return status.Errorf(codes.Unimplemented, "method GetSignature not implemented")
+}
+func (UnimplementedFileSyncServer) UploadDelta(FileSync_UploadDeltaServer) error {
+	return status.Errorf(codes.Unimplemented, "method UploadDelta not implemented")
+}
+func (UnimplementedFileSyncServer) DownloadRange(*RangeRequest, FileSync_DownloadRangeServer) error {
+	return status.Errorf(codes.Unimplemented, "method DownloadRange not implemented")
+}
+func (UnimplementedFileSyncServer) UploadRange(FileSync_UploadRangeServer) error {
+	return status.Errorf(codes.Unimplemented, "method UploadRange not implemented")
+}
+func (UnimplementedFileSyncServer) CommitUpload(context.Context, *CommitUploadRequest) (*FileMetadata, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CommitUpload not implemented")
+}
+func (UnimplementedFileSyncServer) AbortUpload(context.Context, *AbortUploadRequest) (*AbortUploadResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AbortUpload not implemented")
+}
+func (UnimplementedFileSyncServer) mustEmbedUnimplementedFileSyncServer() {}
+
+// UnsafeFileSyncServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to FileSyncServer will
+// result in compilation errors.
+type UnsafeFileSyncServer interface {
 	mustEmbedUnimplementedFileSyncServer()
 }
 
-// UnimplementedFileSyncServer must be embedded to have forward compatible implementations.
-type UnimplementedFileSyncServer struct {
+func RegisterFileSyncServer(s grpc.ServiceRegistrar, srv FileSyncServer) {
+	s.RegisterService(&FileSync_ServiceDesc, srv)
+}
+
+func _FileSync_FileList_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FileListRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileSyncServer).FileList(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/file.FileSync/FileList",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FileSyncServer).FileList(ctx, req.(*FileListRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FileSync_FileDownload_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(FileMetadata)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(FileSyncServer).FileDownload(m, &fileSyncFileDownloadServer{stream})
+}
+
+type FileSync_FileDownloadServer interface {
+	Send(*FileBytesMessage) error
+	grpc.ServerStream
+}
+
+type fileSyncFileDownloadServer struct {
+	grpc.ServerStream
+}
+
+func (x *fileSyncFileDownloadServer) Send(m *FileBytesMessage) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _FileSync_FileUpload_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(FileSyncServer).FileUpload(&fileSyncFileUploadServer{stream})
+}
+
+type FileSync_FileUploadServer interface {
+	SendAndClose(*FileMetadata) error
+	Recv() (*FileBytesMessage, error)
+	grpc.ServerStream
+}
+
+type fileSyncFileUploadServer struct {
+	grpc.ServerStream
+}
+
+func (x *fileSyncFileUploadServer) SendAndClose(m *FileMetadata) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *fileSyncFileUploadServer) Recv() (*FileBytesMessage, error) {
+	m := new(FileBytesMessage)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _FileSync_MkDir_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MkdirRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileSyncServer).MkDir(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/file.FileSync/MkDir",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FileSyncServer).MkDir(ctx, req.(*MkdirRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FileSync_RemoveFile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RemoveFileRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileSyncServer).RemoveFile(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/file.FileSync/RemoveFile",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FileSyncServer).RemoveFile(ctx, req.(*RemoveFileRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FileSync_RemoveDir_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RemoveDirRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileSyncServer).RemoveDir(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/file.FileSync/RemoveDir",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FileSyncServer).RemoveDir(ctx, req.(*RemoveDirRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FileSync_DownloadArchive_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ArchiveRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(FileSyncServer).DownloadArchive(m, &fileSyncDownloadArchiveServer{stream})
+}
+
+type FileSync_DownloadArchiveServer interface {
+	Send(*FileResponse) error
+	grpc.ServerStream
+}
+
+type fileSyncDownloadArchiveServer struct {
+	grpc.ServerStream
+}
+
+func (x *fileSyncDownloadArchiveServer) Send(m *FileResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _FileSync_UploadArchive_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(FileSyncServer).UploadArchive(&fileSyncUploadArchiveServer{stream})
+}
+
+type FileSync_UploadArchiveServer interface {
+	SendAndClose(*ArchiveUploadResponse) error
+	Recv() (*ArchiveUploadMessage, error)
+	grpc.ServerStream
+}
+
+type fileSyncUploadArchiveServer struct {
+	grpc.ServerStream
+}
+
+func (x *fileSyncUploadArchiveServer) SendAndClose(m *ArchiveUploadResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *fileSyncUploadArchiveServer) Recv() (*ArchiveUploadMessage, error) {
+	m := new(ArchiveUploadMessage)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _FileSync_FindMissingChunks_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ChunkList)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileSyncServer).FindMissingChunks(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/file.FileSync/FindMissingChunks",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FileSyncServer).FindMissingChunks(ctx, req.(*ChunkList))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FileSync_UploadChunks_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(FileSyncServer).UploadChunks(&fileSyncUploadChunksServer{stream})
+}
+
+type FileSync_UploadChunksServer interface {
+	SendAndClose(*UploadChunksResponse) error
+	Recv() (*ChunkData, error)
+	grpc.ServerStream
+}
+
+type fileSyncUploadChunksServer struct {
+	grpc.ServerStream
+}
+
+func (x *fileSyncUploadChunksServer) SendAndClose(m *UploadChunksResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *fileSyncUploadChunksServer) Recv() (*ChunkData, error) {
+	m := new(ChunkData)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _FileSync_CommitManifest_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(FileSyncServer).CommitManifest(&fileSyncCommitManifestServer{stream})
+}
+
+type FileSync_CommitManifestServer interface {
+	SendAndClose(*FileMetadata) error
+	Recv() (*FileManifest, error)
+	grpc.ServerStream
+}
+
+type fileSyncCommitManifestServer struct {
+	grpc.ServerStream
+}
+
+func (x *fileSyncCommitManifestServer) SendAndClose(m *FileMetadata) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *fileSyncCommitManifestServer) Recv() (*FileManifest, error) {
+	m := new(FileManifest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _FileSync_GetManifest_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(FileMetadata)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(FileSyncServer).GetManifest(m, &fileSyncGetManifestServer{stream})
+}
+
+type FileSync_GetManifestServer interface {
+	Send(*FileManifest) error
+	grpc.ServerStream
+}
+
+type fileSyncGetManifestServer struct {
+	grpc.ServerStream
+}
+
+func (x *fileSyncGetManifestServer) Send(m *FileManifest) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _FileSync_DownloadChunks_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ChunkList)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(FileSyncServer).DownloadChunks(m, &fileSyncDownloadChunksServer{stream})
+}
+
+type FileSync_DownloadChunksServer interface {
+	Send(*ChunkData) error
+	grpc.ServerStream
 }
 
-func (UnimplementedFileSyncServer) FileList(context.Context, *FileListRequest) (*FileListResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method FileList not implemented")
+type fileSyncDownloadChunksServer struct {
+	grpc.ServerStream
 }
-func (UnimplementedFileSyncServer) FileDownload(*FileMetadata, FileSync_FileDownloadServer) error {
-	return status.Errorf(codes.Unimplemented, "method FileDownload not implemented")
+
+func (x *fileSyncDownloadChunksServer) Send(m *ChunkData) error {
+	return x.ServerStream.SendMsg(m)
 }
-func (UnimplementedFileSyncServer) FileUpload(FileSync_FileUploadServer) error {
-	return status.Errorf(codes.Unimplemented, "method FileUpload not implemented")
+
+func _FileSync_GetSignature_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SignatureRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(FileSyncServer).GetSignature(m, &fileSyncGetSignatureServer{stream})
 }
-func (UnimplementedFileSyncServer) MkDir(context.Context, *MkdirRequest) (*FileMetadata, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method MkDir not implemented")
+
+type FileSync_GetSignatureServer interface {
+	Send(*FileSignature) error
+	grpc.ServerStream
 }
-func (UnimplementedFileSyncServer) RemoveFile(context.Context, *RemoveFileRequest) (*RemoveFileResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method RemoveFile not implemented")
+
+type fileSyncGetSignatureServer struct {
+	grpc.ServerStream
 }
-func (UnimplementedFileSyncServer) RemoveDir(context.Context, *RemoveDirRequest) (*RemoveDirResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method RemoveDir not implemented")
+
+func (x *fileSyncGetSignatureServer) Send(m *FileSignature) error {
+	return x.ServerStream.SendMsg(m)
 }
-func (UnimplementedFileSyncServer) mustEmbedUnimplementedFileSyncServer() {}
 
-// UnsafeFileSyncServer may be embedded to opt out of forward compatibility for this service.
-// Use of this interface is not recommended, as added methods to FileSyncServer will
-// result in compilation errors.
-type UnsafeFileSyncServer interface {
-	mustEmbedUnimplementedFileSyncServer()
+func _FileSync_UploadDelta_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(FileSyncServer).UploadDelta(&fileSyncUploadDeltaServer{stream})
 }
 
-func RegisterFileSyncServer(s grpc.ServiceRegistrar, srv FileSyncServer) {
-	s.RegisterService(&FileSync_ServiceDesc, srv)
+type FileSync_UploadDeltaServer interface {
+	SendAndClose(*FileMetadata) error
+	Recv() (*DeltaMessage, error)
+	grpc.ServerStream
 }
 
-func _FileSync_FileList_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(FileListRequest)
-	if err := dec(in); err != nil {
+type fileSyncUploadDeltaServer struct {
+	grpc.ServerStream
+}
+
+func (x *fileSyncUploadDeltaServer) SendAndClose(m *FileMetadata) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *fileSyncUploadDeltaServer) Recv() (*DeltaMessage, error) {
+	m := new(DeltaMessage)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
 		return nil, err
 	}
-	if interceptor == nil {
-		return srv.(FileSyncServer).FileList(ctx, in)
-	}
-	info := &grpc.UnaryServerInfo{
-		Server:     srv,
-		FullMethod: "/file.FileSync/FileList",
-	}
-	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(FileSyncServer).FileList(ctx, req.(*FileListRequest))
-	}
-	return interceptor(ctx, in, info, handler)
+	return m, nil
 }
 
-func _FileSync_FileDownload_Handler(srv interface{}, stream grpc.ServerStream) error {
-	m := new(FileMetadata)
+func _FileSync_DownloadRange_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(RangeRequest)
 	if err := stream.RecvMsg(m); err != nil {
 		return err
 	}
-	return srv.(FileSyncServer).FileDownload(m, &fileSyncFileDownloadServer{stream})
+	return srv.(FileSyncServer).DownloadRange(m, &fileSyncDownloadRangeServer{stream})
 }
 
-type FileSync_FileDownloadServer interface {
+type FileSync_DownloadRangeServer interface {
 	Send(*FileBytesMessage) error
 	grpc.ServerStream
 }
 
-type fileSyncFileDownloadServer struct {
+type fileSyncDownloadRangeServer struct {
 	grpc.ServerStream
 }
 
-func (x *fileSyncFileDownloadServer) Send(m *FileBytesMessage) error {
+func (x *fileSyncDownloadRangeServer) Send(m *FileBytesMessage) error {
 	return x.ServerStream.SendMsg(m)
 }
 
-func _FileSync_FileUpload_Handler(srv interface{}, stream grpc.ServerStream) error {
-	return srv.(FileSyncServer).FileUpload(&fileSyncFileUploadServer{stream})
+func _FileSync_UploadRange_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(FileSyncServer).UploadRange(&fileSyncUploadRangeServer{stream})
 }
 
-type FileSync_FileUploadServer interface {
-	SendAndClose(*FileMetadata) error
-	Recv() (*FileBytesMessage, error)
+type FileSync_UploadRangeServer interface {
+	SendAndClose(*RangeResponse) error
+	Recv() (*RangeMessage, error)
 	grpc.ServerStream
 }
 
-type fileSyncFileUploadServer struct {
+type fileSyncUploadRangeServer struct {
 	grpc.ServerStream
 }
 
-func (x *fileSyncFileUploadServer) SendAndClose(m *FileMetadata) error {
+func (x *fileSyncUploadRangeServer) SendAndClose(m *RangeResponse) error {
 	return x.ServerStream.SendMsg(m)
 }
 
-func (x *fileSyncFileUploadServer) Recv() (*FileBytesMessage, error) {
-	m := new(FileBytesMessage)
+func (x *fileSyncUploadRangeServer) Recv() (*RangeMessage, error) {
+	m := new(RangeMessage)
 	if err := x.ServerStream.RecvMsg(m); err != nil {
 		return nil, err
 	}
 	return m, nil
 }
 
-func _FileSync_MkDir_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(MkdirRequest)
-	if err := dec(in); err != nil {
-		return nil, err
-	}
-	if interceptor == nil {
-		return srv.(FileSyncServer).MkDir(ctx, in)
-	}
-	info := &grpc.UnaryServerInfo{
-		Server:     srv,
-		FullMethod: "/file.FileSync/MkDir",
-	}
-	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(FileSyncServer).MkDir(ctx, req.(*MkdirRequest))
-	}
-	return interceptor(ctx, in, info, handler)
-}
-
-func _FileSync_RemoveFile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(RemoveFileRequest)
+func _FileSync_CommitUpload_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CommitUploadRequest)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
 	if interceptor == nil {
-		return srv.(FileSyncServer).RemoveFile(ctx, in)
+		return srv.(FileSyncServer).CommitUpload(ctx, in)
 	}
 	info := &grpc.UnaryServerInfo{
 		Server:     srv,
-		FullMethod: "/file.FileSync/RemoveFile",
+		FullMethod: "/file.FileSync/CommitUpload",
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(FileSyncServer).RemoveFile(ctx, req.(*RemoveFileRequest))
+		return srv.(FileSyncServer).CommitUpload(ctx, req.(*CommitUploadRequest))
 	}
 	return interceptor(ctx, in, info, handler)
 }
 
-func _FileSync_RemoveDir_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(RemoveDirRequest)
+func _FileSync_AbortUpload_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AbortUploadRequest)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
 	if interceptor == nil {
-		return srv.(FileSyncServer).RemoveDir(ctx, in)
+		return srv.(FileSyncServer).AbortUpload(ctx, in)
 	}
 	info := &grpc.UnaryServerInfo{
 		Server:     srv,
-		FullMethod: "/file.FileSync/RemoveDir",
+		FullMethod: "/file.FileSync/AbortUpload",
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(FileSyncServer).RemoveDir(ctx, req.(*RemoveDirRequest))
+		return srv.(FileSyncServer).AbortUpload(ctx, req.(*AbortUploadRequest))
 	}
 	return interceptor(ctx, in, info, handler)
 }
@@ -330,6 +1041,18 @@ var FileSync_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "RemoveDir",
 			Handler:    _FileSync_RemoveDir_Handler,
 		},
+		{
+			MethodName: "FindMissingChunks",
+			Handler:    _FileSync_FindMissingChunks_Handler,
+		},
+		{
+			MethodName: "CommitUpload",
+			Handler:    _FileSync_CommitUpload_Handler,
+		},
+		{
+			MethodName: "AbortUpload",
+			Handler:    _FileSync_AbortUpload_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -342,6 +1065,256 @@ var FileSync_ServiceDesc = grpc.ServiceDesc{
 			Handler:       _FileSync_FileUpload_Handler,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "DownloadArchive",
+			Handler:       _FileSync_DownloadArchive_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "UploadArchive",
+			Handler:       _FileSync_UploadArchive_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "UploadChunks",
+			Handler:       _FileSync_UploadChunks_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "CommitManifest",
+			Handler:       _FileSync_CommitManifest_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "GetManifest",
+			Handler:       _FileSync_GetManifest_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "DownloadChunks",
+			Handler:       _FileSync_DownloadChunks_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "GetSignature",
+			Handler:       _FileSync_GetSignature_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "UploadDelta",
+			Handler:       _FileSync_UploadDelta_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "DownloadRange",
+			Handler:       _FileSync_DownloadRange_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "UploadRange",
+			Handler:       _FileSync_UploadRange_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "pkg/file/file.proto",
+}
+
+// AdminClient is the client API for Admin service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type AdminClient interface {
+	Fsck(ctx context.Context, in *FsckRequest, opts ...grpc.CallOption) (*FsckResponse, error)
+	ScrubStatus(ctx context.Context, in *ScrubStatusRequest, opts ...grpc.CallOption) (*ScrubStatusResponse, error)
+	// Reads the configuration again, as SIGHUP does
+	Reload(ctx context.Context, in *ReloadRequest, opts ...grpc.CallOption) (*ReloadResponse, error)
+	// Stops the server as SIGTERM does, once the calls in flight finished or
+	// the shutdown grace period ran out. Returns right away.
+	Drain(ctx context.Context, in *DrainRequest, opts ...grpc.CallOption) (*DrainResponse, error)
+}
+
+type adminClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAdminClient(cc grpc.ClientConnInterface) AdminClient {
+	return &adminClient{cc}
+}
+
+func (c *adminClient) Fsck(ctx context.Context, in *FsckRequest, opts ...grpc.CallOption) (*FsckResponse, error) {
+	out := new(FsckResponse)
+	err := c.cc.Invoke(ctx, "/file.Admin/Fsck", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) ScrubStatus(ctx context.Context, in *ScrubStatusRequest, opts ...grpc.CallOption) (*ScrubStatusResponse, error) {
+	out := new(ScrubStatusResponse)
+	err := c.cc.Invoke(ctx, "/file.Admin/ScrubStatus", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) Reload(ctx context.Context, in *ReloadRequest, opts ...grpc.CallOption) (*ReloadResponse, error) {
+	out := new(ReloadResponse)
+	err := c.cc.Invoke(ctx, "/file.Admin/Reload", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) Drain(ctx context.Context, in *DrainRequest, opts ...grpc.CallOption) (*DrainResponse, error) {
+	out := new(DrainResponse)
+	err := c.cc.Invoke(ctx, "/file.Admin/Drain", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AdminServer is the server API for Admin service.
+// All implementations must embed UnimplementedAdminServer
+// for forward compatibility
+type AdminServer interface {
+	Fsck(context.Context, *FsckRequest) (*FsckResponse, error)
+	ScrubStatus(context.Context, *ScrubStatusRequest) (*ScrubStatusResponse, error)
+	// Reads the configuration again, as SIGHUP does
+	Reload(context.Context, *ReloadRequest) (*ReloadResponse, error)
+	// Stops the server as SIGTERM does, once the calls in flight finished or
+	// the shutdown grace period ran out. Returns right away.
+	Drain(context.Context, *DrainRequest) (*DrainResponse, error)
+	mustEmbedUnimplementedAdminServer()
+}
+
+// UnimplementedAdminServer must be embedded to have forward compatible implementations.
+type UnimplementedAdminServer struct {
+}
+
+func (UnimplementedAdminServer) Fsck(context.Context, *FsckRequest) (*FsckResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Fsck not implemented")
+}
+func (UnimplementedAdminServer) ScrubStatus(context.Context, *ScrubStatusRequest) (*ScrubStatusResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ScrubStatus not implemented")
+}
+func (UnimplementedAdminServer) Reload(context.Context, *ReloadRequest) (*ReloadResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Reload not implemented")
+}
+func (UnimplementedAdminServer) Drain(context.Context, *DrainRequest) (*DrainResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Drain not implemented")
+}
+func (UnimplementedAdminServer) mustEmbedUnimplementedAdminServer() {}
+
+// UnsafeAdminServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AdminServer will
+// result in compilation errors.
+type UnsafeAdminServer interface {
+	mustEmbedUnimplementedAdminServer()
+}
+
+func RegisterAdminServer(s grpc.ServiceRegistrar, srv AdminServer) {
+	s.RegisterService(&Admin_ServiceDesc, srv)
+}
+
+func _Admin_Fsck_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FsckRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).Fsck(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/file.Admin/Fsck",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).Fsck(ctx, req.(*FsckRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_ScrubStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ScrubStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).ScrubStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/file.Admin/ScrubStatus",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).ScrubStatus(ctx, req.(*ScrubStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_Reload_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReloadRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).Reload(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/file.Admin/Reload",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).Reload(ctx, req.(*ReloadRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_Drain_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DrainRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).Drain(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/file.Admin/Drain",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).Drain(ctx, req.(*DrainRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Admin_ServiceDesc is the grpc.ServiceDesc for Admin service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Admin_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "file.Admin",
+	HandlerType: (*AdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Fsck",
+			Handler:    _Admin_Fsck_Handler,
+		},
+		{
+			MethodName: "ScrubStatus",
+			Handler:    _Admin_ScrubStatus_Handler,
+		},
+		{
+			MethodName: "Reload",
+			Handler:    _Admin_Reload_Handler,
+		},
+		{
+			MethodName: "Drain",
+			Handler:    _Admin_Drain_Handler,
+		},
 	},
+	Streams:  []grpc.StreamDesc{},
 	Metadata: "pkg/file/file.proto",
 }
@@ -0,0 +1,54 @@
+// Prometheus metrics of the server. They are always recorded and only
+// served when the server is given a metrics address.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	RPC_REQUESTS = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "filesync_rpc_requests_total",
+		Help: "Calls handled, by method and status code.",
+	}, []string{"method", "code"})
+	RPC_DURATION = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "filesync_rpc_duration_seconds",
+		Help:    "Time taken by calls, by method.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"method"})
+	ACTIVE_STREAMS = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "filesync_active_streams",
+		Help: "Streaming calls in flight, by method.",
+	}, []string{"method"})
+	RECEIVED_BYTES = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "filesync_received_bytes_total",
+		Help: "Bytes of the messages received on streams, by method. Uploads are counted here.",
+	}, []string{"method"})
+	SENT_BYTES = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "filesync_sent_bytes_total",
+		Help: "Bytes of the messages sent on streams, by method. Downloads are counted here.",
+	}, []string{"method"})
+	HASH_MISMATCHES = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "filesync_hash_mismatches_total",
+		Help: "Files and chunks whose bytes did not match their hash, by method or scrub.",
+	}, []string{"source"})
+	DB_QUERY_DURATION = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "filesync_db_query_duration_seconds",
+		Help:    "Time taken by database statements, by first keyword.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"operation"})
+)
+
+func init() {
+	prometheus.MustRegister(RPC_REQUESTS, RPC_DURATION, ACTIVE_STREAMS, RECEIVED_BYTES, SENT_BYTES, HASH_MISMATCHES, DB_QUERY_DURATION)
+}
+
+// Serves the metrics at /metrics on addr until it fails
+func ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,129 @@
+// Token buckets limiting how fast requests are made or bytes are moved
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Refills rate tokens per second up to burst. Taking more tokens than there
+// are puts the bucket in debt, later takers wait until it is paid back, so a
+// single large take is allowed but the average rate is kept. A nil bucket
+// never limits.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time // Of the last refill
+}
+
+// A bucket of rate tokens per second, starting full with burst tokens.
+// burst defaults to one second worth of tokens.
+func NewBucket(rate float64, burst float64) *Bucket {
+	if burst <= 0 {
+		burst = max(rate, 1)
+	}
+	return &Bucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Changes the rate and burst, a rate of 0 or less removes the limit
+func (b *Bucket) SetRate(rate float64, burst float64) {
+	if burst <= 0 {
+		burst = max(rate, 1)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.rate, b.burst = rate, burst
+	b.tokens = min(b.tokens, burst)
+}
+
+// Must hold b.mu
+func (b *Bucket) refill(now time.Time) {
+	if b.rate > 0 {
+		b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.burst)
+	}
+	b.last = now
+}
+
+// Must hold b.mu
+func (b *Bucket) debt() time.Duration {
+	if b.tokens >= 0 || b.rate <= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Takes n tokens if the bucket has them, otherwise returns how long until it
+// will and takes nothing
+func (b *Bucket) Allow(n float64) (bool, time.Duration) {
+	if b == nil {
+		return true, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return true, 0
+	}
+	b.refill(time.Now())
+	if b.tokens >= n {
+		b.tokens -= n
+		return true, 0
+	}
+	return false, time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Takes n tokens and returns how long the taker has to wait for them
+func (b *Bucket) Reserve(n float64) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refill(time.Now())
+	b.tokens -= n
+	return b.debt()
+}
+
+// Gives back tokens taken by Reserve that were not used
+func (b *Bucket) Cancel(n float64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.tokens = min(b.tokens+n, b.burst)
+}
+
+// Takes n tokens and blocks until they are paid for or ctx is done
+func (b *Bucket) Wait(ctx context.Context, n float64) error {
+	return Sleep(ctx, b.Reserve(n))
+}
+
+// Time since the bucket was last used
+func (b *Bucket) Idle() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Since(b.last)
+}
+
+// Blocks for d or until ctx is done
+func Sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
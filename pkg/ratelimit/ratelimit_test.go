@@ -0,0 +1,128 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Durations measured by the tests may be off by this much
+const slack = 50 * time.Millisecond
+
+func near(got time.Duration, want time.Duration) bool {
+	return got >= want-slack && got <= want+slack
+}
+
+func TestReserve(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  float64
+		burst float64
+		takes []float64
+		want  []time.Duration // Wait returned by each take
+	}{
+		{"within burst", 100, 100, []float64{50, 50}, []time.Duration{0, 0}},
+		{"debt", 100, 100, []float64{100, 50, 50}, []time.Duration{0, 500 * time.Millisecond, time.Second}},
+		{"take larger than burst", 1000, 100, []float64{600}, []time.Duration{500 * time.Millisecond}},
+		{"default burst of one second", 200, 0, []float64{200, 100}, []time.Duration{0, 500 * time.Millisecond}},
+		{"no limit", 0, 0, []float64{1e9}, []time.Duration{0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bucket := NewBucket(test.rate, test.burst)
+			for i, n := range test.takes {
+				got := bucket.Reserve(n)
+				if !near(got, test.want[i]) {
+					t.Errorf("take %d of %v: wait %s, want %s", i, n, got, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAllow(t *testing.T) {
+	bucket := NewBucket(100, 10)
+	ok, _ := bucket.Allow(10)
+	if !ok {
+		t.Fatal("first take of the burst refused")
+	}
+	ok, wait := bucket.Allow(5)
+	if ok || !near(wait, 50*time.Millisecond) {
+		t.Fatalf("take from an empty bucket: ok %t wait %s, want refused for 50ms", ok, wait)
+	}
+	// A refused take takes nothing
+	time.Sleep(60 * time.Millisecond)
+	ok, _ = bucket.Allow(5)
+	if !ok {
+		t.Fatal("take refused once the bucket refilled")
+	}
+}
+
+func TestRefill(t *testing.T) {
+	bucket := NewBucket(1000, 100)
+	bucket.Reserve(100)
+	time.Sleep(100 * time.Millisecond)
+	// Refilled up to the burst, not the 100ms worth of tokens
+	if wait := bucket.Reserve(100); wait != 0 {
+		t.Errorf("wait %s after refilling, want 0", wait)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if wait := bucket.Reserve(200); !near(wait, 100*time.Millisecond) {
+		t.Errorf("wait %s with a burst of 100, want 100ms", wait)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	bucket := NewBucket(100, 100)
+	bucket.Reserve(100)
+	bucket.Reserve(100)
+	bucket.Cancel(100)
+	if wait := bucket.Reserve(0); wait != 0 {
+		t.Errorf("wait %s after canceling the debt, want 0", wait)
+	}
+}
+
+func TestSetRate(t *testing.T) {
+	bucket := NewBucket(100, 100)
+	bucket.Reserve(200)
+	bucket.SetRate(1000, 1000)
+	if wait := bucket.Reserve(0); !near(wait, 100*time.Millisecond) {
+		t.Errorf("debt takes %s to pay at the new rate, want 100ms", wait)
+	}
+	bucket.SetRate(0, 0)
+	if wait := bucket.Reserve(1e9); wait != 0 {
+		t.Errorf("wait %s without limit, want 0", wait)
+	}
+}
+
+func TestNilBucket(t *testing.T) {
+	var bucket *Bucket
+	if wait := bucket.Reserve(1e9); wait != 0 {
+		t.Errorf("nil bucket Reserve waits %s", wait)
+	}
+	if ok, _ := bucket.Allow(1e9); !ok {
+		t.Error("nil bucket refused a take")
+	}
+	bucket.Cancel(1)
+	if err := bucket.Wait(context.Background(), 1e9); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWait(t *testing.T) {
+	bucket := NewBucket(10, 10)
+	bucket.Reserve(10)
+	start := time.Now()
+	err := bucket.Wait(context.Background(), 1)
+	if err != nil || !near(time.Since(start), 100*time.Millisecond) {
+		t.Errorf("Wait returned %v after %s, want nil after 100ms", err, time.Since(start))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	err = bucket.Wait(ctx, 100)
+	if err != context.DeadlineExceeded || time.Since(start) > 20*time.Millisecond+slack {
+		t.Errorf("Wait returned %v after %s, want the deadline after 20ms", err, time.Since(start))
+	}
+}
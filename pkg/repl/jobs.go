@@ -0,0 +1,138 @@
+package repl
+
+import (
+	"context"
+	"fmt"
+	"grpc-pedrocarlo/pkg/client"
+	"os"
+	"strconv"
+	"time"
+)
+
+func ListJobs(ctx context.Context, c *client.FileClient, args []string) {
+	if c.Queue == nil {
+		fmt.Println("the transfer queue is disabled")
+		return
+	}
+	jobs := c.Queue.Jobs()
+	if len(jobs) == 0 {
+		fmt.Println("no transfers")
+		return
+	}
+	fmt.Printf("%4s  %-8s  %-8s  %8s  %s\n", "ID", "KIND", "STATE", "PROGRESS", "FILE")
+	for _, job := range jobs {
+		progress := ""
+		if job.State == client.JOB_RUNNING {
+			progress = formatBytes(job.Progress.Bytes)
+			if job.Progress.Total > 0 {
+				progress = fmt.Sprintf("%.0f%%", float64(job.Progress.Bytes)/float64(job.Progress.Total)*100)
+			}
+		}
+		target := job.Filename + " <- " + job.Folder
+		if job.Kind == client.JOB_UPLOAD {
+			target = job.Path + " -> " + job.Folder
+		}
+		if job.Error != "" {
+			target += ": " + job.Error
+		}
+		fmt.Printf("%4d  %-8s  %-8s  %8s  %s\n", job.Id, job.Kind, job.State, progress, target)
+	}
+}
+
+// Draws the progress of every pending transfer until they are all finished.
+// Ctrl-C stops waiting, the transfers keep running.
+func WaitJobs(ctx context.Context, c *client.FileClient, args []string) {
+	if c.Queue == nil {
+		fmt.Println("the transfer queue is disabled")
+		return
+	}
+	wait_ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	finished := make(chan error, 1)
+	go func() {
+		finished <- c.Queue.Wait(wait_ctx)
+	}()
+	bar := newProgressBar(os.Stdout)
+	ticker := time.NewTicker(client.PROGRESS_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-finished:
+			bar.end()
+			if err != nil {
+				fmt.Println("stopped waiting, transfers keep running in the background")
+				return
+			}
+			failed := 0
+			for _, job := range c.Queue.Jobs() {
+				if job.State == client.JOB_FAILED {
+					failed++
+				}
+			}
+			if failed > 0 {
+				fmt.Printf("%d transfers failed, see jobs\n", failed)
+			}
+			return
+		case <-ticker.C:
+			bar.draw(pendingProgress(c.Queue.Jobs()))
+		}
+	}
+}
+
+// Sum of the progress of the queued and running jobs
+func pendingProgress(jobs []client.Job) client.Progress {
+	total := client.Progress{}
+	for _, job := range jobs {
+		if job.State != client.JOB_QUEUED && job.State != client.JOB_RUNNING {
+			continue
+		}
+		total.Bytes += job.Progress.Bytes
+		total.Total += job.Progress.Total
+		total.Rate += job.Progress.Rate
+	}
+	if total.Rate > 0 && total.Total > total.Bytes {
+		total.ETA = time.Duration(float64(total.Total-total.Bytes) / total.Rate * float64(time.Second))
+	}
+	return total
+}
+
+func CancelJob(ctx context.Context, c *client.FileClient, args []string) {
+	id, ok := jobId(c, args, "cancel")
+	if !ok {
+		return
+	}
+	err := c.Queue.Cancel(id)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+}
+
+func RetryJob(ctx context.Context, c *client.FileClient, args []string) {
+	id, ok := jobId(c, args, "retry")
+	if !ok {
+		return
+	}
+	err := c.Queue.Retry(id)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+}
+
+func jobId(c *client.FileClient, args []string, command string) (int, bool) {
+	if c.Queue == nil {
+		fmt.Println("the transfer queue is disabled")
+		return 0, false
+	}
+	if len(args) < 1 {
+		fmt.Printf("usage: %s <job_id>\n", command)
+		return 0, false
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		fmt.Println(err)
+		return 0, false
+	}
+	return id, true
+}
@@ -0,0 +1,86 @@
+package repl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"grpc-pedrocarlo/pkg/client"
+	"io"
+	"strings"
+	"time"
+)
+
+const PROGRESS_BAR_WIDTH = 30
+
+// Draws the progress of a transfer on a single terminal line
+type progressBar struct {
+	w     io.Writer
+	drawn bool // A line was drawn and not ended yet
+}
+
+func newProgressBar(w io.Writer) *progressBar {
+	return &progressBar{w: w}
+}
+
+// Returns a context whose transfers are drawn by the bar
+func (b *progressBar) context(ctx context.Context) context.Context {
+	return client.WithProgress(ctx, b.draw)
+}
+
+func (b *progressBar) draw(p client.Progress) {
+	line := formatBytes(p.Bytes)
+	if p.Total > 0 {
+		ratio := min(float64(p.Bytes)/float64(p.Total), 1)
+		filled := int(ratio * PROGRESS_BAR_WIDTH)
+		bar := strings.Repeat("=", filled)
+		if filled < PROGRESS_BAR_WIDTH {
+			bar += ">" + strings.Repeat(" ", PROGRESS_BAR_WIDTH-filled-1)
+		}
+		line = fmt.Sprintf("[%s] %3.0f%% %s/%s", bar, ratio*100, line, formatBytes(p.Total))
+	}
+	if p.Rate > 0 {
+		line += fmt.Sprintf(" %s/s", formatBytes(int64(p.Rate)))
+	}
+	if p.ETA > 0 {
+		line += fmt.Sprintf(" ETA %s", p.ETA.Round(time.Second))
+	}
+	// Pads over the end of a longer previous line
+	fmt.Fprintf(b.w, "\r%-80s", line)
+	b.drawn = true
+	if p.Done {
+		b.end()
+	}
+}
+
+// Moves past the bar so following output starts on a new line
+func (b *progressBar) end() {
+	if b.drawn {
+		fmt.Fprintln(b.w)
+		b.drawn = false
+	}
+}
+
+// Prints the error of a transfer, which is only a cancellation once the
+// user pressed Ctrl-C
+func printTransferError(ctx context.Context, err error) {
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) {
+		fmt.Println("canceled")
+		return
+	}
+	fmt.Println(err)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, suffix := float64(n)/unit, "KiB"
+	for _, s := range []string{"MiB", "GiB", "TiB"} {
+		if value < unit {
+			break
+		}
+		value, suffix = value/unit, s
+	}
+	return fmt.Sprintf("%.1f %s", value, suffix)
+}
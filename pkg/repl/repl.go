@@ -1,12 +1,14 @@
 package repl
 
 import (
+	"context"
 	"fmt"
 	"grpc-pedrocarlo/pkg/client"
 	filesync "grpc-pedrocarlo/pkg/file"
 	"grpc-pedrocarlo/pkg/utils"
 	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
 
@@ -14,7 +16,7 @@ import (
 )
 
 type Command struct {
-	f    func(*client.FileClient, []string)
+	f    func(context.Context, *client.FileClient, []string)
 	name string
 	desc string
 }
@@ -33,7 +35,7 @@ func (commandMap *CommandMap) buildCompleter(c *client.FileClient) {
 	completer := readline.PrefixCompleter{}
 	children := make([]readline.PrefixCompleterInterface, 0)
 	listCwd := func(string) []string {
-		return listFiles(c, []string{"."})
+		return listFiles(context.Background(), c, []string{"."})
 	}
 	for name := range commandMap.commands {
 		children = append(children, readline.PcItem(name, readline.PcItemDynamic(listCwd)))
@@ -51,11 +53,26 @@ func initializeCommands() *CommandMap {
 		name: "upload",
 		desc: "Uploads a file from the hosts machine to the server",
 	}
+	commands["sync"] = Command{
+		f:    SyncFile,
+		name: "sync",
+		desc: "Uploads a file sending only the blocks that changed since the version on the server",
+	}
 	commands["download"] = Command{
 		f:    DownloadFile,
 		name: "download",
 		desc: "Downloads a file from a folder on the server to the client_files/downloads/ folder",
 	}
+	commands["get-archive"] = Command{
+		f:    DownloadArchive,
+		name: "get-archive",
+		desc: "Downloads a remote folder as a tar, tar.gz or zip archive to the client_files/downloads/ folder",
+	}
+	commands["put-archive"] = Command{
+		f:    UploadArchive,
+		name: "put-archive",
+		desc: "Uploads a local folder or a tar, tar.gz or zip archive and extracts it into a remote folder",
+	}
 	commands["ls"] = Command{
 		f:    ListFiles,
 		name: "ls",
@@ -76,6 +93,26 @@ func initializeCommands() *CommandMap {
 		name: "rmdir",
 		desc: "Remove empty dir from server",
 	}
+	commands["jobs"] = Command{
+		f:    ListJobs,
+		name: "jobs",
+		desc: "List the background uploads and downloads",
+	}
+	commands["wait"] = Command{
+		f:    WaitJobs,
+		name: "wait",
+		desc: "Wait for the background uploads and downloads to finish",
+	}
+	commands["cancel"] = Command{
+		f:    CancelJob,
+		name: "cancel",
+		desc: "Cancel a queued or running background transfer",
+	}
+	commands["retry"] = Command{
+		f:    RetryJob,
+		name: "retry",
+		desc: "Queue a failed or canceled background transfer again",
+	}
 	commands["cd"] = Command{
 		f:    ChangeDir,
 		name: "cd",
@@ -92,7 +129,7 @@ func initializeCommands() *CommandMap {
 func Repl(c *client.FileClient) {
 	commandMap := initializeCommands()
 	commandMap.buildCompleter(c)
-	ChangeDir(c, []string{"/"})
+	ChangeDir(context.Background(), c, []string{"/"})
 
 	l := ReplInitialize(commandMap)
 	defer l.Close()
@@ -108,7 +145,10 @@ func Repl(c *client.FileClient) {
 		} else {
 			command, ok := commandMap.commands[name]
 			if ok {
-				command.f(c, args[1:])
+				// Ctrl-C cancels the running command instead of the client
+				ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+				command.f(ctx, c, args[1:])
+				stop()
 			} else {
 				fmt.Printf("Command '%s' not found\n", args[0])
 			}
@@ -121,7 +161,7 @@ func Repl(c *client.FileClient) {
 func ReplInitialize(commandMap *CommandMap) *readline.Instance {
 	l, err := readline.NewEx(&readline.Config{
 		Prompt:            "> ",
-		HistoryFile:       "./client_files/tmp/history.tmp",
+		HistoryFile:       filepath.Join(client.TEMP_DIR, "history.tmp"),
 		InterruptPrompt:   "^C",
 		HistorySearchFold: true,
 		AutoComplete:      commandMap.completer,
@@ -148,26 +188,58 @@ func ReplGetLine(repl *readline.Instance) (string, bool) {
 	return line, false
 }
 
-func UploadFile(c *client.FileClient, args []string) {
+func UploadFile(ctx context.Context, c *client.FileClient, args []string) {
 	if len(args) < 2 {
 		fmt.Println("usage: upload <filepath> <remote_folder>")
 		return
 	}
 	filepath, folder := args[0], translateFolderClient(c, args[1])
 	fmt.Println("folder:", folder)
+	if c.Queue != nil {
+		job, err := c.Queue.Upload(filepath, folder)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Printf("queued job %d\n", job.Id)
+		return
+	}
 	file, err := os.Open(filepath)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
-	err = c.UploadFile(file, folder)
+	bar := newProgressBar(os.Stdout)
+	err = c.UploadFile(bar.context(ctx), file, folder)
+	bar.end()
+	if err != nil {
+		printTransferError(ctx, err)
+		return
+	}
+}
+
+func SyncFile(ctx context.Context, c *client.FileClient, args []string) {
+	if len(args) < 2 {
+		fmt.Println("usage: sync <filepath> <remote_folder>")
+		return
+	}
+	filepath, folder := args[0], translateFolderClient(c, args[1])
+	file, err := os.Open(filepath)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
+	defer file.Close()
+	bar := newProgressBar(os.Stdout)
+	err = c.SyncFile(bar.context(ctx), file, folder)
+	bar.end()
+	if err != nil {
+		printTransferError(ctx, err)
+		return
+	}
 }
 
-func DownloadFile(c *client.FileClient, args []string) {
+func DownloadFile(ctx context.Context, c *client.FileClient, args []string) {
 	if len(args) < 1 {
 		fmt.Println("usage: download <remote_filename> [<remote_dir>]")
 		return
@@ -181,7 +253,7 @@ func DownloadFile(c *client.FileClient, args []string) {
 	var file_meta *filesync.FileMetadata = nil
 	if folder != c.Curr_dir {
 		// Get File List for dir
-		files, err := c.GetFileList(folder)
+		files, err := c.GetFileList(ctx, folder)
 		if err != nil {
 			fmt.Println(err)
 			return
@@ -205,11 +277,81 @@ func DownloadFile(c *client.FileClient, args []string) {
 		}
 		file_meta = placeholder_meta
 	}
-	err := c.DownloadFile(file_meta)
+	if c.Queue != nil {
+		job, err := c.Queue.Download(file_meta.Folder, file_meta.Filename)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Printf("queued job %d\n", job.Id)
+		return
+	}
+	bar := newProgressBar(os.Stdout)
+	err := c.DownloadFile(bar.context(ctx), file_meta)
+	bar.end()
+	if err != nil {
+		printTransferError(ctx, err)
+		return
+	}
+}
+
+func DownloadArchive(ctx context.Context, c *client.FileClient, args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Println("usage: get-archive <remote_folder> [tar|tar.gz|zip]")
+		return
+	}
+	format := "tar.gz"
+	if len(args) == 2 {
+		format = args[1]
+	}
+	folder := translateFolderClient(c, args[0])
+	bar := newProgressBar(os.Stdout)
+	path, err := c.DownloadArchive(bar.context(ctx), folder, format)
+	bar.end()
+	if err != nil {
+		printTransferError(ctx, err)
+		return
+	}
+	fmt.Println("saved to", path)
+}
+
+func UploadArchive(ctx context.Context, c *client.FileClient, args []string) {
+	if len(args) < 2 {
+		fmt.Println("usage: put-archive <local_folder|archive_path> <remote_folder>")
+		return
+	}
+	path, folder := args[0], translateFolderClient(c, args[1])
+	info, err := os.Stat(path)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
+	bar := newProgressBar(os.Stdout)
+	var res *filesync.ArchiveUploadResponse
+	if info.IsDir() {
+		res, err = c.UploadDirectory(bar.context(ctx), path, folder)
+	} else {
+		var format string
+		format, err = client.ArchiveFormat(path)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		var file *os.File
+		file, err = os.Open(path)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer file.Close()
+		res, err = c.UploadArchive(bar.context(ctx), file, info.Size(), format, folder)
+	}
+	bar.end()
+	if err != nil {
+		printTransferError(ctx, err)
+		return
+	}
+	fmt.Printf("extracted %d files (%d bytes) and created %d folders in %s\n", res.Files, res.Bytes, res.Folders, folder)
 }
 
 func translateFolderClient(c *client.FileClient, folder string) string {
@@ -238,14 +380,14 @@ func translateFolderClient(c *client.FileClient, folder string) string {
 	return folder
 }
 
-func listFiles(c *client.FileClient, args []string) []string {
+func listFiles(ctx context.Context, c *client.FileClient, args []string) []string {
 	out := make([]string, 0)
 	if len(args) < 1 {
 		fmt.Println("usage: ls <remote_folder>")
 		return out
 	}
 	folder := translateFolderClient(c, args[0])
-	files, err := c.GetFileList(folder)
+	files, err := c.GetFileList(ctx, folder)
 	if err != nil {
 		fmt.Println(err)
 		return out
@@ -260,8 +402,8 @@ func listFiles(c *client.FileClient, args []string) []string {
 	return out
 }
 
-func ListFiles(c *client.FileClient, args []string) {
-	out := listFiles(c, args)
+func ListFiles(ctx context.Context, c *client.FileClient, args []string) {
+	out := listFiles(ctx, c, args)
 	out_str := ""
 	for _, name := range out {
 		out_str += fmt.Sprintf("%10s", name)
@@ -269,40 +411,40 @@ func ListFiles(c *client.FileClient, args []string) {
 	fmt.Printf("%s\n", out_str)
 }
 
-func Mkdir(c *client.FileClient, args []string) {
+func Mkdir(ctx context.Context, c *client.FileClient, args []string) {
 	if len(args) < 1 {
 		fmt.Println("usage: mdkir <remote_folder>")
 		return
 	}
 	folder := translateFolderClient(c, args[0])
 	utils.Log_trace(folder)
-	_, err := c.Mkdir(folder)
+	_, err := c.Mkdir(ctx, folder)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 }
 
-func RemoveFile(c *client.FileClient, args []string) {
+func RemoveFile(ctx context.Context, c *client.FileClient, args []string) {
 	if len(args) < 2 {
 		fmt.Println("usage: rm <remote_filename> <remote_folder>")
 		return
 	}
 	filename, folder := args[0], translateFolderClient(c, args[1])
-	err := c.RemoveFile(folder, filename)
+	err := c.RemoveFile(ctx, folder, filename)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 }
 
-func RemoveDir(c *client.FileClient, args []string) {
+func RemoveDir(ctx context.Context, c *client.FileClient, args []string) {
 	if len(args) < 1 {
 		fmt.Println("usage: rmdir <remote_folder>")
 		return
 	}
 	folder := translateFolderClient(c, args[0])
-	err := c.RemoveDir(folder)
+	err := c.RemoveDir(ctx, folder)
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -310,14 +452,14 @@ func RemoveDir(c *client.FileClient, args []string) {
 }
 
 // Tab autocomplete only completes for current folder at the moment
-func ChangeDir(c *client.FileClient, args []string) {
+func ChangeDir(ctx context.Context, c *client.FileClient, args []string) {
 	if len(args) < 1 {
 		fmt.Println("usage: cd <remote_folder>")
 		return
 	}
 	folder := translateFolderClient(c, args[0])
 	// Query its parent folder, to see if it either errors or if it is inside
-	out, err := c.GetFileList(filepath.Dir(folder))
+	out, err := c.GetFileList(ctx, filepath.Dir(folder))
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -329,7 +471,7 @@ func ChangeDir(c *client.FileClient, args []string) {
 	for _, file := range out {
 		if file.IsDir && filepath.Join(file.Folder, file.Filename) == folder {
 			// Attempt at Update cache
-			files, err := c.GetFileList(folder)
+			files, err := c.GetFileList(ctx, folder)
 			if err != nil {
 				fmt.Println(err)
 				return
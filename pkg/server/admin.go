@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"grpc-pedrocarlo/pkg/db"
+	filesync "grpc-pedrocarlo/pkg/file"
+	"grpc-pedrocarlo/pkg/utils"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// AdminServer implements the maintenance operations of filesync.AdminServer.
+// It is served apart from FileSync, on a listener only operators can reach.
+type AdminServer struct {
+	filesync.UnimplementedAdminServer
+	Db_conn  *db.Store
+	Scrubber *Scrubber // nil when scrubbing is disabled
+	// Reads the configuration again and returns the settings that changed and
+	// were applied and those that need a restart, nil when there is none
+	Reloader func() (applied []string, restart_required []string, err error)
+	Drainer  *Drainer // nil when the server can not be drained
+}
+
+// Fsck implements filesync.AdminServer.
+func (s *AdminServer) Fsck(ctx context.Context, request *filesync.FsckRequest) (*filesync.FsckResponse, error) {
+	utils.Log_trace("Received Fsck request")
+	if request == nil {
+		return nil, errors.New("request is nil")
+	}
+	report, err := Fsck(s.Db_conn, request.Repair)
+	if err != nil {
+		return nil, err
+	}
+	return FsckReportToFilesyncFsckResponse(report), nil
+}
+
+// ScrubStatus implements filesync.AdminServer.
+func (s *AdminServer) ScrubStatus(ctx context.Context, request *filesync.ScrubStatusRequest) (*filesync.ScrubStatusResponse, error) {
+	utils.Log_trace("Received Scrub Status request")
+	quarantined, err := db.QueryQuarantinedFiles(s.Db_conn)
+	if err != nil {
+		return nil, err
+	}
+	return ScrubStatsToFilesyncScrubStatusResponse(s.Scrubber, quarantined), nil
+}
+
+// Reload implements filesync.AdminServer.
+func (s *AdminServer) Reload(ctx context.Context, request *filesync.ReloadRequest) (*filesync.ReloadResponse, error) {
+	utils.Log_trace("Received Reload request")
+	if s.Reloader == nil {
+		return nil, status.Error(codes.Unimplemented, "the server has no configuration to reload")
+	}
+	applied, restart_required, err := s.Reloader()
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &filesync.ReloadResponse{Applied: applied, RestartRequired: restart_required}, nil
+}
+
+// Drain implements filesync.AdminServer.
+func (s *AdminServer) Drain(ctx context.Context, request *filesync.DrainRequest) (*filesync.DrainResponse, error) {
+	utils.Log_trace("Received Drain request")
+	if s.Drainer == nil {
+		return nil, status.Error(codes.Unimplemented, "the server can not be drained")
+	}
+	active := s.Drainer.Active()
+	s.Drainer.Drain()
+	return &filesync.DrainResponse{Active: active}, nil
+}
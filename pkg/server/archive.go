@@ -0,0 +1,207 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"grpc-pedrocarlo/pkg/db"
+	filesync "grpc-pedrocarlo/pkg/file"
+	"grpc-pedrocarlo/pkg/storage"
+	"grpc-pedrocarlo/pkg/utils"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Formats accepted by DownloadArchive
+const (
+	ARCHIVE_TAR    = "tar"
+	ARCHIVE_TAR_GZ = "tar.gz"
+	ARCHIVE_ZIP    = "zip"
+)
+
+var errUnknownArchiveFormat = errors.New("unknown archive format, expected tar, tar.gz or zip")
+
+// Buffers writes and sends them as FileResponse chunks
+type chunkWriter struct {
+	stream filesync.FileSync_DownloadArchiveServer
+	buf    []byte
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), MESSAGE_SIZE-len(w.buf))
+		w.buf = append(w.buf, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(w.buf) == MESSAGE_SIZE {
+			err := w.flush(false)
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *chunkWriter) flush(done bool) error {
+	err := w.stream.Send(&filesync.FileResponse{Chunk: w.buf, Done: done})
+	w.buf = make([]byte, 0, MESSAGE_SIZE)
+	return err
+}
+
+// Entry of an archive, either a folder or a file
+type archiveEntry struct {
+	name     string // Slash separated path inside the archive, folders end in /
+	meta     *db.FileMetadata
+	modified time.Time
+}
+
+// archiveWriter hides the differences between tar and zip
+type archiveWriter interface {
+	// Adds entry, for files the content is read from r
+	add(entry *archiveEntry, size int64, r io.Reader) error
+	Close() error
+}
+
+type tarArchiveWriter struct {
+	tw *tar.Writer
+	gz *gzip.Writer // nil for uncompressed tars
+}
+
+func (a *tarArchiveWriter) add(entry *archiveEntry, size int64, r io.Reader) error {
+	header := &tar.Header{Name: entry.name, ModTime: entry.modified, Mode: 0644, Typeflag: tar.TypeReg, Size: size}
+	if entry.meta.Is_dir == 1 {
+		header.Mode = 0755
+		header.Typeflag = tar.TypeDir
+	}
+	err := a.tw.WriteHeader(header)
+	if err != nil || r == nil {
+		return err
+	}
+	_, err = io.Copy(a.tw, r)
+	return err
+}
+
+func (a *tarArchiveWriter) Close() error {
+	err := a.tw.Close()
+	if err != nil || a.gz == nil {
+		return err
+	}
+	return a.gz.Close()
+}
+
+type zipArchiveWriter struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchiveWriter) add(entry *archiveEntry, size int64, r io.Reader) error {
+	header := &zip.FileHeader{Name: entry.name, Modified: entry.modified, Method: zip.Deflate}
+	if entry.meta.Is_dir == 1 {
+		header.Method = zip.Store
+	}
+	w, err := a.zw.CreateHeader(header)
+	if err != nil || r == nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func (a *zipArchiveWriter) Close() error {
+	return a.zw.Close()
+}
+
+func newArchiveWriter(format string, w io.Writer) (archiveWriter, error) {
+	switch format {
+	case ARCHIVE_TAR:
+		return &tarArchiveWriter{tw: tar.NewWriter(w)}, nil
+	case ARCHIVE_TAR_GZ:
+		gz := gzip.NewWriter(w)
+		return &tarArchiveWriter{tw: tar.NewWriter(gz), gz: gz}, nil
+	case ARCHIVE_ZIP:
+		return &zipArchiveWriter{zw: zip.NewWriter(w)}, nil
+	}
+	return nil, fmt.Errorf("%w: %q", errUnknownArchiveFormat, format)
+}
+
+// DownloadArchive implements filesync.FileSyncServer.
+// The archive is written straight to the stream while it is built, files are
+// read from storage one at a time and nothing is staged in TEMP_DIR.
+func (s *FileSyncServer) DownloadArchive(request *filesync.ArchiveRequest, stream filesync.FileSync_DownloadArchiveServer) error {
+	utils.Log_trace("Received Download Archive request")
+	if request == nil {
+		return errors.New("request is nil")
+	}
+	folder := filepath.Clean(translateFolder(request.Folder))
+	_, err := db.QueryFolderByPath(s.store(stream.Context()), folder)
+	if err != nil {
+		return err
+	}
+	rows, err := db.QueryFolderTree(s.store(stream.Context()), folder)
+	if err != nil {
+		return err
+	}
+	out := &chunkWriter{stream: stream, buf: make([]byte, 0, MESSAGE_SIZE)}
+	archive, err := newArchiveWriter(request.Format, out)
+	if err != nil {
+		return err
+	}
+
+	// Entries are prefixed by the name of the folder so they extract into it
+	prefix := filepath.Base(folder)
+	if folder == db.ROOT_FOLDER {
+		prefix = "files"
+	}
+	err = archive.add(&archiveEntry{name: prefix + "/", meta: &db.FileMetadata{Is_dir: 1}, modified: time.Now()}, 0, nil)
+	if err != nil {
+		return err
+	}
+	for i := range rows {
+		row := &rows[i]
+		if row.Quarantined == 1 {
+			continue
+		}
+		rel, err := filepath.Rel(folder, metadataPath(row))
+		if err != nil {
+			return err
+		}
+		// Entries never leave the folder archived
+		if rel == ".." || strings.HasPrefix(rel, "../") {
+			return fmt.Errorf("%w: %q", errArchiveBadEntryName, metadataPath(row))
+		}
+		entry := &archiveEntry{name: prefix + "/" + filepath.ToSlash(rel), meta: row, modified: time.Unix(int64(row.Timestamp), 0)}
+		if row.Is_dir == 1 {
+			entry.name += "/"
+			err = archive.add(entry, 0, nil)
+		} else {
+			err = addArchiveFile(s.store(stream.Context()), archive, entry)
+		}
+		if err != nil {
+			return fmt.Errorf("adding %s: %w", metadataPath(row), err)
+		}
+	}
+	err = archive.Close()
+	if err != nil {
+		return err
+	}
+	utils.Log_trace(fmt.Sprintf("Finished archive of %s with %d entries", folder, len(rows)))
+	return out.flush(true)
+}
+
+func addArchiveFile(conn *db.Store, archive archiveWriter, entry *archiveEntry) error {
+	size, err := storage.Size(entry.meta)
+	if err != nil {
+		return err
+	}
+	file, err := storage.Open(conn, entry.meta)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return archive.add(entry, size, file)
+}
@@ -0,0 +1,392 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"grpc-pedrocarlo/pkg/cdc"
+	"grpc-pedrocarlo/pkg/db"
+	filesync "grpc-pedrocarlo/pkg/file"
+	"grpc-pedrocarlo/pkg/storage"
+	"grpc-pedrocarlo/pkg/tracing"
+	"grpc-pedrocarlo/pkg/utils"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Most chunks listed in one ChunkList or FileManifest message
+const MAX_CHUNKS_PER_MESSAGE = 10000
+
+var (
+	errFileTooLarge      = errors.New("file is larger than the uploads allowed")
+	errBadChunkHash      = errors.New("chunk hash is not a hex SHA-256")
+	errChunkTooLarge     = errors.New("chunk is larger than the maximum chunk size")
+	errChunkHashMismatch = errors.New("chunk does not match its hash")
+	errChunkMissing      = errors.New("chunk is not stored")
+	errTooManyChunks     = errors.New("too many chunks in one message")
+	errBadFilename       = errors.New("filename must be a single path element")
+)
+
+func checkChunkHash(hash string) error {
+	if len(hash) != 2*sha256.Size || strings.Trim(hash, "0123456789abcdef") != "" {
+		return fmt.Errorf("%w: %q", errBadChunkHash, hash)
+	}
+	return nil
+}
+
+func checkFilename(filename string) error {
+	if filename == "" || strings.ContainsAny(filename, "/\x00") || filename == "." || filename == ".." {
+		return fmt.Errorf("%w: %q", errBadFilename, filename)
+	}
+	return nil
+}
+
+// FindMissingChunks implements filesync.FileSyncServer.
+// Returns the hashes of the request that are not stored.
+func (s *FileSyncServer) FindMissingChunks(ctx context.Context, request *filesync.ChunkList) (*filesync.ChunkList, error) {
+	if len(request.Hashes) > MAX_CHUNKS_PER_MESSAGE {
+		return nil, errTooManyChunks
+	}
+	existing, err := db.QueryExistingChunks(s.store(ctx), request.Hashes)
+	if err != nil {
+		return nil, err
+	}
+	missing := []string{}
+	for _, hash := range request.Hashes {
+		if !existing[hash] {
+			missing = append(missing, hash)
+		}
+	}
+	return &filesync.ChunkList{Hashes: missing}, nil
+}
+
+// UploadChunks implements filesync.FileSyncServer.
+// Every chunk is checked against its hash before it is stored.
+func (s *FileSyncServer) UploadChunks(stream filesync.FileSync_UploadChunksServer) error {
+	utils.Log_trace("Received Upload Chunks request")
+	response := &filesync.UploadChunksResponse{}
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			utils.Log_trace(fmt.Sprintf("Stored %d new chunks, %d bytes", response.Stored, response.Bytes))
+			return stream.SendAndClose(response)
+		}
+		if err != nil {
+			return err
+		}
+		err = s.Limits.Throttle(stream.Context(), len(chunk.Data))
+		if err != nil {
+			return err
+		}
+		stored, err := storeChunk(s.store(stream.Context()), chunk)
+		if err != nil {
+			return err
+		}
+		if stored {
+			response.Stored++
+			response.Bytes += int64(len(chunk.Data))
+		}
+	}
+}
+
+func storeChunk(conn *db.Store, chunk *filesync.ChunkData) (bool, error) {
+	ctx, span := tracing.StartChild(conn.Context(), "store chunk",
+		attribute.String("filesync.chunk", chunk.Hash),
+		attribute.Int("filesync.bytes", len(chunk.Data)))
+	stored, err := writeChunk(conn.WithContext(ctx), chunk)
+	span.SetAttributes(attribute.Bool("filesync.stored", stored))
+	tracing.End(span, err)
+	return stored, err
+}
+
+func writeChunk(conn *db.Store, chunk *filesync.ChunkData) (bool, error) {
+	err := checkChunkHash(chunk.Hash)
+	if err != nil {
+		return false, err
+	}
+	if len(chunk.Data) > cdc.MAX_SIZE {
+		return false, fmt.Errorf("%w: %d bytes", errChunkTooLarge, len(chunk.Data))
+	}
+	sum := sha256.Sum256(chunk.Data)
+	if hex.EncodeToString(sum[:]) != chunk.Hash {
+		return false, fmt.Errorf("%w: %s", errChunkHashMismatch, chunk.Hash)
+	}
+	existing, err := db.QueryExistingChunks(conn, []string{chunk.Hash})
+	if err != nil || existing[chunk.Hash] {
+		return false, err
+	}
+	temp_file, err := os.CreateTemp(db.TEMP_DIR, utils.TEMP_PATTERN)
+	if err != nil {
+		return false, err
+	}
+	defer temp_file.Close()
+	defer os.Remove(temp_file.Name())
+	_, err = temp_file.Write(chunk.Data)
+	if err != nil {
+		return false, err
+	}
+	err = temp_file.Close()
+	if err != nil {
+		return false, err
+	}
+	return storage.StoreChunk(conn, temp_file.Name(), chunk.Hash)
+}
+
+// CommitManifest implements filesync.FileSyncServer.
+// Records a file made of chunks already stored, replacing any file with the
+// same name. The chunks are read back to check the hash of the whole file.
+func (s *FileSyncServer) CommitManifest(stream filesync.FileSync_CommitManifestServer) error {
+	utils.Log_trace("Received Commit Manifest request")
+	manifest, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	// Every chunk but the last is at least cdc.MIN_SIZE bytes
+	max_size := s.maxFileSize()
+	max_chunks := max_size/cdc.MIN_SIZE + 1
+	chunks := []*filesync.ChunkRef{}
+	size := int64(0)
+	for next := manifest; ; {
+		if int64(len(chunks)+len(next.Chunks)) > max_chunks {
+			return fmt.Errorf("%w: more than %d chunks", errTooManyChunks, max_chunks)
+		}
+		for _, ref := range next.Chunks {
+			size += max(ref.Size, 0)
+		}
+		if size > max_size {
+			return fmt.Errorf("%w: more than %d bytes", errFileTooLarge, max_size)
+		}
+		chunks = append(chunks, next.Chunks...)
+		next, err = stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	folder := translateFolder(manifest.Folder)
+	err = checkFilename(manifest.Filename)
+	if err != nil {
+		return err
+	}
+	_, err = db.QueryFolderByPath(s.store(stream.Context()), folder)
+	if err != nil {
+		return err
+	}
+
+	ctx, span := tracing.StartChild(stream.Context(), "hash chunks", attribute.Int("filesync.chunks", len(chunks)))
+	hashes, size, filehash, err := hashManifest(ctx, s.store(ctx), chunks)
+	tracing.End(span, err)
+	if err != nil {
+		return chunkMissingStatus(err)
+	}
+	// The sizes of the references are only what the client said
+	if size > max_size {
+		return fmt.Errorf("%w: more than %d bytes", errFileTooLarge, max_size)
+	}
+	if filehash != manifest.Filehash {
+		return errHashDifferent
+	}
+
+	file_meta := &db.FileMetadata{
+		Folder:    folder,
+		Filename:  manifest.Filename,
+		Filehash:  manifest.Filehash,
+		Timestamp: int(time.Now().Unix()),
+		Chunked:   1,
+	}
+	file_meta.FileSize = size
+	err = commitManifest(s.store(stream.Context()), file_meta, hashes)
+	if err != nil {
+		return chunkMissingStatus(err)
+	}
+	utils.Log_trace(fmt.Sprintf("Committed %s made of %d chunks, %d bytes", metadataPath(file_meta), len(hashes), size))
+	return stream.SendAndClose(DbFileMetadataToFilesyncFileMetadata(file_meta))
+}
+
+// Chunks reported stored may have been removed by the janitor since, the
+// client tells it apart by the FailedPrecondition code, sends them and retries
+func chunkMissingStatus(err error) error {
+	if errors.Is(err, errChunkMissing) {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return err
+}
+
+// Reads back the chunks of a manifest, returns their hashes, the size and
+// the hash of the whole file
+func hashManifest(ctx context.Context, conn *db.Store, chunks []*filesync.ChunkRef) ([]string, int64, string, error) {
+	hashes := make([]string, len(chunks))
+	size := int64(0)
+	hasher := sha256.New()
+	for i, ref := range chunks {
+		// Reading back a large file takes a while, stop once the client gave up
+		if err := ctx.Err(); err != nil {
+			return nil, 0, "", err
+		}
+		chunk, err := db.QueryChunk(conn, ref.Hash)
+		if err != nil {
+			return nil, 0, "", fmt.Errorf("%w: %s", errChunkMissing, ref.Hash)
+		}
+		n, err := copyChunk(hasher, chunk)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		hashes[i] = ref.Hash
+		size += n
+	}
+	return hashes, size, hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// Hashes the original bytes of a stored chunk, checking them on the way
+func copyChunk(w io.Writer, chunk *db.ChunkMetadata) (int64, error) {
+	file, err := storage.OpenChunk(chunk)
+	if os.IsNotExist(err) {
+		// Being removed by the janitor
+		return 0, fmt.Errorf("%w: %s", errChunkMissing, chunk.Hash)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, hasher), file)
+	if err != nil {
+		return n, err
+	}
+	if hex.EncodeToString(hasher.Sum(nil)) != chunk.Hash {
+		return n, fmt.Errorf("%w: chunk %s does not match its hash", storage.ErrCorrupted, chunk.Hash)
+	}
+	return n, nil
+}
+
+func commitManifest(conn *db.Store, file_meta *db.FileMetadata, hashes []string) error {
+	tx, err := conn.Beginx()
+	if err != nil {
+		return err
+	}
+	err = db.InsertFile(tx, file_meta)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	file_meta.Id, err = db.QueryFileId(tx, file_meta.Folder, file_meta.Filename)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = db.InsertFileChunks(tx, file_meta.Id, hashes)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	// The janitor may have removed an unused chunk since it was checked
+	missing, err := db.CountMissingFileChunks(tx, file_meta.Id)
+	if err == nil && missing > 0 {
+		err = fmt.Errorf("%w: %d chunks were removed meanwhile", errChunkMissing, missing)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	// The file replaced may have been stored in one piece. Its blob is only
+	// removed once nothing points at it, fsck finds it if this fails.
+	err = os.Remove(db.GetFilePath(file_meta))
+	if err != nil && !os.IsNotExist(err) {
+		utils.Log_trace(fmt.Sprintf("Failed to remove the replaced blob of %s: %v", metadataPath(file_meta), err))
+	}
+	return nil
+}
+
+// GetManifest implements filesync.FileSyncServer.
+// Files stored in one piece get a single message with chunked unset.
+func (s *FileSyncServer) GetManifest(request *filesync.FileMetadata, stream filesync.FileSync_GetManifestServer) error {
+	utils.Log_trace("Received Get Manifest request")
+	file_meta, err := db.QueryFileMetadata(s.store(stream.Context()), translateFolder(request.Folder), request.Filename)
+	if err != nil {
+		return err
+	}
+	if file_meta.Quarantined == 1 {
+		return errQuarantined
+	}
+	size, err := storage.Size(file_meta)
+	if err != nil {
+		return err
+	}
+	manifest := &filesync.FileManifest{
+		Folder:   file_meta.Folder,
+		Filename: file_meta.Filename,
+		Filehash: file_meta.Filehash,
+		Chunked:  file_meta.Chunked == 1,
+		Size:     size,
+	}
+	if file_meta.Chunked == 0 {
+		return stream.Send(manifest)
+	}
+	chunks, err := db.QueryFileChunks(s.store(stream.Context()), file_meta.Id)
+	if err != nil {
+		return err
+	}
+	for start := 0; start == 0 || start < len(chunks); start += MAX_CHUNKS_PER_MESSAGE {
+		for _, chunk := range chunks[start:min(start+MAX_CHUNKS_PER_MESSAGE, len(chunks))] {
+			manifest.Chunks = append(manifest.Chunks, &filesync.ChunkRef{Hash: chunk.Hash, Size: chunk.FileSize})
+		}
+		err = stream.Send(manifest)
+		if err != nil {
+			return err
+		}
+		manifest = &filesync.FileManifest{Chunked: true}
+	}
+	return nil
+}
+
+// DownloadChunks implements filesync.FileSyncServer.
+// Chunks are sent in the order of the request.
+func (s *FileSyncServer) DownloadChunks(request *filesync.ChunkList, stream filesync.FileSync_DownloadChunksServer) error {
+	utils.Log_trace("Received Download Chunks request")
+	if len(request.Hashes) > MAX_CHUNKS_PER_MESSAGE {
+		return errTooManyChunks
+	}
+	for _, hash := range request.Hashes {
+		chunk, err := db.QueryChunk(s.store(stream.Context()), hash)
+		if err != nil {
+			return fmt.Errorf("%w: %s", errChunkMissing, hash)
+		}
+		data := &chunkBuffer{}
+		_, err = copyChunk(data, chunk)
+		if err != nil {
+			return err
+		}
+		err = s.Limits.Throttle(stream.Context(), len(data.buf))
+		if err != nil {
+			return err
+		}
+		err = stream.Send(&filesync.ChunkData{Hash: hash, Data: data.buf})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type chunkBuffer struct {
+	buf []byte
+}
+
+func (b *chunkBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	return len(p), nil
+}
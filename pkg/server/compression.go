@@ -0,0 +1,56 @@
+package server
+
+import (
+	"context"
+	"grpc-pedrocarlo/pkg/zstd"
+	"strings"
+
+	"google.golang.org/grpc"
+	_ "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+)
+
+// Header listing the compressors the server accepts, clients read it to
+// pick the compressor of the messages they send
+const COMPRESSORS_HEADER = "filesync-compressors"
+
+// Compressors of the messages sent by the server, in order of preference.
+// The first one the client also supports is used, empty disables compression.
+var WIRE_COMPRESSION = []string{zstd.NAME, "gzip"}
+
+func negotiateCompression(ctx context.Context) error {
+	err := grpc.SetHeader(ctx, metadata.Pairs(COMPRESSORS_HEADER, strings.Join(WIRE_COMPRESSION, ",")))
+	if err != nil {
+		return err
+	}
+	supported, err := grpc.ClientSupportedCompressors(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range WIRE_COMPRESSION {
+		for _, client_name := range supported {
+			if name == client_name {
+				return grpc.SetSendCompressor(ctx, name)
+			}
+		}
+	}
+	return nil
+}
+
+// Interceptors compressing the responses with the preferred compressor the
+// client supports
+func UnaryCompressionInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	err := negotiateCompression(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func StreamCompressionInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	err := negotiateCompression(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"grpc-pedrocarlo/pkg/db"
+	"grpc-pedrocarlo/pkg/delta"
+	filesync "grpc-pedrocarlo/pkg/file"
+	"grpc-pedrocarlo/pkg/storage"
+	"grpc-pedrocarlo/pkg/utils"
+	"io"
+	"os"
+	"strings"
+)
+
+// Most block signatures sent in one FileSignature message
+const MAX_BLOCKS_PER_MESSAGE = 10000
+
+var errBaseChanged = errors.New("stored file changed since its signature was sent")
+
+// GetSignature implements filesync.FileSyncServer.
+func (s *FileSyncServer) GetSignature(request *filesync.SignatureRequest, stream filesync.FileSync_GetSignatureServer) error {
+	utils.Log_trace("Received Get Signature request")
+	file_meta, err := db.QueryFileMetadata(s.store(stream.Context()), translateFolder(request.Folder), request.Filename)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Nothing to reuse, the delta will only hold literal data
+		return stream.Send(&filesync.FileSignature{BlockSize: int32(delta.BlockSize(0))})
+	}
+	if err != nil {
+		return err
+	}
+	if file_meta.Quarantined == 1 {
+		return errQuarantined
+	}
+	size, err := storage.Size(file_meta)
+	if err != nil {
+		return err
+	}
+	file, err := storage.Open(s.store(stream.Context()), file_meta)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	sig, err := delta.Sign(file, delta.BlockSize(size))
+	if err != nil {
+		return err
+	}
+	if sig.Size != size {
+		return fmt.Errorf("%w: %s is %d bytes instead of %d", storage.ErrCorrupted, metadataPath(file_meta), sig.Size, size)
+	}
+	message := &filesync.FileSignature{
+		Filehash:  file_meta.Filehash,
+		BlockSize: int32(sig.BlockSize),
+		Size:      sig.Size,
+	}
+	for start := 0; start == 0 || start < len(sig.Blocks); start += MAX_BLOCKS_PER_MESSAGE {
+		for _, block := range sig.Blocks[start:min(start+MAX_BLOCKS_PER_MESSAGE, len(sig.Blocks))] {
+			message.Blocks = append(message.Blocks, &filesync.BlockSignature{Weak: block.Weak, Strong: block.Strong})
+		}
+		err = stream.Send(message)
+		if err != nil {
+			return err
+		}
+		message = &filesync.FileSignature{}
+	}
+	return nil
+}
+
+// UploadDelta implements filesync.FileSyncServer.
+// Rebuilds the new version of a file from the stored one and the delta,
+// then stores it like an uploaded file.
+func (s *FileSyncServer) UploadDelta(stream filesync.FileSync_UploadDeltaServer) error {
+	utils.Log_trace("Received Upload Delta request")
+	message, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	folder := translateFolder(message.Folder)
+	filename := message.Filename
+	err = checkFilename(filename)
+	if err != nil {
+		return err
+	}
+	_, err = db.QueryFolderByPath(s.store(stream.Context()), folder)
+	if err != nil {
+		return err
+	}
+
+	base, base_size, err := s.openBase(stream.Context(), folder, filename, message.BaseHash)
+	if err != nil {
+		return err
+	}
+	if base != nil {
+		defer base.Close()
+		defer os.Remove(base.Name())
+	}
+
+	file, err := os.CreateTemp(db.TEMP_DIR, utils.TEMP_PATTERN)
+	if err != nil {
+		return err
+	}
+	path := file.Name()
+	utils.Log_trace(fmt.Sprintf("Created temp file: %s", path))
+	defer file.Close()
+	defer os.Remove(path)
+	hasher := sha256.New()
+	var base_reader io.ReaderAt = base
+	if base == nil {
+		base_reader = strings.NewReader("")
+	}
+	patcher := delta.NewPatcher(io.MultiWriter(file, hasher), base_reader, delta.BlockSize(base_size), base_size)
+	// Blocks of the base are copied without being sent, the rebuilt file is
+	// bounded rather than the bytes received
+	patcher.MaxSize = s.maxFileSize()
+	literal, copied := int64(0), int64(0)
+	for {
+		for _, op := range message.Ops {
+			err = patcher.Apply(delta.Op{Data: op.Data, Block: op.Block, Blocks: op.Blocks})
+			if err != nil {
+				return err
+			}
+			literal += int64(len(op.Data))
+			copied += op.Blocks
+		}
+		filehash := message.Filehash
+		message, err = stream.Recv()
+		if err == io.EOF {
+			if filehash != hex.EncodeToString(hasher.Sum(nil)) {
+				return errHashDifferent
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	err = commitFile(s.store(stream.Context()), path, folder, filename, hash)
+	if err != nil {
+		return err
+	}
+	utils.Log_trace(fmt.Sprintf("Rebuilt %s from %d literal bytes and %d blocks", filename, literal, copied))
+	return stream.SendAndClose(&filesync.FileMetadata{Folder: folder, Filename: filename, Filehash: hash})
+}
+
+// Copies the stored file the delta is against into a temp file, the delta
+// may refer to its blocks in any order. Returns a nil file when base_hash
+// is empty.
+func (s *FileSyncServer) openBase(ctx context.Context, folder string, filename string, base_hash string) (*os.File, int64, error) {
+	if base_hash == "" {
+		return nil, 0, nil
+	}
+	file_meta, err := db.QueryFileMetadata(s.store(ctx), folder, filename)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && file_meta.Filehash != base_hash) {
+		return nil, 0, errBaseChanged
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if file_meta.Quarantined == 1 {
+		return nil, 0, errQuarantined
+	}
+	stored, err := storage.Open(s.store(ctx), file_meta)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer stored.Close()
+	base, err := os.CreateTemp(db.TEMP_DIR, utils.TEMP_PATTERN)
+	if err != nil {
+		return nil, 0, err
+	}
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(base, hasher), stored)
+	if err == nil && hex.EncodeToString(hasher.Sum(nil)) != base_hash {
+		err = fmt.Errorf("%w: %s does not match its hash", storage.ErrCorrupted, metadataPath(file_meta))
+	}
+	if err != nil {
+		base.Close()
+		os.Remove(base.Name())
+		return nil, 0, err
+	}
+	return base, size, nil
+}
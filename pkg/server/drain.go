@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"grpc-pedrocarlo/pkg/utils"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// Stops a server without cutting transfers short: new calls are refused
+// while the calls in flight get Grace to finish, past it they are canceled
+// and their handlers clean up their temp files. Its interceptors must be
+// installed on Server so it knows which calls are in flight.
+type Drainer struct {
+	Server  *grpc.Server
+	Grace   time.Duration
+	OnDrain func() // Called when draining starts, nil for nothing
+
+	once     sync.Once
+	done     chan struct{}
+	handlers sync.WaitGroup
+	active   atomic.Int64
+}
+
+func NewDrainer(grace time.Duration) *Drainer {
+	return &Drainer{Grace: grace, done: make(chan struct{})}
+}
+
+// Calls in flight
+func (d *Drainer) Active() int64 {
+	return d.active.Load()
+}
+
+// Starts draining the server, later calls do nothing. Returns right away,
+// Done is closed once every handler returned.
+func (d *Drainer) Drain() {
+	d.once.Do(func() {
+		go d.drain()
+	})
+}
+
+func (d *Drainer) drain() {
+	utils.Log_trace(fmt.Sprintf("Draining %d calls, canceling them after %s", d.Active(), d.Grace))
+	if d.OnDrain != nil {
+		d.OnDrain()
+	}
+	stopped := make(chan struct{})
+	go func() {
+		d.Server.GracefulStop()
+		close(stopped)
+	}()
+	timer := time.NewTimer(d.Grace)
+	defer timer.Stop()
+	select {
+	case <-stopped:
+	case <-timer.C:
+		utils.Log_trace(fmt.Sprintf("Canceling %d calls still running", d.Active()))
+		d.Server.Stop()
+		<-stopped
+	}
+	// Stop does not wait for the canceled handlers
+	d.handlers.Wait()
+	utils.Log_trace("Drained")
+	close(d.done)
+}
+
+func (d *Drainer) Done() <-chan struct{} {
+	return d.done
+}
+
+func (d *Drainer) track() func() {
+	d.handlers.Add(1)
+	d.active.Add(1)
+	return func() {
+		d.active.Add(-1)
+		d.handlers.Done()
+	}
+}
+
+// Interceptors keeping count of the calls in flight
+func (d *Drainer) UnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	defer d.track()()
+	return handler(ctx, req)
+}
+
+func (d *Drainer) StreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	defer d.track()()
+	return handler(srv, ss)
+}
@@ -0,0 +1,284 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"grpc-pedrocarlo/pkg/db"
+	filesync "grpc-pedrocarlo/pkg/file"
+	"grpc-pedrocarlo/pkg/utils"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Default limits of UploadArchive, protecting the server against archive bombs
+const (
+	DEFAULT_ARCHIVE_MAX_ENTRIES = 100000
+	DEFAULT_ARCHIVE_MAX_BYTES   = 10 << 30
+)
+
+var (
+	errArchiveTooManyEntries = errors.New("archive has too many entries")
+	errArchiveTooLarge       = errors.New("archive extracts to too many bytes")
+	errArchiveBadEntryName   = errors.New("archive entry name is not a relative path inside the archive")
+)
+
+// Reads the chunks of an UploadArchive stream after the first message
+type archiveStreamReader struct {
+	stream filesync.FileSync_UploadArchiveServer
+	buf    []byte
+	done   bool
+}
+
+func (r *archiveStreamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		res, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		if res.Response == nil {
+			return 0, errors.New("nil response")
+		}
+		r.buf = res.Response.Chunk
+		r.done = res.Response.Done
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// Validates an archive entry name and returns its slash separated path
+// relative to the extraction folder, empty for the extraction folder itself
+func archiveEntryPath(name string) (string, error) {
+	clean := strings.TrimSuffix(name, "/")
+	for strings.HasPrefix(clean, "./") {
+		clean = clean[2:]
+	}
+	if clean == "." {
+		return "", nil
+	}
+	if strings.ContainsAny(clean, "\\\x00") || !filepath.IsLocal(clean) || path.Clean(clean) != clean {
+		return "", fmt.Errorf("%w: %q", errArchiveBadEntryName, name)
+	}
+	return clean, nil
+}
+
+// Extracts archive entries into folder while enforcing the limits
+type extractor struct {
+	conn        *db.Store
+	folder      string
+	max_entries int
+	max_bytes   int64
+
+	entries int
+	folders int
+	files   int
+	bytes   int64
+}
+
+func (e *extractor) countEntry() error {
+	e.entries++
+	if e.entries > e.max_entries {
+		return fmt.Errorf("%w, limit is %d", errArchiveTooManyEntries, e.max_entries)
+	}
+	return nil
+}
+
+func (e *extractor) addFolder(name string) error {
+	rel, err := archiveEntryPath(name)
+	if err != nil || rel == "" {
+		return err
+	}
+	created, err := ensureFolder(e.conn, filepath.Join(e.folder, rel))
+	if created {
+		e.folders++
+	}
+	return err
+}
+
+// Copies r, never more than the bytes left in the budget, and commits it
+func (e *extractor) addFile(name string, r io.Reader) error {
+	rel, err := archiveEntryPath(name)
+	if err == nil && rel == "" {
+		err = fmt.Errorf("%w: %q", errArchiveBadEntryName, name)
+	}
+	if err != nil {
+		return err
+	}
+	remote_path := filepath.Join(e.folder, rel)
+	created, err := ensureFolder(e.conn, filepath.Dir(remote_path))
+	if created {
+		e.folders++
+	}
+	if err != nil {
+		return err
+	}
+	temp_file, err := os.CreateTemp(db.TEMP_DIR, utils.TEMP_PATTERN)
+	if err != nil {
+		return err
+	}
+	temp_path := temp_file.Name()
+	defer temp_file.Close()
+	defer os.Remove(temp_path)
+	hasher := sha256.New()
+	left := e.max_bytes - e.bytes
+	n, err := io.Copy(io.MultiWriter(temp_file, hasher), io.LimitReader(r, left+1))
+	if err != nil {
+		return err
+	}
+	if n > left {
+		return fmt.Errorf("%w, limit is %d bytes", errArchiveTooLarge, e.max_bytes)
+	}
+	e.bytes += n
+	err = temp_file.Close()
+	if err != nil {
+		return err
+	}
+	e.files++
+	return commitFile(e.conn, temp_path, filepath.Dir(remote_path), filepath.Base(remote_path), hex.EncodeToString(hasher.Sum(nil)))
+}
+
+func (e *extractor) extractTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = e.countEntry()
+		if err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = e.addFolder(header.Name)
+		case tar.TypeReg:
+			err = e.addFile(header.Name, tr)
+		default:
+			utils.Log_trace(fmt.Sprintf("Skipping archive entry %s of type %c", header.Name, header.Typeflag))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (e *extractor) extractZip(file *os.File, size int64) error {
+	zr, err := zip.NewReader(file, size)
+	if err != nil {
+		return err
+	}
+	for _, entry := range zr.File {
+		err = e.countEntry()
+		if err != nil {
+			return err
+		}
+		mode := entry.Mode()
+		switch {
+		case mode.IsDir():
+			err = e.addFolder(entry.Name)
+		case mode.IsRegular():
+			err = e.extractZipFile(entry)
+		default:
+			utils.Log_trace(fmt.Sprintf("Skipping archive entry %s with mode %s", entry.Name, mode))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *extractor) extractZipFile(entry *zip.File) error {
+	r, err := entry.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return e.addFile(entry.Name, r)
+}
+
+// UploadArchive implements filesync.FileSyncServer.
+// Tar archives are extracted while they are received, zip archives need
+// random access and are staged in TEMP_DIR first.
+func (s *FileSyncServer) UploadArchive(stream filesync.FileSync_UploadArchiveServer) error {
+	utils.Log_trace("Received Upload Archive request")
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if first.Response == nil {
+		return errors.New("nil response")
+	}
+	folder := filepath.Clean(translateFolder(first.Folder))
+	if !strings.HasPrefix(folder, db.ROOT_FOLDER) {
+		return errRemoteFolderNotAbsolute
+	}
+	e := &extractor{conn: s.store(stream.Context()), folder: folder, max_entries: s.ArchiveMaxEntries, max_bytes: s.ArchiveMaxBytes}
+	if e.max_entries <= 0 {
+		e.max_entries = DEFAULT_ARCHIVE_MAX_ENTRIES
+	}
+	if e.max_bytes <= 0 {
+		e.max_bytes = DEFAULT_ARCHIVE_MAX_BYTES
+	}
+	created, err := ensureFolder(s.store(stream.Context()), folder)
+	if err != nil {
+		return err
+	}
+	if created {
+		e.folders++
+	}
+	r := &archiveStreamReader{stream: stream, buf: first.Response.Chunk, done: first.Response.Done}
+
+	switch first.Format {
+	case ARCHIVE_TAR:
+		err = e.extractTar(r)
+	case ARCHIVE_TAR_GZ:
+		var gz *gzip.Reader
+		gz, err = gzip.NewReader(r)
+		if err == nil {
+			err = e.extractTar(gz)
+		}
+	case ARCHIVE_ZIP:
+		err = e.extractZipStream(r)
+	default:
+		err = fmt.Errorf("%w: %q", errUnknownArchiveFormat, first.Format)
+	}
+	if err != nil {
+		utils.Log_trace(fmt.Sprintf("Archive extraction into %s stopped after %d files: %v", folder, e.files, err))
+		return err
+	}
+	utils.Log_trace(fmt.Sprintf("Extracted %d folders, %d files and %d bytes into %s", e.folders, e.files, e.bytes, folder))
+	return stream.SendAndClose(&filesync.ArchiveUploadResponse{Folders: int32(e.folders), Files: int32(e.files), Bytes: e.bytes})
+}
+
+func (e *extractor) extractZipStream(r io.Reader) error {
+	temp_file, err := os.CreateTemp(db.TEMP_DIR, utils.TEMP_PATTERN)
+	if err != nil {
+		return err
+	}
+	defer temp_file.Close()
+	defer os.Remove(temp_file.Name())
+	// Staging is bounded by the same limit as the extracted bytes
+	size, err := io.Copy(temp_file, io.LimitReader(r, e.max_bytes+1))
+	if err != nil {
+		return err
+	}
+	if size > e.max_bytes {
+		return fmt.Errorf("%w, limit is %d bytes", errArchiveTooLarge, e.max_bytes)
+	}
+	return e.extractZip(temp_file, size)
+}
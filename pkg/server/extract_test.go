@@ -0,0 +1,42 @@
+package server
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestArchiveEntryPath(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"file.txt", "file.txt", true},
+		{"dir/", "dir", true},
+		{"dir/file.txt", "dir/file.txt", true},
+		{"./dir/file.txt", "dir/file.txt", true},
+		{"././file.txt", "file.txt", true},
+		{"./", "", true},
+		{".", "", true},
+		{"..", "", false},
+		{"../file.txt", "", false},
+		{"dir/../../file.txt", "", false},
+		{"dir/../file.txt", "", false},
+		{"/etc/passwd", "", false},
+		{"dir//file.txt", "", false},
+		{"dir/./file.txt", "", false},
+		{"dir\\..\\file.txt", "", false},
+		{"..\\file.txt", "", false},
+		{"file\x00.txt", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		got, err := archiveEntryPath(test.name)
+		if test.ok && (err != nil || got != test.want) {
+			t.Errorf("archiveEntryPath(%q) = %q, %v, want %q", test.name, got, err, test.want)
+		}
+		if !test.ok && !errors.Is(err, errArchiveBadEntryName) {
+			t.Errorf("archiveEntryPath(%q) = %q, %v, want errArchiveBadEntryName", test.name, got, err)
+		}
+	}
+}
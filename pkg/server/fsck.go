@@ -0,0 +1,411 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"grpc-pedrocarlo/pkg/db"
+	filesync "grpc-pedrocarlo/pkg/file"
+	"grpc-pedrocarlo/pkg/storage"
+	"grpc-pedrocarlo/pkg/utils"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Kinds of problems found by Fsck
+const (
+	FSCK_MISSING_BLOB    = "missing_blob"    // file row without bytes on disk
+	FSCK_ORPHANED_FILE   = "orphaned_file"   // bytes on disk without file row
+	FSCK_ORPHANED_FOLDER = "orphaned_folder" // directory on disk without folder row
+	FSCK_HASH_MISMATCH   = "hash_mismatch"   // bytes on disk do not match file_hash
+	FSCK_DANGLING_FOLDER = "dangling_folder" // folder row without directory or parent folder
+	FSCK_READ_ERROR      = "read_error"      // bytes on disk could not be read
+	FSCK_ORPHANED_CHUNK  = "orphaned_chunk"  // chunk blob on disk without chunk row
+)
+
+var errChunkInUse = errors.New("chunk is used by files")
+
+// Files on disk this recent may belong to an upload that is being committed
+const fsckOrphanGrace = time.Minute
+
+type FsckProblem struct {
+	Kind     string
+	Path     string
+	Detail   string
+	Repaired bool
+}
+
+type FsckReport struct {
+	Problems       []FsckProblem
+	FilesChecked   int
+	FoldersChecked int
+}
+
+// Returns how many problems were found and not repaired
+func (r *FsckReport) Unrepaired() int {
+	n := 0
+	for _, problem := range r.Problems {
+		if !problem.Repaired {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *FsckReport) add(kind string, path string, detail string, repair func() error) {
+	problem := FsckProblem{Kind: kind, Path: path, Detail: detail}
+	if repair != nil {
+		err := repair()
+		if err != nil {
+			problem.Detail = fmt.Sprintf("%s, repair failed: %v", detail, err)
+		} else {
+			problem.Repaired = true
+		}
+	}
+	utils.Log_trace(fmt.Sprintf("%s %s: %s (repaired: %t)", problem.Kind, problem.Path, problem.Detail, problem.Repaired))
+	r.Problems = append(r.Problems, problem)
+}
+
+// Cross checks files_metadata against DB_FILES_DIR and the chunks table
+// against CHUNKS_DIR. With repair set:
+//   - rows of missing blobs are removed, and rows of files missing a chunk
+//   - orphaned files and chunks are moved to LOST_FOUND_DIR
+//   - orphaned folders are added to files_metadata
+//   - dangling folders get their directory and missing parents recreated
+//
+// Hash mismatches and read errors are only reported, the original bytes
+// cannot be recovered.
+// Files quarantined by the Scrubber are skipped.
+func Fsck(conn *db.Store, repair bool) (*FsckReport, error) {
+	utils.Log_trace(fmt.Sprintf("Starting fsck, repair: %t", repair))
+	rows, err := db.QueryAllFiles(conn)
+	if err != nil {
+		return nil, err
+	}
+	report := &FsckReport{}
+	folders := make(map[string]bool)
+	files := make(map[string]bool)
+	for _, row := range rows {
+		if row.Is_dir == 1 {
+			folders[metadataPath(&row)] = true
+		} else {
+			files[metadataPath(&row)] = true
+		}
+	}
+
+	for i := range rows {
+		row := &rows[i]
+		path := metadataPath(row)
+		if row.Is_dir == 1 {
+			report.FoldersChecked++
+			checkFolder(conn, report, folders, row, path, repair)
+		} else if row.Quarantined == 0 {
+			report.FilesChecked++
+			checkFile(conn, report, folders, row, path, repair)
+		}
+	}
+
+	err = filepath.WalkDir(db.DB_FILES_DIR, func(disk_path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(db.DB_FILES_DIR, disk_path)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(db.ROOT_FOLDER, rel)
+		if entry.IsDir() {
+			if folders[path] {
+				return nil
+			}
+			var fix func() error
+			if repair {
+				fix = func() error {
+					folders[path] = true
+					return insertFolder(conn, path)
+				}
+			}
+			report.add(FSCK_ORPHANED_FOLDER, path, "directory has no folder row", fix)
+			return nil
+		}
+		if files[path] {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if time.Since(info.ModTime()) < fsckOrphanGrace {
+			return nil
+		}
+		var fix func() error
+		if repair {
+			fix = func() error { return moveToLostFound(disk_path, rel) }
+		}
+		report.add(FSCK_ORPHANED_FILE, path, "file has no metadata row", fix)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// After the files, whose repair may leave chunks unused
+	err = checkChunks(conn, report, repair)
+	if err != nil {
+		return nil, err
+	}
+	utils.Log_trace(fmt.Sprintf("Finished fsck, %d files and %d folders checked, %d problems", report.FilesChecked, report.FoldersChecked, len(report.Problems)))
+	return report, nil
+}
+
+func checkFolder(conn *db.Store, report *FsckReport, folders map[string]bool, row *db.FileMetadata, path string, repair bool) {
+	if path != db.ROOT_FOLDER && !folders[row.Folder] {
+		var fix func() error
+		if repair {
+			fix = func() error { return insertParents(conn, folders, path) }
+		}
+		report.add(FSCK_DANGLING_FOLDER, path, fmt.Sprintf("parent folder %s does not exist", row.Folder), fix)
+	}
+	info, err := os.Stat(db.GetFilePath(row))
+	if err == nil && info.IsDir() {
+		return
+	}
+	detail := "directory does not exist"
+	if err == nil {
+		detail = "path on disk is not a directory"
+	}
+	var fix func() error
+	if repair && err != nil {
+		fix = func() error { return os.MkdirAll(db.GetFilePath(row), 0755) }
+	}
+	report.add(FSCK_DANGLING_FOLDER, path, detail, fix)
+}
+
+func checkFile(conn *db.Store, report *FsckReport, folders map[string]bool, row *db.FileMetadata, path string, repair bool) {
+	if !folders[row.Folder] {
+		var fix func() error
+		if repair {
+			fix = func() error { return insertParents(conn, folders, path) }
+		}
+		report.add(FSCK_DANGLING_FOLDER, row.Folder, fmt.Sprintf("folder of %s does not exist", path), fix)
+	}
+	var fix func() error
+	if repair {
+		fix = func() error { return removeRow(conn, row.Id) }
+	}
+	if row.Chunked == 1 {
+		missing, err := missingChunks(conn, row)
+		if err != nil {
+			report.add(FSCK_READ_ERROR, path, err.Error(), nil)
+			return
+		}
+		if len(missing) > 0 {
+			report.add(FSCK_MISSING_BLOB, path, fmt.Sprintf("%d chunks are missing, the first is %s", len(missing), missing[0]), fix)
+			return
+		}
+	}
+	file, err := storage.Open(conn, row)
+	if os.IsNotExist(err) {
+		report.add(FSCK_MISSING_BLOB, path, err.Error(), fix)
+		return
+	}
+	if err != nil {
+		report.add(readErrorKind(err), path, err.Error(), nil)
+		return
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, file)
+	if err != nil {
+		report.add(readErrorKind(err), path, err.Error(), nil)
+		return
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	if hash != row.Filehash {
+		report.add(FSCK_HASH_MISMATCH, path, fmt.Sprintf("expected %s got %s", row.Filehash, hash), nil)
+	}
+}
+
+// Bytes that were read but are not the ones stored are a mismatch, anything
+// else kept them from being read
+func readErrorKind(err error) string {
+	if errors.Is(err, storage.ErrCorrupted) {
+		return FSCK_HASH_MISMATCH
+	}
+	return FSCK_READ_ERROR
+}
+
+// Hashes of the chunks of a chunked file without a row or a blob
+func missingChunks(conn *db.Store, row *db.FileMetadata) ([]string, error) {
+	missing, err := db.QueryMissingFileChunks(conn, row.Id)
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := db.QueryFileChunks(conn, row.Id)
+	if err != nil {
+		return nil, err
+	}
+	for _, chunk := range chunks {
+		_, err = os.Stat(db.GetChunkPath(chunk.Hash))
+		if os.IsNotExist(err) {
+			missing = append(missing, chunk.Hash)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return missing, nil
+}
+
+// Cross checks the chunks table against CHUNKS_DIR. Chunk rows without blob
+// are removed on repair when no file uses them anymore.
+func checkChunks(conn *db.Store, report *FsckReport, repair bool) error {
+	chunks, err := db.QueryAllChunks(conn)
+	if err != nil {
+		return err
+	}
+	known := make(map[string]bool)
+	for _, chunk := range chunks {
+		known[chunk.Hash] = true
+		chunk_path := db.GetChunkPath(chunk.Hash)
+		_, err = os.Stat(chunk_path)
+		if os.IsNotExist(err) {
+			var fix func() error
+			if repair {
+				fix = func() error { return removeChunkRow(conn, chunk.Hash) }
+			}
+			report.add(FSCK_MISSING_BLOB, chunkReportPath(chunk_path), "chunk row has no blob", fix)
+			continue
+		}
+		if err != nil {
+			report.add(FSCK_READ_ERROR, chunkReportPath(chunk_path), err.Error(), nil)
+		}
+	}
+	return filepath.WalkDir(db.CHUNKS_DIR, func(disk_path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || known[entry.Name()] {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		// Stored before its row is committed
+		if time.Since(info.ModTime()) < fsckOrphanGrace {
+			return nil
+		}
+		path := chunkReportPath(disk_path)
+		var fix func() error
+		if repair {
+			fix = func() error { return moveToLostFound(disk_path, path) }
+		}
+		report.add(FSCK_ORPHANED_CHUNK, path, "chunk has no chunk row", fix)
+		return nil
+	})
+}
+
+// Path of a chunk blob relative to BASE_DIR, like chunks/ab/ab01...
+func chunkReportPath(disk_path string) string {
+	rel, err := filepath.Rel(db.BASE_DIR, disk_path)
+	if err != nil {
+		return disk_path
+	}
+	return rel
+}
+
+func removeChunkRow(conn *db.Store, hash string) error {
+	tx, err := conn.Beginx()
+	if err != nil {
+		return err
+	}
+	removed, err := db.RemoveUnusedChunk(tx, hash)
+	if err == nil && !removed {
+		err = errChunkInUse
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Logical path of a row, the root folder is "/"
+func metadataPath(meta *db.FileMetadata) string {
+	return filepath.Join(meta.Folder, meta.Filename)
+}
+
+func insertFolder(conn *db.Store, path string) error {
+	tx, err := conn.Beginx()
+	if err != nil {
+		return err
+	}
+	err = db.InsertFolder(tx, path)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Inserts every missing folder between the root and path
+func insertParents(conn *db.Store, folders map[string]bool, path string) error {
+	missing := []string{}
+	for parent := filepath.Dir(path); !folders[parent] && parent != db.ROOT_FOLDER; parent = filepath.Dir(parent) {
+		missing = append(missing, parent)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		err := insertFolder(conn, missing[i])
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(filepath.Join(db.DB_FILES_DIR, missing[i]), 0755)
+		if err != nil {
+			return err
+		}
+		folders[missing[i]] = true
+	}
+	return nil
+}
+
+func removeRow(conn *db.Store, id int) error {
+	tx, err := conn.Beginx()
+	if err != nil {
+		return err
+	}
+	err = db.RemoveRow(tx, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func moveToLostFound(disk_path string, rel string) error {
+	new_path := filepath.Join(db.LOST_FOUND_DIR, rel)
+	err := os.MkdirAll(filepath.Dir(new_path), 0755)
+	if err != nil {
+		return err
+	}
+	return os.Rename(disk_path, new_path)
+}
+
+func FsckReportToFilesyncFsckResponse(report *FsckReport) *filesync.FsckResponse {
+	problems := make([]*filesync.FsckProblem, 0, len(report.Problems))
+	for _, problem := range report.Problems {
+		problems = append(problems, &filesync.FsckProblem{
+			Kind:     problem.Kind,
+			Path:     problem.Path,
+			Detail:   problem.Detail,
+			Repaired: problem.Repaired,
+		})
+	}
+	return &filesync.FsckResponse{
+		Problems:       problems,
+		FilesChecked:   int32(report.FilesChecked),
+		FoldersChecked: int32(report.FoldersChecked),
+	}
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"grpc-pedrocarlo/pkg/db"
+	filesync "grpc-pedrocarlo/pkg/file"
+	"grpc-pedrocarlo/pkg/utils"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Longest a health check may take before the server is reported down
+const HEALTH_CHECK_TIMEOUT = 5 * time.Second
+
+// Calls of the health service, exempt from the limits so a busy client does
+// not make the server look down
+func isHealthCheck(full_method string) bool {
+	return strings.HasPrefix(full_method, "/"+healthpb.Health_ServiceDesc.ServiceName+"/")
+}
+
+// Reports to Health whether the server can do its work: it is NOT_SERVING
+// while the database can not be reached or a storage folder can not be
+// written to.
+type HealthChecker struct {
+	Health   *health.Server
+	Db_conn  *db.Store
+	Interval time.Duration
+}
+
+// Returns why the server can not serve, nil when it can
+func (h *HealthChecker) Check(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, HEALTH_CHECK_TIMEOUT)
+	defer cancel()
+	err := h.Db_conn.PingContext(ctx)
+	if err != nil {
+		return fmt.Errorf("database unreachable: %w", err)
+	}
+	for _, dir := range []string{db.TEMP_DIR, db.DB_FILES_DIR, db.CHUNKS_DIR} {
+		file, err := os.CreateTemp(dir, utils.TEMP_PATTERN)
+		if err != nil {
+			return fmt.Errorf("storage not writable: %w", err)
+		}
+		file.Close()
+		os.Remove(file.Name())
+	}
+	return nil
+}
+
+func (h *HealthChecker) update(ctx context.Context, last healthpb.HealthCheckResponse_ServingStatus) healthpb.HealthCheckResponse_ServingStatus {
+	status := healthpb.HealthCheckResponse_SERVING
+	err := h.Check(ctx)
+	if err != nil {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+		if last != status {
+			utils.Log_trace(fmt.Sprintf("Server is not serving: %v", err))
+		}
+	} else if last == healthpb.HealthCheckResponse_NOT_SERVING {
+		utils.Log_trace("Server is serving again")
+	}
+	h.Health.SetServingStatus("", status)
+	h.Health.SetServingStatus(filesync.FileSync_ServiceDesc.ServiceName, status)
+	return status
+}
+
+// Checks the server every Interval until ctx is done
+func (h *HealthChecker) Run(ctx context.Context) {
+	last := h.update(ctx, healthpb.HealthCheckResponse_UNKNOWN)
+	ticker := time.NewTicker(h.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		last = h.update(ctx, last)
+	}
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"grpc-pedrocarlo/pkg/db"
+	"grpc-pedrocarlo/pkg/utils"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var errRemoteFolderNotAbsolute = errors.New("remote folder must start with /")
+
+// Outcome of importing a single local file
+const (
+	IMPORT_ADDED     = "added"
+	IMPORT_UPDATED   = "updated"
+	IMPORT_UNCHANGED = "unchanged"
+	IMPORT_SKIPPED   = "skipped" // Not a regular file
+)
+
+type ImportProgress struct {
+	Done   int // Files processed, including this one
+	Total  int
+	Path   string // Remote path of the file
+	Size   int64
+	Result string
+}
+
+type ImportReport struct {
+	Added, Updated, Unchanged, Skipped, Folders int
+	Bytes                                       int64 // Bytes copied into storage
+}
+
+// Copies the local tree at local_root into remote_folder, creating the folders
+// it needs. Files already stored with the same hash are left untouched, so an
+// interrupted import can simply be run again.
+func ImportTree(conn *db.Store, local_root string, remote_folder string, progress func(ImportProgress)) (*ImportReport, error) {
+	if !strings.HasPrefix(remote_folder, db.ROOT_FOLDER) {
+		return nil, errRemoteFolderNotAbsolute
+	}
+	remote_folder = filepath.Clean(remote_folder)
+	report := &ImportReport{}
+	info, err := os.Stat(local_root)
+	if err != nil {
+		return nil, err
+	}
+	// Paths are relative to base, so a single file lands inside remote_folder
+	base := local_root
+	if !info.IsDir() {
+		base = filepath.Dir(local_root)
+	}
+	created, err := ensureFolder(conn, remote_folder)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		report.Folders++
+	}
+
+	// Folders are created on the way, files are only listed so progress has a total
+	local_files := []string{}
+	err = filepath.WalkDir(local_root, func(local_path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		remote_path, err := importRemotePath(base, local_path, remote_folder)
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			created, err := ensureFolder(conn, remote_path)
+			if created {
+				report.Folders++
+			}
+			return err
+		}
+		local_files = append(local_files, local_path)
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	for i, local_path := range local_files {
+		remote_path, err := importRemotePath(base, local_path, remote_folder)
+		if err != nil {
+			return report, err
+		}
+		result, size, err := importFile(conn, local_path, remote_path)
+		if err != nil {
+			return report, fmt.Errorf("importing %s: %w", local_path, err)
+		}
+		switch result {
+		case IMPORT_ADDED:
+			report.Added++
+			report.Bytes += size
+		case IMPORT_UPDATED:
+			report.Updated++
+			report.Bytes += size
+		case IMPORT_UNCHANGED:
+			report.Unchanged++
+		case IMPORT_SKIPPED:
+			report.Skipped++
+		}
+		if progress != nil {
+			progress(ImportProgress{Done: i + 1, Total: len(local_files), Path: remote_path, Size: size, Result: result})
+		}
+	}
+	return report, nil
+}
+
+func importRemotePath(base string, local_path string, remote_folder string) (string, error) {
+	rel, err := filepath.Rel(base, local_path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(remote_folder, filepath.ToSlash(rel)), nil
+}
+
+func importFile(conn *db.Store, local_path string, remote_path string) (string, int64, error) {
+	info, err := os.Lstat(local_path)
+	if err != nil {
+		return "", 0, err
+	}
+	if !info.Mode().IsRegular() {
+		utils.Log_trace(fmt.Sprintf("Skipping %s, not a regular file", local_path))
+		return IMPORT_SKIPPED, 0, nil
+	}
+	local_file, err := os.Open(local_path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer local_file.Close()
+
+	folder, filename := filepath.Dir(remote_path), filepath.Base(remote_path)
+	result := IMPORT_ADDED
+	existing, err := db.QueryFileMetadata(conn, folder, filename)
+	if err == nil {
+		result = IMPORT_UPDATED
+		hasher := sha256.New()
+		_, err = io.Copy(hasher, local_file)
+		if err != nil {
+			return "", 0, err
+		}
+		_, stat_err := os.Stat(db.GetFilePath(existing))
+		if hex.EncodeToString(hasher.Sum(nil)) == existing.Filehash && stat_err == nil {
+			return IMPORT_UNCHANGED, info.Size(), nil
+		}
+		_, err = local_file.Seek(0, io.SeekStart)
+		if err != nil {
+			return "", 0, err
+		}
+	}
+
+	// Hash while copying, the local file may change between two reads
+	temp_file, err := os.CreateTemp(db.TEMP_DIR, utils.TEMP_PATTERN)
+	if err != nil {
+		return "", 0, err
+	}
+	path := temp_file.Name()
+	defer temp_file.Close()
+	defer os.Remove(path)
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(temp_file, hasher), local_file)
+	if err != nil {
+		return "", 0, err
+	}
+	err = temp_file.Close()
+	if err != nil {
+		return "", 0, err
+	}
+	err = commitFile(conn, path, folder, filename, hex.EncodeToString(hasher.Sum(nil)))
+	return result, size, err
+}
+
+// Creates the folder at path and its missing parents, both in files_metadata
+// and on disk. Returns whether path itself had to be created.
+func ensureFolder(conn *db.Store, path string) (bool, error) {
+	_, err := db.QueryFolderByPath(conn, path)
+	if err == nil {
+		return false, os.MkdirAll(filepath.Join(db.DB_FILES_DIR, path), 0755)
+	}
+	if path != db.ROOT_FOLDER {
+		_, err = ensureFolder(conn, filepath.Dir(path))
+		if err != nil {
+			return false, err
+		}
+	}
+	err = os.MkdirAll(filepath.Join(db.DB_FILES_DIR, path), 0755)
+	if err != nil {
+		return false, err
+	}
+	return true, insertFolder(conn, path)
+}
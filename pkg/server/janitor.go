@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"grpc-pedrocarlo/pkg/db"
+	"grpc-pedrocarlo/pkg/storage"
+	"grpc-pedrocarlo/pkg/utils"
+	"sync"
+	"time"
+)
+
+var publishJanitorOnce sync.Once
+
+type JanitorStats struct {
+	Runs           int64
+	Removed        int64
+	BytesReclaimed int64
+	ChunksRemoved  int64
+}
+
+// Janitor periodically removes the temp files and upload leftovers of Dir
+// that have not been touched for MaxAge, e.g. after a crash or a stalled client.
+// With Db_conn set it also removes the chunks no file has used for MaxAge,
+// left by overwritten or removed files and by uploads never committed.
+type Janitor struct {
+	Dir      string
+	MaxAge   time.Duration
+	Interval time.Duration
+	Db_conn  *db.Store
+
+	mu    sync.Mutex
+	stats JanitorStats
+}
+
+func (j *Janitor) Stats() JanitorStats {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.stats
+}
+
+// Removes the temp leftovers older than MaxAge, meant to be called at startup
+// instead of waiting for the first run. Younger files may be upload staging
+// files resumed after a restart, or belong to another server sharing Dir.
+func (j *Janitor) Recover() error {
+	return j.clean(j.MaxAge)
+}
+
+// Runs the janitor until ctx is done. Stats are published in expvar as "janitor".
+func (j *Janitor) Run(ctx context.Context) {
+	publishJanitorOnce.Do(func() {
+		expvar.Publish("janitor", expvar.Func(func() any { return j.Stats() }))
+	})
+	ticker := time.NewTicker(j.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := j.clean(j.MaxAge)
+		if err != nil {
+			utils.Log_trace(fmt.Sprintf("Janitor failed to clean %s: %v", j.Dir, err))
+		}
+		if j.Db_conn != nil {
+			err = j.collectChunks()
+			if err != nil {
+				utils.Log_trace(fmt.Sprintf("Janitor failed to remove unused chunks: %v", err))
+			}
+		}
+	}
+}
+
+// Chunks of an upload in progress are not used by any file until it is
+// committed, so only chunks older than MaxAge are removed
+func (j *Janitor) collectChunks() error {
+	chunks, err := db.QueryUnusedChunks(j.Db_conn, int(time.Now().Add(-j.MaxAge).Unix()))
+	if err != nil {
+		return err
+	}
+	removed := int64(0)
+	for _, chunk := range chunks {
+		ok, err := storage.RemoveUnusedChunk(j.Db_conn, chunk.Hash)
+		if err != nil {
+			return err
+		}
+		if ok {
+			removed++
+		}
+	}
+	j.mu.Lock()
+	j.stats.ChunksRemoved += removed
+	j.mu.Unlock()
+	if removed > 0 {
+		utils.Log_trace(fmt.Sprintf("Janitor removed %d unused chunks", removed))
+	}
+	return nil
+}
+
+func (j *Janitor) clean(max_age time.Duration) error {
+	stats, err := utils.CleanTempDir(j.Dir, max_age)
+	j.mu.Lock()
+	j.stats.Runs++
+	j.stats.Removed += int64(stats.Removed)
+	j.stats.BytesReclaimed += stats.Bytes
+	j.mu.Unlock()
+	if stats.Removed > 0 {
+		utils.Log_trace(fmt.Sprintf("Janitor removed %d temp entries from %s, reclaimed %d bytes", stats.Removed, j.Dir, stats.Bytes))
+	}
+	return err
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"grpc-pedrocarlo/pkg/ratelimit"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Trailer of a ResourceExhausted error, seconds to wait before trying again
+const RETRY_AFTER_HEADER = "retry-after"
+
+// Longest a transfer is slowed down to stay under its throughput limits,
+// past it the transfer fails with ResourceExhausted
+const MAX_THROTTLE_WAIT = 10 * time.Second
+
+// Transfers take their bytes from the buckets in pieces of at most this
+// size, so parallel transfers of a caller queue up little debt each
+const THROTTLE_PIECE = 64 << 10
+
+// Buckets of users and connections idle for this long are dropped
+const LIMIT_IDLE_TIMEOUT = 10 * time.Minute
+
+// Limits of the server, 0 for no limit. There are no accounts, a user is
+// the address clients connect from and a connection is its address and port.
+type Limits struct {
+	UserRequests float64 // Requests per second of a user, over all its connections
+	ConnRequests float64 // Requests per second of a connection
+	UserBytes    int64   // Bytes per second moved by a user, over all its connections
+	ConnBytes    int64   // Bytes per second moved by a connection
+}
+
+// Enforces Limits with a token bucket for each user and connection. Requests
+// are checked by the interceptors, throughput by the transfer loops. A nil
+// limiter limits nothing.
+type Limiter struct {
+	limits Limits
+
+	mu         sync.Mutex
+	buckets    map[string]*ratelimit.Bucket
+	last_prune time.Time
+}
+
+func NewLimiter(limits Limits) *Limiter {
+	return &Limiter{limits: limits, buckets: map[string]*ratelimit.Bucket{}, last_prune: time.Now()}
+}
+
+// Changes the limits. Buckets already in use keep their tokens and follow
+// the new rates, including those of the transfers in flight.
+func (l *Limiter) SetLimits(limits Limits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = limits
+	for name, bucket := range l.buckets {
+		kind, _, _ := strings.Cut(name, " ")
+		rate := l.rate(kind)
+		if rate <= 0 {
+			delete(l.buckets, name)
+			continue
+		}
+		bucket.SetRate(rate, 0)
+	}
+}
+
+// Must hold l.mu
+func (l *Limiter) rate(kind string) float64 {
+	switch kind {
+	case "user-requests":
+		return l.limits.UserRequests
+	case "conn-requests":
+		return l.limits.ConnRequests
+	case "user-bytes":
+		return float64(l.limits.UserBytes)
+	case "conn-bytes":
+		return float64(l.limits.ConnBytes)
+	}
+	return 0
+}
+
+// Bucket of key for the given kind of limit, nil when there is no limit
+func (l *Limiter) bucket(kind string, key string) *ratelimit.Bucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rate := l.rate(kind)
+	if rate <= 0 {
+		return nil
+	}
+	if time.Since(l.last_prune) > LIMIT_IDLE_TIMEOUT {
+		for name, bucket := range l.buckets {
+			if bucket.Idle() > LIMIT_IDLE_TIMEOUT {
+				delete(l.buckets, name)
+			}
+		}
+		l.last_prune = time.Now()
+	}
+	name := kind + " " + key
+	bucket, ok := l.buckets[name]
+	if !ok {
+		bucket = ratelimit.NewBucket(rate, 0)
+		l.buckets[name] = bucket
+	}
+	return bucket
+}
+
+// User and connection of the caller
+func callerKeys(ctx context.Context) (string, string) {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return "", ""
+	}
+	addr := p.Addr.String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return host, addr
+}
+
+func resourceExhausted(ctx context.Context, wait time.Duration, format string, args ...any) error {
+	seconds := max(int(math.Ceil(wait.Seconds())), 1)
+	// Clients retrying through their service config wait for the pushback
+	grpc.SetTrailer(ctx, metadata.Pairs(
+		RETRY_AFTER_HEADER, strconv.Itoa(seconds),
+		"grpc-retry-pushback-ms", strconv.FormatInt(wait.Milliseconds(), 10),
+	))
+	return status.Errorf(codes.ResourceExhausted, "%s, retry after %ds", fmt.Sprintf(format, args...), seconds)
+}
+
+// Takes a request token from the user and connection of the caller
+func (l *Limiter) allowRequest(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	user, conn := callerKeys(ctx)
+	user_bucket := l.bucket("user-requests", user)
+	ok, wait := user_bucket.Allow(1)
+	if !ok {
+		return resourceExhausted(ctx, wait, "too many requests from %s", user)
+	}
+	ok, wait = l.bucket("conn-requests", conn).Allow(1)
+	if !ok {
+		user_bucket.Cancel(1)
+		return resourceExhausted(ctx, wait, "too many requests on connection %s", conn)
+	}
+	return nil
+}
+
+// Slows down a transfer of n more bytes to the throughput limits of the
+// caller, fails it when that takes longer than MAX_THROTTLE_WAIT
+func (l *Limiter) Throttle(ctx context.Context, n int) error {
+	if l == nil || n == 0 {
+		return nil
+	}
+	user, conn := callerKeys(ctx)
+	user_bucket := l.bucket("user-bytes", user)
+	conn_bucket := l.bucket("conn-bytes", conn)
+	for n > 0 {
+		piece := float64(min(n, THROTTLE_PIECE))
+		wait := max(user_bucket.Reserve(piece), conn_bucket.Reserve(piece))
+		if wait > MAX_THROTTLE_WAIT {
+			user_bucket.Cancel(piece)
+			conn_bucket.Cancel(piece)
+			return resourceExhausted(ctx, wait-MAX_THROTTLE_WAIT, "too many bytes moved by %s", user)
+		}
+		err := ratelimit.Sleep(ctx, wait)
+		if err != nil {
+			return err
+		}
+		n -= int(piece)
+	}
+	return nil
+}
+
+// Interceptors refusing requests over the request rate limits
+func (l *Limiter) UnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if isHealthCheck(info.FullMethod) {
+		return handler(ctx, req)
+	}
+	err := l.allowRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (l *Limiter) StreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if isHealthCheck(info.FullMethod) {
+		return handler(srv, ss)
+	}
+	err := l.allowRequest(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"grpc-pedrocarlo/pkg/db"
+	"grpc-pedrocarlo/pkg/metrics"
+	"grpc-pedrocarlo/pkg/utils"
+	"io/fs"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Interceptors recording every call in pkg/metrics
+func MetricsUnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	observeCall(info.FullMethod, start, err)
+	return resp, err
+}
+
+func MetricsStreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	active := metrics.ACTIVE_STREAMS.WithLabelValues(info.FullMethod)
+	active.Inc()
+	defer active.Dec()
+	start := time.Now()
+	err := handler(srv, &countedStream{
+		ServerStream: ss,
+		received:     metrics.RECEIVED_BYTES.WithLabelValues(info.FullMethod),
+		sent:         metrics.SENT_BYTES.WithLabelValues(info.FullMethod),
+	})
+	observeCall(info.FullMethod, start, err)
+	return err
+}
+
+func observeCall(method string, start time.Time, err error) {
+	metrics.RPC_DURATION.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	metrics.RPC_REQUESTS.WithLabelValues(method, status.Code(err).String()).Inc()
+	if errors.Is(err, errHashDifferent) || errors.Is(err, errChunkHashMismatch) {
+		metrics.HASH_MISMATCHES.WithLabelValues(method).Inc()
+	}
+}
+
+type countedStream struct {
+	grpc.ServerStream
+	received prometheus.Counter
+	sent     prometheus.Counter
+}
+
+func (s *countedStream) RecvMsg(m any) error {
+	err := s.ServerStream.RecvMsg(m)
+	if message, ok := m.(proto.Message); ok && err == nil {
+		s.received.Add(float64(proto.Size(message)))
+	}
+	return err
+}
+
+func (s *countedStream) SendMsg(m any) error {
+	err := s.ServerStream.SendMsg(m)
+	if message, ok := m.(proto.Message); ok && err == nil {
+		s.sent.Add(float64(proto.Size(message)))
+	}
+	return err
+}
+
+var (
+	storedFilesDesc       = prometheus.NewDesc("filesync_stored_files", "Files stored, without folders.", nil, nil)
+	storedFileBytesDesc   = prometheus.NewDesc("filesync_stored_file_bytes", "Bytes of the stored files before compression.", nil, nil)
+	storedChunksDesc      = prometheus.NewDesc("filesync_stored_chunks", "Chunks stored for chunked files.", nil, nil)
+	storedChunkBytesDesc  = prometheus.NewDesc("filesync_stored_chunk_bytes", "Bytes of the stored chunks before compression.", nil, nil)
+	quarantinedFilesDesc  = prometheus.NewDesc("filesync_quarantined_files", "Files found corrupted by the scrubber.", nil, nil)
+	tempFilesDesc         = prometheus.NewDesc("filesync_temp_files", "Files in the temp folder, mostly uploads in progress.", nil, nil)
+	tempBytesDesc         = prometheus.NewDesc("filesync_temp_bytes", "Bytes of the files in the temp folder.", nil, nil)
+	storageCollectorDescs = []*prometheus.Desc{storedFilesDesc, storedFileBytesDesc, storedChunksDesc, storedChunkBytesDesc, quarantinedFilesDesc, tempFilesDesc, tempBytesDesc}
+)
+
+// Collects the storage totals and the temp folder usage when scraped
+type StorageCollector struct {
+	Db_conn *db.Store
+}
+
+func (c *StorageCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range storageCollectorDescs {
+		ch <- desc
+	}
+}
+
+func (c *StorageCollector) Collect(ch chan<- prometheus.Metric) {
+	gauge := func(desc *prometheus.Desc, value int64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(value))
+	}
+	totals, err := db.QueryStorageTotals(c.Db_conn)
+	if err != nil {
+		utils.Log_trace(fmt.Sprintf("Failed to query storage totals: %v", err))
+	} else {
+		gauge(storedFilesDesc, totals.Files)
+		gauge(storedFileBytesDesc, totals.FileBytes)
+		gauge(storedChunksDesc, totals.Chunks)
+		gauge(storedChunkBytesDesc, totals.ChunkBytes)
+		gauge(quarantinedFilesDesc, totals.Quarantined)
+	}
+	files, bytes := int64(0), int64(0)
+	err = filepath.WalkDir(db.TEMP_DIR, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			// Files of finished uploads disappear while walking
+			return nil
+		}
+		info, err := entry.Info()
+		if err == nil {
+			files++
+			bytes += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		utils.Log_trace(fmt.Sprintf("Failed to walk %s: %v", db.TEMP_DIR, err))
+		return
+	}
+	gauge(tempFilesDesc, files)
+	gauge(tempBytesDesc, bytes)
+}
+
+var (
+	scrubbedFilesDesc   = prometheus.NewDesc("filesync_scrubbed_files_total", "Files re-hashed by the scrubber.", nil, nil)
+	scrubbedBytesDesc   = prometheus.NewDesc("filesync_scrubbed_bytes_total", "Bytes re-hashed by the scrubber.", nil, nil)
+	scrubCorruptedDesc  = prometheus.NewDesc("filesync_scrub_corrupted_files_total", "Files the scrubber found corrupted and quarantined.", nil, nil)
+	scrubMissingDesc    = prometheus.NewDesc("filesync_scrub_missing_files_total", "Files the scrubber found missing from storage.", nil, nil)
+	scrubFailedDesc     = prometheus.NewDesc("filesync_scrub_failed_files_total", "Files the scrubber could not hash.", nil, nil)
+	scrubPassesDesc     = prometheus.NewDesc("filesync_scrub_passes_total", "Passes of the scrubber over the stored files.", nil, nil)
+	scrubCollectorDescs = []*prometheus.Desc{scrubbedFilesDesc, scrubbedBytesDesc, scrubCorruptedDesc, scrubMissingDesc, scrubFailedDesc, scrubPassesDesc}
+)
+
+// Collects the stats of the scrubber when scraped
+type ScrubCollector struct {
+	Scrubber *Scrubber
+}
+
+func (c *ScrubCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range scrubCollectorDescs {
+		ch <- desc
+	}
+}
+
+func (c *ScrubCollector) Collect(ch chan<- prometheus.Metric) {
+	counter := func(desc *prometheus.Desc, value int64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(value))
+	}
+	stats := c.Scrubber.Stats()
+	counter(scrubbedFilesDesc, stats.FilesScrubbed)
+	counter(scrubbedBytesDesc, stats.BytesScrubbed)
+	counter(scrubCorruptedDesc, stats.Corrupted)
+	counter(scrubMissingDesc, stats.Missing)
+	counter(scrubFailedDesc, stats.Failed)
+	counter(scrubPassesDesc, stats.Passes)
+}
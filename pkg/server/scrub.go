@@ -0,0 +1,249 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"grpc-pedrocarlo/pkg/db"
+	filesync "grpc-pedrocarlo/pkg/file"
+	"grpc-pedrocarlo/pkg/metrics"
+	"grpc-pedrocarlo/pkg/storage"
+	"grpc-pedrocarlo/pkg/utils"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Files fetched from the database per scrub batch
+const scrubBatchSize = 100
+
+// Size of the reads done while hashing, also the granularity of the throttling
+const scrubReadSize = 64 * 1024
+
+var publishScrubOnce sync.Once
+
+type ScrubStats struct {
+	FilesScrubbed int64
+	BytesScrubbed int64
+	Corrupted     int64
+	Missing       int64
+	Failed        int64 // Files that could not be hashed, tried again in the next pass
+	Passes        int64
+	Current       string // File being hashed, empty when idle
+}
+
+// Scrubber slowly re-hashes every stored file, at most once per Interval, and
+// quarantines the files whose bytes do not match file_hash anymore.
+type Scrubber struct {
+	Db_conn  *db.Store
+	Rate     int64         // Bytes per second read from disk
+	Interval time.Duration // Minimum time between two scrubs of the same file
+
+	mu    sync.Mutex
+	stats ScrubStats
+}
+
+func (s *Scrubber) Stats() ScrubStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+func (s *Scrubber) update(f func(stats *ScrubStats)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(&s.stats)
+}
+
+// Runs the scrubber until ctx is done. Stats are published in expvar as "scrub".
+func (s *Scrubber) Run(ctx context.Context) {
+	publishScrubOnce.Do(func() {
+		expvar.Publish("scrub", expvar.Func(func() any { return s.Stats() }))
+	})
+	utils.Log_trace(fmt.Sprintf("Starting scrubber at %d bytes/s every %s", s.Rate, s.Interval))
+	scrubbed_in_pass := 0
+	for {
+		before := int(time.Now().Add(-s.Interval).Unix())
+		files, err := db.QueryScrubCandidates(s.Db_conn, before, scrubBatchSize)
+		if err != nil {
+			utils.Log_trace(fmt.Sprintf("Scrubber query failed: %v", err))
+		}
+		if len(files) == 0 {
+			if scrubbed_in_pass > 0 {
+				utils.Log_trace(fmt.Sprintf("Scrubber finished pass over %d files", scrubbed_in_pass))
+				s.update(func(stats *ScrubStats) { stats.Passes++ })
+				scrubbed_in_pass = 0
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(min(s.Interval, time.Hour)):
+			}
+			continue
+		}
+		for i := range files {
+			if ctx.Err() != nil {
+				return
+			}
+			err := s.scrubFile(ctx, &files[i])
+			if err != nil && ctx.Err() == nil {
+				utils.Log_trace(fmt.Sprintf("Scrubber failed on %s: %v", metadataPath(&files[i]), err))
+				s.update(func(stats *ScrubStats) { stats.Failed++ })
+				// Otherwise the file heads every batch and the scrubber never moves on
+				err = db.UpdateScrubbedAt(s.Db_conn, files[i].Id, int(time.Now().Unix()))
+				if err != nil {
+					utils.Log_trace(fmt.Sprintf("Scrubber failed to skip %s: %v", metadataPath(&files[i]), err))
+				}
+			}
+			scrubbed_in_pass++
+		}
+	}
+}
+
+func (s *Scrubber) scrubFile(ctx context.Context, file_meta *db.FileMetadata) error {
+	path := metadataPath(file_meta)
+	s.update(func(stats *ScrubStats) { stats.Current = path })
+	defer s.update(func(stats *ScrubStats) { stats.Current = "" })
+
+	hash, err := s.hashFile(ctx, file_meta)
+	if os.IsNotExist(err) {
+		// Left for fsck, there is nothing to quarantine
+		utils.Log_trace(fmt.Sprintf("Scrubber found missing file %s", path))
+		s.update(func(stats *ScrubStats) { stats.Missing++ })
+		return db.UpdateScrubbedAt(s.Db_conn, file_meta.Id, int(time.Now().Unix()))
+	}
+	if errors.Is(err, storage.ErrCorrupted) {
+		// Damaged compressed or encrypted data can't be hashed
+		hash = err.Error()
+	} else if err != nil {
+		return err
+	}
+	if hash == file_meta.Filehash {
+		return db.UpdateScrubbedAt(s.Db_conn, file_meta.Id, int(time.Now().Unix()))
+	}
+
+	quarantined, err := quarantine(s.Db_conn, file_meta)
+	if err != nil || !quarantined {
+		return err
+	}
+	utils.Log_trace(fmt.Sprintf("Scrubber quarantined corrupted file %s: expected %s got %s", path, file_meta.Filehash, hash))
+	s.update(func(stats *ScrubStats) { stats.Corrupted++ })
+	metrics.HASH_MISMATCHES.WithLabelValues("scrub").Inc()
+	return nil
+}
+
+// Marks the file as quarantined and moves its blob away, unless an upload
+// replaced it since it was hashed. The blob is moved before the transaction
+// commits, an upload replacing the file waits for it and its new blob is
+// never the one moved.
+func quarantine(conn *db.Store, file_meta *db.FileMetadata) (bool, error) {
+	tx, err := conn.Beginx()
+	if err != nil {
+		return false, err
+	}
+	quarantined, err := db.QuarantineFile(tx, file_meta.Id, file_meta.Filehash, file_meta.Timestamp)
+	if err != nil || !quarantined {
+		tx.Rollback()
+		return false, err
+	}
+	if file_meta.Chunked == 1 {
+		// Chunks may be shared with other files, they stay where they are
+		return true, tx.Commit()
+	}
+	new_path, err := moveToQuarantine(file_meta)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		// The row still points at the blob
+		os.Rename(new_path, db.GetFilePath(file_meta))
+		return false, err
+	}
+	return true, nil
+}
+
+// Hashes the original bytes of the stored file, throttled to s.Rate
+func (s *Scrubber) hashFile(ctx context.Context, file_meta *db.FileMetadata) (string, error) {
+	file, err := storage.Open(s.Db_conn, file_meta)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	n, err := io.Copy(hasher, &throttledReader{ctx: ctx, r: file, rate: s.Rate, start: time.Now()})
+	s.update(func(stats *ScrubStats) { stats.BytesScrubbed += n })
+	if err != nil {
+		return "", err
+	}
+	s.update(func(stats *ScrubStats) { stats.FilesScrubbed++ })
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func moveToQuarantine(file_meta *db.FileMetadata) (string, error) {
+	new_path := filepath.Join(db.QUARANTINE_DIR, file_meta.Folder, fmt.Sprintf("%s.%d", file_meta.Filename, time.Now().Unix()))
+	err := os.MkdirAll(filepath.Dir(new_path), 0755)
+	if err != nil {
+		return "", err
+	}
+	return new_path, os.Rename(db.GetFilePath(file_meta), new_path)
+}
+
+// Reader that does not go over rate bytes per second since start
+type throttledReader struct {
+	ctx   context.Context
+	r     io.Reader
+	rate  int64
+	start time.Time
+	read  int64
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if err := t.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if len(p) > scrubReadSize {
+		p = p[:scrubReadSize]
+	}
+	n, err := t.r.Read(p)
+	t.read += int64(n)
+	if t.rate > 0 {
+		expected := time.Duration(float64(t.read) / float64(t.rate) * float64(time.Second))
+		if wait := expected - time.Since(t.start); wait > 0 {
+			select {
+			case <-t.ctx.Done():
+				return n, t.ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+	}
+	return n, err
+}
+
+func ScrubStatsToFilesyncScrubStatusResponse(s *Scrubber, quarantined []db.FileMetadata) *filesync.ScrubStatusResponse {
+	files := make([]*filesync.FileMetadata, 0, len(quarantined))
+	for i := range quarantined {
+		files = append(files, DbFileMetadataToFilesyncFileMetadata(&quarantined[i]))
+	}
+	response := &filesync.ScrubStatusResponse{Quarantined: files}
+	if s == nil {
+		return response
+	}
+	stats := s.Stats()
+	response.Enabled = true
+	response.Rate = s.Rate
+	response.FilesScrubbed = stats.FilesScrubbed
+	response.BytesScrubbed = stats.BytesScrubbed
+	response.Corrupted = stats.Corrupted
+	response.Missing = stats.Missing
+	response.Failed = stats.Failed
+	response.Passes = stats.Passes
+	response.Current = stats.Current
+	return response
+}
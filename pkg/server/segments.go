@@ -0,0 +1,219 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"grpc-pedrocarlo/pkg/db"
+	filesync "grpc-pedrocarlo/pkg/file"
+	"grpc-pedrocarlo/pkg/storage"
+	"grpc-pedrocarlo/pkg/tracing"
+	"grpc-pedrocarlo/pkg/utils"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var (
+	errBadUploadId = errors.New("upload id must be 32 hex digits")
+	errBadRange    = errors.New("invalid byte range")
+	errSizeChanged = errors.New("uploaded segments do not add up to the file size")
+)
+
+// Segments of an upload are written into this temp file until it is
+// committed, stale ones are removed by the janitor like any temp file
+func uploadPath(upload_id string) (string, error) {
+	if len(upload_id) != 32 || strings.Trim(upload_id, "0123456789abcdef") != "" {
+		return "", fmt.Errorf("%w: %q", errBadUploadId, upload_id)
+	}
+	name := strings.Replace(utils.TEMP_PATTERN, "*", "upload-"+upload_id, 1)
+	return filepath.Join(db.TEMP_DIR, name), nil
+}
+
+// DownloadRange implements filesync.FileSyncServer.
+// The first message holds the hash of the whole file.
+func (s *FileSyncServer) DownloadRange(request *filesync.RangeRequest, stream filesync.FileSync_DownloadRangeServer) error {
+	utils.Log_trace(fmt.Sprintf("Received Download Range request for %d bytes from %d", request.Length, request.Offset))
+	if request.Offset < 0 || request.Length < 0 {
+		return errBadRange
+	}
+	file_meta, err := db.QueryFileMetadata(s.store(stream.Context()), translateFolder(request.Folder), request.Filename)
+	if err != nil {
+		return err
+	}
+	if file_meta.Quarantined == 1 {
+		return errQuarantined
+	}
+	file, err := storage.Open(s.store(stream.Context()), file_meta)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	// Compressed and chunked files can only be read from the start
+	if seeker, ok := file.(io.Seeker); ok {
+		_, err = seeker.Seek(request.Offset, io.SeekStart)
+	} else {
+		_, err = io.CopyN(io.Discard, file, request.Offset)
+		if err == io.EOF {
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	var r io.Reader = file
+	if request.Length > 0 {
+		r = io.LimitReader(file, request.Length)
+	}
+	buf := make([]byte, MESSAGE_SIZE)
+	filehash := file_meta.Filehash
+	for done := false; !done; {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			done = true
+		} else if err != nil {
+			return err
+		}
+		err = s.Limits.Throttle(stream.Context(), n)
+		if err != nil {
+			return err
+		}
+		err = stream.Send(&filesync.FileBytesMessage{
+			Filehash: filehash,
+			Response: &filesync.FileResponse{Chunk: buf[:n], Done: done},
+		})
+		if err != nil {
+			return err
+		}
+		filehash = ""
+	}
+	return nil
+}
+
+// UploadRange implements filesync.FileSyncServer.
+// Several streams may write different ranges of the same upload at once.
+func (s *FileSyncServer) UploadRange(stream filesync.FileSync_UploadRangeServer) error {
+	message, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	path, err := uploadPath(message.UploadId)
+	if err != nil {
+		return err
+	}
+	if message.Offset < 0 {
+		return errBadRange
+	}
+	utils.Log_trace(fmt.Sprintf("Received Upload Range request for %s from %d", message.UploadId, message.Offset))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	// Segments may come over many streams, the file they make is bounded
+	max_size := s.maxFileSize()
+	offset := message.Offset
+	for {
+		if offset > max_size || int64(len(message.Chunk)) > max_size-offset {
+			return fmt.Errorf("%w: more than %d bytes", errFileTooLarge, max_size)
+		}
+		err = s.Limits.Throttle(stream.Context(), len(message.Chunk))
+		if err != nil {
+			return err
+		}
+		_, err = file.WriteAt(message.Chunk, offset)
+		if err != nil {
+			return err
+		}
+		offset += int64(len(message.Chunk))
+		message, err = stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(&filesync.RangeResponse{Bytes: offset})
+}
+
+// CommitUpload implements filesync.FileSyncServer.
+// Checks the size and hash of the reassembled file before storing it.
+func (s *FileSyncServer) CommitUpload(ctx context.Context, request *filesync.CommitUploadRequest) (*filesync.FileMetadata, error) {
+	utils.Log_trace(fmt.Sprintf("Received Commit Upload request for %s", request.UploadId))
+	path, err := uploadPath(request.UploadId)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(path)
+	folder := translateFolder(request.Folder)
+	err = checkFilename(request.Filename)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.QueryFolderByPath(s.store(ctx), folder)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	// Checked before hashing, a sparse file may claim far more than was sent
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() != request.Size {
+		return nil, fmt.Errorf("%w: %d bytes instead of %d", errSizeChanged, info.Size(), request.Size)
+	}
+	hasher := sha256.New()
+	_, span := tracing.StartChild(ctx, "hash file", attribute.Int64("filesync.bytes", request.Size))
+	size, err := io.Copy(hasher, file)
+	tracing.End(span, err)
+	if err != nil {
+		return nil, err
+	}
+	if size != request.Size {
+		return nil, fmt.Errorf("%w: %d bytes instead of %d", errSizeChanged, size, request.Size)
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	if hash != request.Filehash {
+		return nil, errHashDifferent
+	}
+	file.Close()
+	// The client gave up while the file was hashed, it will not retry this upload
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	err = commitFile(s.store(ctx), path, folder, request.Filename, hash)
+	if err != nil {
+		return nil, err
+	}
+	utils.Log_trace(fmt.Sprintf("Committed segmented upload of %s, %d bytes", request.Filename, size))
+	return &filesync.FileMetadata{Folder: folder, Filename: request.Filename, Filehash: hash}, nil
+}
+
+// AbortUpload implements filesync.FileSyncServer.
+func (s *FileSyncServer) AbortUpload(ctx context.Context, request *filesync.AbortUploadRequest) (*filesync.AbortUploadResponse, error) {
+	utils.Log_trace(fmt.Sprintf("Received Abort Upload request for %s", request.UploadId))
+	path, err := uploadPath(request.UploadId)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return &filesync.AbortUploadResponse{}, nil
+}
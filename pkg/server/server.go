@@ -8,20 +8,44 @@ import (
 	"fmt"
 	"grpc-pedrocarlo/pkg/db"
 	filesync "grpc-pedrocarlo/pkg/file"
+	"grpc-pedrocarlo/pkg/storage"
+	"grpc-pedrocarlo/pkg/tracing"
 	"grpc-pedrocarlo/pkg/utils"
 	"io"
 	"os"
 	"path/filepath"
 	"time"
 
-	"github.com/jmoiron/sqlx"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var errHashDifferent = errors.New("files hashes are not the same")
+var errQuarantined = errors.New("file is quarantined, its stored bytes are corrupted")
+
+// Bytes of file data sent in each message of a stream. Messages must stay
+// under the 4 MiB gRPC receive limit.
+var MESSAGE_SIZE = 1000000
 
 type FileSyncServer struct {
 	filesync.UnimplementedFileSyncServer
-	Db_conn *sqlx.DB
+	Db_conn           *db.Store
+	ArchiveMaxEntries int            // Entries allowed in an uploaded archive, defaults to DEFAULT_ARCHIVE_MAX_ENTRIES
+	ArchiveMaxBytes   int64          // Bytes an uploaded archive may extract to, defaults to DEFAULT_ARCHIVE_MAX_BYTES
+	Limits            *Limiter       // Throughput limits of transfers, nil for none
+	StreamLimits      *StreamLimiter // Bounds the size of uploaded files, nil for MAX_FILE_SIZE
+}
+
+// Largest file a client may upload
+func (s *FileSyncServer) maxFileSize() int64 {
+	if s.StreamLimits == nil {
+		return MAX_FILE_SIZE
+	}
+	return s.StreamLimits.Limits().MaxFileSize()
+}
+
+// Metadata store running the statements of a call in its context
+func (s *FileSyncServer) store(ctx context.Context) *db.Store {
+	return s.Db_conn.WithContext(ctx)
 }
 
 func FileSyncFileMetadataToDbFileMetadata(request *filesync.FileMetadata) *db.FileMetadata {
@@ -61,14 +85,22 @@ func (s *FileSyncServer) FileDownload(request *filesync.FileMetadata, stream fil
 		return errors.New("nil file_meta")
 	}
 	request.Folder = translateFolder(request.Folder)
-	dbFileMeta := FileSyncFileMetadataToDbFileMetadata(request)
+	// The stored row tells how the bytes are stored
+	dbFileMeta, err := db.QueryFileMetadata(s.store(stream.Context()), request.Folder, request.Filename)
+	if err != nil {
+		return err
+	}
 	utils.Log_trace(fmt.Sprintf("DB File meta: %+v", dbFileMeta))
-	file, err := db.GetFile(dbFileMeta)
+	if dbFileMeta.Quarantined == 1 {
+		return errQuarantined
+	}
+	file, err := storage.Open(s.store(stream.Context()), dbFileMeta)
 	if err != nil {
 		return err
 	}
+	defer file.Close()
 
-	temp_file, err := os.CreateTemp(db.TEMP_DIR, "*")
+	temp_file, err := os.CreateTemp(db.TEMP_DIR, utils.TEMP_PATTERN)
 	path := temp_file.Name()
 	utils.Log_trace(fmt.Sprintf("Created temp file: %s", path))
 	defer temp_file.Close()
@@ -86,8 +118,7 @@ func (s *FileSyncServer) FileDownload(request *filesync.FileMetadata, stream fil
 	}
 
 	bytesRead := 0
-	mb := 1000000
-	buf := make([]byte, mb)
+	buf := make([]byte, MESSAGE_SIZE)
 	var done bool = false
 	utils.Log_trace("Starting File Download request")
 	for !done {
@@ -103,12 +134,19 @@ func (s *FileSyncServer) FileDownload(request *filesync.FileMetadata, stream fil
 		if done && n == 0 {
 			buf = make([]byte, 0)
 		}
-		stream.Send(&filesync.FileBytesMessage{
+		err = s.Limits.Throttle(stream.Context(), n)
+		if err != nil {
+			return err
+		}
+		err = stream.Send(&filesync.FileBytesMessage{
 			Folder:   request.Folder,
 			Filename: request.Filename,
-			Filehash: request.Filehash,
+			Filehash: dbFileMeta.Filehash,
 			Response: &filesync.FileResponse{Chunk: buf[:n], Done: done},
 		})
+		if err != nil {
+			return err
+		}
 	}
 	utils.Log_trace("Finished File Download request")
 	return nil
@@ -126,11 +164,11 @@ func (s *FileSyncServer) FileList(ctx context.Context, request *filesync.FileLis
 	// Not sanitizing or cleaning request.FolderName
 	// Assuming for now it is good
 	request.ParentFolder = translateFolder(request.ParentFolder)
-	_, err := db.QueryFolder(s.Db_conn, request.ParentFolder, request.FolderName)
+	_, err := db.QueryFolder(s.store(ctx), request.ParentFolder, request.FolderName)
 	if err != nil {
 		return nil, err
 	}
-	files, err := db.QueryFilesFolder(s.Db_conn, request.ParentFolder, request.FolderName)
+	files, err := db.QueryFilesFolder(s.store(ctx), request.ParentFolder, request.FolderName)
 	if err != nil {
 		return nil, err
 	}
@@ -144,7 +182,7 @@ func (s *FileSyncServer) FileList(ctx context.Context, request *filesync.FileLis
 func (s *FileSyncServer) FileUpload(stream filesync.FileSync_FileUploadServer) error {
 	utils.Log_trace("Received File Upload request")
 	// Create a temp File with random str as filename
-	file, err := os.CreateTemp(db.TEMP_DIR, "*")
+	file, err := os.CreateTemp(db.TEMP_DIR, utils.TEMP_PATTERN)
 	path := file.Name()
 	utils.Log_trace(fmt.Sprintf("Created temp file: %s", path))
 	defer file.Close()
@@ -154,15 +192,19 @@ func (s *FileSyncServer) FileUpload(stream filesync.FileSync_FileUploadServer) e
 	}
 	var done bool = false
 	var res *filesync.FileBytesMessage
-	// TODO implement timeout here as well
+	// A stalled client is cut off by StreamLimits
 	for !done {
 		res, err = stream.Recv()
 		if err != nil {
 			return err
 		}
+		err = s.Limits.Throttle(stream.Context(), len(res.Response.Chunk))
+		if err != nil {
+			return err
+		}
 		res.Folder = translateFolder(res.Folder)
 		// Check if folder exists
-		_, err := db.QueryFolder(s.Db_conn, filepath.Dir(res.Folder), filepath.Base(res.Folder))
+		_, err := db.QueryFolder(s.store(stream.Context()), filepath.Dir(res.Folder), filepath.Base(res.Folder))
 		if err != nil {
 			return err
 		}
@@ -172,7 +214,6 @@ func (s *FileSyncServer) FileUpload(stream filesync.FileSync_FileUploadServer) e
 		}
 		done = res.Response.Done
 	}
-	new_path := filepath.Join(db.DB_FILES_DIR, res.Folder, res.Filename)
 	// Check hash of file
 	hasher := sha256.New()
 	file.Seek(0, io.SeekStart)
@@ -186,19 +227,39 @@ func (s *FileSyncServer) FileUpload(stream filesync.FileSync_FileUploadServer) e
 		return errHashDifferent
 	}
 	file.Close()
-	utils.Log_trace("Beginning Db Transaction")
-	tx, err := s.Db_conn.Beginx()
+	err = commitFile(s.store(stream.Context()), path, res.Folder, res.Filename, hash)
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
-	utils.Log_trace("Inserting File to Db")
-	err = db.InsertFile(tx, &db.FileMetadata{
-		Folder:    res.Folder,
-		Filename:  res.Filename,
+	utils.Log_trace(fmt.Sprintf("Finished download of file %s", res.Filename))
+	return nil
+}
+
+// Moves the verified temp file at path to its place in DB_FILES_DIR and
+// records it in files_metadata
+func commitFile(conn *db.Store, path string, folder string, filename string, hash string) error {
+	new_path := filepath.Join(db.DB_FILES_DIR, folder, filename)
+	file_meta := &db.FileMetadata{
+		Folder:    folder,
+		Filename:  filename,
 		Filehash:  hash,
 		Timestamp: int(time.Now().Unix()),
-	})
+	}
+	// Compresses and encrypts the file in place
+	_, span := tracing.StartChild(conn.Context(), "prepare file")
+	err := storage.Prepare(path, &file_meta.StoredBlob)
+	span.SetAttributes(attribute.String("filesync.codec", file_meta.Codec), attribute.Int64("filesync.bytes", file_meta.FileSize))
+	tracing.End(span, err)
+	if err != nil {
+		return err
+	}
+	utils.Log_trace("Beginning Db Transaction")
+	tx, err := conn.Beginx()
+	if err != nil {
+		return err
+	}
+	utils.Log_trace("Inserting File to Db")
+	err = db.InsertFile(tx, file_meta)
 	if err != nil {
 		tx.Rollback()
 		return err
@@ -215,7 +276,6 @@ func (s *FileSyncServer) FileUpload(stream filesync.FileSync_FileUploadServer) e
 		tx.Rollback()
 		return err
 	}
-	utils.Log_trace(fmt.Sprintf("Finished download of file %s", res.Filename))
 	return nil
 }
 
@@ -225,7 +285,7 @@ func (s *FileSyncServer) MkDir(ctx context.Context, dir_meta *filesync.MkdirRequ
 		return nil, errors.New("nil dir_meta")
 	}
 	dir_meta.Folder = translateFolder(dir_meta.Folder)
-	tx, err := s.Db_conn.Beginx()
+	tx, err := s.store(ctx).Beginx()
 	if err != nil {
 		tx.Rollback()
 		return nil, err
@@ -236,7 +296,7 @@ func (s *FileSyncServer) MkDir(ctx context.Context, dir_meta *filesync.MkdirRequ
 		return nil, err
 	}
 	tx.Commit()
-	db_dir_meta, err := db.QueryFolder(s.Db_conn, filepath.Dir(dir_meta.Folder), filepath.Base(dir_meta.Folder))
+	db_dir_meta, err := db.QueryFolder(s.store(ctx), filepath.Dir(dir_meta.Folder), filepath.Base(dir_meta.Folder))
 	if err != nil {
 		return nil, err
 	}
@@ -252,20 +312,29 @@ func (s *FileSyncServer) RemoveFile(ctx context.Context, request *filesync.Remov
 	if request == nil {
 		return nil, errors.New("request is nil")
 	}
-	tx, err := s.Db_conn.Beginx()
+	file_meta, err := db.QueryFileMetadata(s.store(ctx), translateFolder(request.Folder), request.Filename)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := s.store(ctx).Beginx()
 	if err != nil {
 		return nil, err
 	}
-	err = db.RemoveFile(s.Db_conn, tx, request.Folder, request.Filename)
+	defer tx.Rollback()
+	err = db.RemoveFile(s.store(ctx), tx, request.Folder, request.Filename)
 	if err != nil {
 		return nil, err
 	}
+	// Chunks are left to the janitor, other files may share them
 	path := filepath.Join(db.DB_FILES_DIR, request.Folder, request.Filename)
 	err = os.Remove(path)
+	if err != nil && !(file_meta.Chunked == 1 && os.IsNotExist(err)) {
+		return nil, err
+	}
+	err = tx.Commit()
 	if err != nil {
 		return nil, err
 	}
-	tx.Commit()
 	return &filesync.RemoveFileResponse{}, nil
 }
 
@@ -277,22 +346,23 @@ func (s *FileSyncServer) RemoveDir(ctx context.Context, request *filesync.Remove
 	if request.Folder == db.ROOT_FOLDER {
 		return nil, errors.New("cannot remove root folder")
 	}
-	tx, err := s.Db_conn.Beginx()
+	tx, err := s.store(ctx).Beginx()
 	if err != nil {
-		tx.Rollback()
 		return nil, err
 	}
-	err = db.RemoveFolder(s.Db_conn, tx, request.Folder)
+	defer tx.Rollback()
+	err = db.RemoveFolder(s.store(ctx), tx, request.Folder)
 	if err != nil {
-		tx.Rollback()
 		return nil, err
 	}
 	path := filepath.Join(db.DB_FILES_DIR, request.Folder)
 	err = os.Remove(path)
 	if err != nil {
-		tx.Rollback()
 		return nil, err
 	}
-	tx.Commit()
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
 	return &filesync.RemoveDirResponse{}, nil
 }
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Defaults of StreamLimits
+const (
+	DEFAULT_STREAM_IDLE_TIMEOUT = 2 * time.Minute
+	DEFAULT_STREAM_MAX_DURATION = 12 * time.Hour
+	DEFAULT_UPLOAD_MAX_BYTES    = 16 << 30
+)
+
+// Largest file accepted when MaxUploadBytes is 0. Files are also bounded
+// when they are sent over several streams.
+const MAX_FILE_SIZE = 1 << 40
+
+// Bounds of every streaming call, so a stalled or endless client does not
+// hold a goroutine and a temp file forever. 0 disables a bound.
+type StreamLimits struct {
+	IdleTimeout    time.Duration // Longest wait for the next message to be received or sent
+	MaxDuration    time.Duration // Longest a stream may stay open
+	MaxUploadBytes int64         // Bytes a client may send over one stream, and largest file accepted
+}
+
+// Largest file a client may upload, whatever the streams it is sent over
+func (l StreamLimits) MaxFileSize() int64 {
+	if l.MaxUploadBytes > 0 {
+		return min(l.MaxUploadBytes, MAX_FILE_SIZE)
+	}
+	return MAX_FILE_SIZE
+}
+
+// The handler runs on its own goroutine so a limit can end the stream while
+// the handler waits in a call: returning closes the stream, which unblocks
+// the call, and the handler then returns on its own.
+func (l StreamLimits) StreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if isHealthCheck(info.FullMethod) {
+		// Watch streams stay quiet until the status changes
+		return handler(srv, ss)
+	}
+	ctx, cancel := context.WithCancelCause(ss.Context())
+	defer cancel(nil)
+	stream := &boundedStream{ServerStream: ss, ctx: ctx, cancel: cancel, limits: l}
+	if l.MaxDuration > 0 {
+		var cancel_timeout context.CancelFunc
+		cause := status.Errorf(codes.DeadlineExceeded, "stream open for more than %s", l.MaxDuration)
+		stream.ctx, cancel_timeout = context.WithTimeoutCause(ctx, l.MaxDuration, cause)
+		defer cancel_timeout()
+	}
+	if l.IdleTimeout <= 0 && l.MaxDuration <= 0 {
+		return handler(srv, stream)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- handler(srv, stream)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-stream.ctx.Done():
+		if ss.Context().Err() != nil {
+			// The client is gone, the transport already unblocked the handler
+			return <-done
+		}
+		return stream.err()
+	}
+}
+
+// StreamLimits that can be changed while serving, streams keep the limits
+// they were opened with
+type StreamLimiter struct {
+	limits atomic.Pointer[StreamLimits]
+}
+
+func NewStreamLimiter(limits StreamLimits) *StreamLimiter {
+	l := &StreamLimiter{}
+	l.SetLimits(limits)
+	return l
+}
+
+func (l *StreamLimiter) SetLimits(limits StreamLimits) {
+	l.limits.Store(&limits)
+}
+
+func (l *StreamLimiter) Limits() StreamLimits {
+	return *l.limits.Load()
+}
+
+func (l *StreamLimiter) StreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return l.limits.Load().StreamInterceptor(srv, ss, info, handler)
+}
+
+// Ends a stream that went quiet or was open for too long by canceling the
+// context the handler sees, calls made after that fail right away.
+type boundedStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	cancel   context.CancelCauseFunc
+	limits   StreamLimits
+	received int64
+}
+
+func (s *boundedStream) Context() context.Context {
+	return s.ctx
+}
+
+// Status of the limit that ended the stream
+func (s *boundedStream) err() error {
+	cause := context.Cause(s.ctx)
+	if _, ok := status.FromError(cause); ok {
+		return cause
+	}
+	return status.FromContextError(s.ctx.Err()).Err()
+}
+
+func (s *boundedStream) bounded(call func() error, what string) error {
+	if s.ctx.Err() != nil {
+		return s.err()
+	}
+	if s.limits.IdleTimeout > 0 {
+		timer := time.AfterFunc(s.limits.IdleTimeout, func() {
+			s.cancel(status.Errorf(codes.DeadlineExceeded, "nothing %s for %s", what, s.limits.IdleTimeout))
+		})
+		defer timer.Stop()
+	}
+	err := call()
+	if err != nil && s.ctx.Err() != nil {
+		return s.err()
+	}
+	return err
+}
+
+func (s *boundedStream) RecvMsg(m any) error {
+	err := s.bounded(func() error { return s.ServerStream.RecvMsg(m) }, "received")
+	if err != nil {
+		return err
+	}
+	if message, ok := m.(proto.Message); ok && s.limits.MaxUploadBytes > 0 {
+		s.received += int64(proto.Size(message))
+		if s.received > s.limits.MaxUploadBytes {
+			return status.Errorf(codes.ResourceExhausted, "upload larger than %d bytes", s.limits.MaxUploadBytes)
+		}
+	}
+	return nil
+}
+
+func (s *boundedStream) SendMsg(m any) error {
+	return s.bounded(func() error { return s.ServerStream.SendMsg(m) }, "sent")
+}
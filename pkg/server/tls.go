@@ -0,0 +1,53 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"grpc-pedrocarlo/pkg/utils"
+	"sync/atomic"
+)
+
+// Serves the certificate of a pair of PEM files. Load reads them again, so a
+// renewed certificate is used by new connections without a restart while
+// established connections keep going. Load must not be called concurrently.
+type CertReloader struct {
+	cert_file string
+	key_file  string
+	cert      atomic.Pointer[tls.Certificate]
+}
+
+func NewCertReloader(cert_file string, key_file string) (*CertReloader, error) {
+	c := &CertReloader{}
+	err := c.Load(cert_file, key_file)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Switches to the certificate of the given files, the previous one is kept
+// when they can not be read
+func (c *CertReloader) Load(cert_file string, key_file string) error {
+	cert, err := tls.LoadX509KeyPair(cert_file, key_file)
+	if err != nil {
+		return fmt.Errorf("loading certificate %s: %w", cert_file, err)
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("parsing certificate %s: %w", cert_file, err)
+	}
+	c.cert_file, c.key_file = cert_file, key_file
+	c.cert.Store(&cert)
+	utils.Log_trace(fmt.Sprintf("Loaded certificate %s for %v valid until %s", cert_file, cert.Leaf.DNSNames, cert.Leaf.NotAfter))
+	return nil
+}
+
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
+
+// TLS settings of a server presenting the certificate
+func (c *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: c.GetCertificate}
+}
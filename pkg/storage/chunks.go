@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"grpc-pedrocarlo/pkg/db"
+	"grpc-pedrocarlo/pkg/utils"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Stores the temp file at path, holding the original bytes of the chunk with
+// hash, in CHUNKS_DIR. Returns false, leaving path alone, when the chunk is
+// already stored.
+func StoreChunk(conn *db.Store, path string, hash string) (bool, error) {
+	chunk := &db.ChunkMetadata{Hash: hash, CreatedAt: int(time.Now().Unix())}
+	err := Prepare(path, &chunk.StoredBlob)
+	if err != nil {
+		return false, err
+	}
+	// Only the upload that inserted the row may write the blob, another one
+	// would have encrypted it with a different key
+	tx, err := conn.Beginx()
+	if err != nil {
+		return false, err
+	}
+	inserted, err := db.InsertChunk(tx, chunk)
+	if err != nil || !inserted {
+		tx.Rollback()
+		return false, err
+	}
+	new_path := db.GetChunkPath(hash)
+	err = os.MkdirAll(filepath.Dir(new_path), 0755)
+	if err == nil {
+		err = os.Rename(path, new_path)
+	}
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// Opens a stored chunk and returns its original bytes
+func OpenChunk(chunk *db.ChunkMetadata) (io.ReadCloser, error) {
+	return openBlob(db.GetChunkPath(chunk.Hash), &chunk.StoredBlob)
+}
+
+// Removes the chunk if no file uses it, returns whether it was removed.
+// The blob is moved out of the way before the row is gone: an upload storing
+// the same chunk meanwhile waits for the transaction, then writes its own.
+func RemoveUnusedChunk(conn *db.Store, hash string) (bool, error) {
+	tx, err := conn.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	removed, err := db.RemoveUnusedChunk(tx, hash)
+	if err != nil || !removed {
+		return false, err
+	}
+	path := db.GetChunkPath(hash)
+	// Left to the janitor if removing it fails
+	trash := filepath.Join(db.TEMP_DIR, strings.Replace(utils.TEMP_PATTERN, "*", "chunk-"+hash, 1))
+	err = os.Rename(path, trash)
+	if os.IsNotExist(err) {
+		return true, tx.Commit()
+	}
+	if err != nil {
+		return false, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		// The row still points at the blob
+		os.Rename(trash, path)
+		return false, err
+	}
+	return true, os.Remove(trash)
+}
+
+// Reads the chunks of a file one after the other, checking each against its hash
+type chunkedReader struct {
+	chunks  []db.ChunkMetadata
+	current io.ReadCloser
+	hasher  hash.Hash
+}
+
+func openChunked(conn *db.Store, meta *db.FileMetadata) (io.ReadCloser, error) {
+	chunks, err := db.QueryFileChunks(conn, meta.Id)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkedReader{chunks: chunks, hasher: sha256.New()}, nil
+}
+
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	for len(r.chunks) > 0 {
+		chunk := &r.chunks[0]
+		if r.current == nil {
+			file, err := OpenChunk(chunk)
+			if os.IsNotExist(err) {
+				return 0, fmt.Errorf("%w: chunk %s is missing", ErrCorrupted, chunk.Hash)
+			}
+			if err != nil {
+				return 0, err
+			}
+			r.current = file
+			r.hasher.Reset()
+		}
+		n, err := r.current.Read(p)
+		r.hasher.Write(p[:n])
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if hex.EncodeToString(r.hasher.Sum(nil)) != chunk.Hash {
+				return n, fmt.Errorf("%w: chunk %s does not match its hash", ErrCorrupted, chunk.Hash)
+			}
+			r.chunks = r.chunks[1:]
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+	return 0, io.EOF
+}
+
+func (r *chunkedReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	return r.current.Close()
+}
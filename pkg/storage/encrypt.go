@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Encrypted blobs start with a header holding ENCRYPTION_MAGIC and the
+// segment size, followed by the segments. Each segment holds up to
+// SEGMENT_SIZE bytes sealed with AES-GCM on its own, so any range of the
+// file can be read by decrypting only the segments it overlaps. The nonce
+// of a segment is its index and the last segment is sealed with a
+// different additional data, so segments can be neither reordered nor
+// dropped. Data keys are never reused, a new one is made for every blob.
+const (
+	ENCRYPTION_MAGIC = "FSE1"
+	SEGMENT_SIZE     = 64 << 10
+)
+
+const encryptionHeaderSize = len(ENCRYPTION_MAGIC) + 4
+
+var errBadEncryptionHeader = errors.New("encrypted file has a bad header")
+
+func segmentNonce(aead cipher.AEAD, index int64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], uint64(index))
+	return nonce
+}
+
+func segmentAdditionalData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// Encrypts r into w with data_key
+func encryptSegments(w io.Writer, r io.Reader, data_key []byte) error {
+	aead, err := newGCM(data_key)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, encryptionHeaderSize)
+	copy(header, ENCRYPTION_MAGIC)
+	binary.BigEndian.PutUint32(header[len(ENCRYPTION_MAGIC):], SEGMENT_SIZE)
+	_, err = w.Write(header)
+	if err != nil {
+		return err
+	}
+	br := bufio.NewReaderSize(r, SEGMENT_SIZE)
+	plain := make([]byte, SEGMENT_SIZE)
+	sealed := make([]byte, 0, SEGMENT_SIZE+aead.Overhead())
+	for index := int64(0); ; index++ {
+		n, err := io.ReadFull(br, plain)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := n < SEGMENT_SIZE
+		if !last {
+			_, err = br.Peek(1)
+			last = err == io.EOF
+		}
+		sealed = aead.Seal(sealed[:0], segmentNonce(aead, index), plain[:n], segmentAdditionalData(last))
+		_, err = w.Write(sealed)
+		if err != nil || last {
+			return err
+		}
+	}
+}
+
+// Reads the plaintext of an encrypted blob, sequentially or at any offset
+type segmentReader struct {
+	file     *os.File
+	aead     cipher.AEAD
+	segments int64 // Number of segments in the file
+	size     int64 // Size of the plaintext
+
+	offset int64 // Of the next Read
+	index  int64 // Of the segment in plain, -1 when none was decrypted
+	plain  []byte
+}
+
+func openSegments(file *os.File, data_key []byte) (*segmentReader, error) {
+	aead, err := newGCM(data_key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, encryptionHeaderSize)
+	_, err = io.ReadFull(file, header)
+	if err != nil || string(header[:len(ENCRYPTION_MAGIC)]) != ENCRYPTION_MAGIC ||
+		binary.BigEndian.Uint32(header[len(ENCRYPTION_MAGIC):]) != SEGMENT_SIZE {
+		return nil, fmt.Errorf("%w: %w", ErrCorrupted, errBadEncryptionHeader)
+	}
+	sealed_size := int64(SEGMENT_SIZE + aead.Overhead())
+	body := info.Size() - int64(encryptionHeaderSize)
+	segments := (body + sealed_size - 1) / sealed_size
+	if segments == 0 || body-(segments-1)*sealed_size < int64(aead.Overhead()) {
+		return nil, fmt.Errorf("%w: encrypted file is truncated", ErrCorrupted)
+	}
+	return &segmentReader{
+		file:     file,
+		aead:     aead,
+		segments: segments,
+		size:     body - segments*int64(aead.Overhead()),
+		index:    -1,
+		plain:    make([]byte, 0, SEGMENT_SIZE),
+	}, nil
+}
+
+// Size of the plaintext
+func (r *segmentReader) Size() int64 {
+	return r.size
+}
+
+func (r *segmentReader) decrypt(index int64) error {
+	if index == r.index {
+		return nil
+	}
+	sealed_size := int64(SEGMENT_SIZE + r.aead.Overhead())
+	sealed := make([]byte, sealed_size)
+	n, err := r.file.ReadAt(sealed, int64(encryptionHeaderSize)+index*sealed_size)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	r.index = -1
+	r.plain, err = r.aead.Open(r.plain[:0], segmentNonce(r.aead, index), sealed[:n], segmentAdditionalData(index == r.segments-1))
+	if err != nil {
+		return fmt.Errorf("%w: segment %d: %v", ErrCorrupted, index, err)
+	}
+	r.index = index
+	return nil
+}
+
+func (r *segmentReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	read := 0
+	for read < len(p) {
+		if off >= r.size {
+			return read, io.EOF
+		}
+		err := r.decrypt(off / SEGMENT_SIZE)
+		if err != nil {
+			return read, err
+		}
+		n := copy(p[read:], r.plain[off%SEGMENT_SIZE:])
+		read += n
+		off += int64(n)
+	}
+	return read, nil
+}
+
+func (r *segmentReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	// Never more than the current segment, like a plain file would
+	p = p[:min(int64(len(p)), SEGMENT_SIZE-r.offset%SEGMENT_SIZE)]
+	n, err := r.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *segmentReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *segmentReader) Close() error {
+	return r.file.Close()
+}
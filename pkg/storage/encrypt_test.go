@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	mrand "math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newDataKey(t *testing.T) []byte {
+	data_key := make([]byte, KEY_SIZE)
+	_, err := rand.Read(data_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data_key
+}
+
+// Encrypts data into a file of the test's temp dir and returns its path
+func encryptToFile(t *testing.T, data []byte, data_key []byte) string {
+	path := filepath.Join(t.TempDir(), "blob")
+	var sealed bytes.Buffer
+	err := encryptSegments(&sealed, bytes.NewReader(data), data_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, sealed.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func openSegmentsAt(t *testing.T, path string, data_key []byte) (*segmentReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := openSegments(file, data_key)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	t.Cleanup(func() { r.Close() })
+	return r, nil
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	sizes := []int{0, 1, SEGMENT_SIZE - 1, SEGMENT_SIZE, SEGMENT_SIZE + 1, 3*SEGMENT_SIZE + 100}
+	for _, size := range sizes {
+		data := make([]byte, size)
+		mrand.New(mrand.NewSource(int64(size))).Read(data)
+		data_key := newDataKey(t)
+		r, err := openSegmentsAt(t, encryptToFile(t, data, data_key), data_key)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if r.Size() != int64(size) {
+			t.Errorf("%d bytes: Size is %d", size, r.Size())
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%d bytes: read back different bytes", size)
+		}
+	}
+}
+
+func TestEncryptReadAt(t *testing.T) {
+	data := make([]byte, 3*SEGMENT_SIZE+100)
+	mrand.New(mrand.NewSource(1)).Read(data)
+	data_key := newDataKey(t)
+	r, err := openSegmentsAt(t, encryptToFile(t, data, data_key), data_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		offset int64
+		length int
+	}{
+		{"start", 0, 10},
+		{"within a segment", 100, 1000},
+		{"across segments", SEGMENT_SIZE - 10, 20},
+		{"across several segments", 10, 2*SEGMENT_SIZE + 50},
+		{"last segment", 3 * SEGMENT_SIZE, 100},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := make([]byte, test.length)
+			n, err := r.ReadAt(p, test.offset)
+			if err != nil || n != test.length {
+				t.Fatalf("read %d bytes, err %v", n, err)
+			}
+			if !bytes.Equal(p, data[test.offset:test.offset+int64(test.length)]) {
+				t.Error("read different bytes")
+			}
+		})
+	}
+
+	p := make([]byte, 200)
+	n, err := r.ReadAt(p, int64(len(data))-50)
+	if n != 50 || err != io.EOF {
+		t.Errorf("read past the end: %d bytes, err %v, want 50 and EOF", n, err)
+	}
+}
+
+func TestEncryptTamper(t *testing.T) {
+	data := make([]byte, 2*SEGMENT_SIZE+100)
+	mrand.New(mrand.NewSource(2)).Read(data)
+	data_key := newDataKey(t)
+	var sealed bytes.Buffer
+	err := encryptSegments(&sealed, bytes.NewReader(data), data_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed_size := SEGMENT_SIZE + 16
+
+	tests := []struct {
+		name   string
+		tamper func(b []byte) []byte
+		key    []byte
+	}{
+		{"flipped byte", func(b []byte) []byte { b[encryptionHeaderSize+100] ^= 1; return b }, data_key},
+		{"flipped tag", func(b []byte) []byte { b[len(b)-1] ^= 1; return b }, data_key},
+		{"dropped last segment", func(b []byte) []byte { return b[:encryptionHeaderSize+2*sealed_size] }, data_key},
+		{"truncated", func(b []byte) []byte { return b[:len(b)-10] }, data_key},
+		{"swapped segments", func(b []byte) []byte {
+			first := append([]byte{}, b[encryptionHeaderSize:encryptionHeaderSize+sealed_size]...)
+			copy(b[encryptionHeaderSize:], b[encryptionHeaderSize+sealed_size:encryptionHeaderSize+2*sealed_size])
+			copy(b[encryptionHeaderSize+sealed_size:], first)
+			return b
+		}, data_key},
+		{"bad magic", func(b []byte) []byte { b[0] = 'X'; return b }, data_key},
+		{"bad segment size", func(b []byte) []byte { b[len(ENCRYPTION_MAGIC)] = 1; return b }, data_key},
+		{"header only", func(b []byte) []byte { return b[:encryptionHeaderSize] }, data_key},
+		{"wrong key", func(b []byte) []byte { return b }, newDataKey(t)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "blob")
+			err := os.WriteFile(path, test.tamper(bytes.Clone(sealed.Bytes())), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := openSegmentsAt(t, path, test.key)
+			if err == nil {
+				_, err = io.ReadAll(r)
+			}
+			if !errors.Is(err, ErrCorrupted) {
+				t.Errorf("got %v, want ErrCorrupted", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,305 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"grpc-pedrocarlo/pkg/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Size in bytes of master and data keys, AES-256
+const KEY_SIZE = 32
+
+// Master keys replaced by a rotation are kept at least this long. A server
+// may have wrapped a data key with the old key just before the rotation and
+// only commit the file afterwards, the key is only removed once it is no
+// longer used past this delay.
+const KEY_RETIRE_GRACE = 7 * 24 * time.Hour
+
+var (
+	errKeyFileExists = errors.New("key file already exists")
+	errUnknownKey    = errors.New("unknown master key")
+	errBadKeyFile    = errors.New("malformed key file")
+	errBadWrappedKey = errors.New("malformed wrapped data key")
+)
+
+// Master keys loaded from a key file. Each line of the file holds the id of
+// a key, the key encoded in base64 and, once it was replaced, when it was
+// retired. The last key wraps new data keys and the others are kept to
+// unwrap data keys not rotated yet.
+// The file is read again whenever it changes, so keys rotated by another
+// process are picked up by a running server.
+type Keyring struct {
+	path string
+
+	mu      sync.Mutex
+	modtime time.Time
+	size    int64
+	ids     []string
+	keys    map[string][]byte
+	retired map[string]time.Time // Of the keys replaced by a rotation
+}
+
+// Loads the key file at path, which must exist
+func LoadKeyring(path string) (*Keyring, error) {
+	k := &Keyring{path: path}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k, k.reload()
+}
+
+// Creates the key file at path with a new master key and returns its id
+func CreateKeyFile(path string) (string, error) {
+	_, err := os.Stat(path)
+	if err == nil {
+		return "", fmt.Errorf("%w: %s", errKeyFileExists, path)
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	id, key, err := newKey()
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return "", err
+	}
+	return id, writeKeyFile(path, []string{id}, map[string][]byte{id: key}, nil)
+}
+
+func newKey() (string, []byte, error) {
+	id := make([]byte, 8)
+	key := make([]byte, KEY_SIZE)
+	_, err := rand.Read(id)
+	if err == nil {
+		_, err = rand.Read(key)
+	}
+	return hex.EncodeToString(id), key, err
+}
+
+// Reads the key file again if it changed. Must hold k.mu
+func (k *Keyring) reload() error {
+	info, err := os.Stat(k.path)
+	if err != nil {
+		return err
+	}
+	if k.keys != nil && info.ModTime().Equal(k.modtime) && info.Size() == k.size {
+		return nil
+	}
+	file, err := os.Open(k.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	ids := []string{}
+	keys := map[string][]byte{}
+	retired := map[string]time.Time{}
+	scanner := bufio.NewScanner(file)
+	for line_number := 1; scanner.Scan(); line_number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 && len(fields) != 3 {
+			return fmt.Errorf("%w %s: line %d", errBadKeyFile, k.path, line_number)
+		}
+		if len(fields) == 3 {
+			retired_at, err := time.Parse(time.RFC3339, fields[2])
+			if err != nil {
+				return fmt.Errorf("%w %s: line %d has no valid retirement time", errBadKeyFile, k.path, line_number)
+			}
+			retired[fields[0]] = retired_at
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != KEY_SIZE {
+			return fmt.Errorf("%w %s: line %d does not hold a %d bytes key", errBadKeyFile, k.path, line_number, KEY_SIZE)
+		}
+		ids = append(ids, fields[0])
+		keys[fields[0]] = key
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("%w %s: no keys", errBadKeyFile, k.path)
+	}
+	k.ids, k.keys, k.retired, k.modtime, k.size = ids, keys, retired, info.ModTime(), info.Size()
+	return nil
+}
+
+// Writes the key file atomically, readable only by its owner
+func writeKeyFile(path string, ids []string, keys map[string][]byte, retired map[string]time.Time) error {
+	temp_file, err := os.CreateTemp(filepath.Dir(path), utils.TEMP_PATTERN)
+	if err != nil {
+		return err
+	}
+	defer temp_file.Close()
+	defer os.Remove(temp_file.Name())
+	err = temp_file.Chmod(0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(temp_file)
+	fmt.Fprintln(w, "# Master keys of the stored files, the last one wraps new data keys. Keep a backup.")
+	for _, id := range ids {
+		line := id + " " + base64.StdEncoding.EncodeToString(keys[id])
+		if retired_at, ok := retired[id]; ok {
+			line += " " + retired_at.UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintln(w, line)
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	err = temp_file.Sync()
+	if err != nil {
+		return err
+	}
+	err = temp_file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp_file.Name(), path)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Returns the id of the master key wrapping new data keys
+func (k *Keyring) Current() (string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	err := k.reload()
+	if err != nil {
+		return "", err
+	}
+	return k.ids[len(k.ids)-1], nil
+}
+
+// Wraps data_key with the current master key
+func (k *Keyring) Wrap(data_key []byte) (key_id string, wrapped string, err error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	err = k.reload()
+	if err != nil {
+		return "", "", err
+	}
+	key_id = k.ids[len(k.ids)-1]
+	aead, err := newGCM(k.keys[key_id])
+	if err != nil {
+		return "", "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", "", err
+	}
+	sealed := aead.Seal(nonce, nonce, data_key, []byte(key_id))
+	return key_id, base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Unwraps a data key wrapped by the master key key_id
+func (k *Keyring) Unwrap(key_id string, wrapped string) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	err := k.reload()
+	if err != nil {
+		return nil, err
+	}
+	key, ok := k.keys[key_id]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", errUnknownKey, key_id)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, errBadWrappedKey
+	}
+	data_key, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(key_id))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadWrappedKey, err)
+	}
+	return data_key, nil
+}
+
+// Adds a new master key that wraps new data keys from now on and returns its id
+func (k *Keyring) Rotate() (string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	err := k.reload()
+	if err != nil {
+		return "", err
+	}
+	id, key, err := newKey()
+	if err != nil {
+		return "", err
+	}
+	keys := map[string][]byte{id: key}
+	retired := map[string]time.Time{}
+	for old_id, old_key := range k.keys {
+		keys[old_id] = old_key
+		retired[old_id] = time.Now()
+		if retired_at, ok := k.retired[old_id]; ok {
+			retired[old_id] = retired_at
+		}
+	}
+	err = writeKeyFile(k.path, append(k.ids[:len(k.ids):len(k.ids)], id), keys, retired)
+	if err != nil {
+		return "", err
+	}
+	return id, k.reload()
+}
+
+// Removes the master keys retired before retired_before that are not in
+// in_use and returns their ids
+func (k *Keyring) Prune(in_use []string, retired_before time.Time) ([]string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	err := k.reload()
+	if err != nil {
+		return nil, err
+	}
+	keep := map[string]bool{k.ids[len(k.ids)-1]: true}
+	for _, id := range in_use {
+		keep[id] = true
+	}
+	ids := []string{}
+	removed := []string{}
+	for _, id := range k.ids {
+		retired_at, ok := k.retired[id]
+		if keep[id] || !ok || !retired_at.Before(retired_before) {
+			ids = append(ids, id)
+		} else {
+			removed = append(removed, id)
+		}
+	}
+	if len(removed) == 0 {
+		return removed, nil
+	}
+	err = writeKeyFile(k.path, ids, k.keys, k.retired)
+	if err != nil {
+		return nil, err
+	}
+	return removed, k.reload()
+}
@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newKeyring(t *testing.T) (*Keyring, string) {
+	path := filepath.Join(t.TempDir(), "master.key")
+	_, err := CreateKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadKeyring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys, path
+}
+
+func TestCreateKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "master.key")
+	id, err := CreateKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("key file mode is %v, want 0600", info.Mode().Perm())
+	}
+	keys, err := LoadKeyring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := keys.Current()
+	if err != nil || current != id {
+		t.Errorf("current key is %q, err %v, want %q", current, err, id)
+	}
+	_, err = CreateKeyFile(path)
+	if !errors.Is(err, errKeyFileExists) {
+		t.Errorf("creating over an existing file: got %v, want errKeyFileExists", err)
+	}
+}
+
+func TestWrapUnwrap(t *testing.T) {
+	keys, _ := newKeyring(t)
+	data_key := newDataKey(t)
+	key_id, wrapped, err := keys.Wrap(data_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := keys.Unwrap(key_id, wrapped)
+	if err != nil || !bytes.Equal(got, data_key) {
+		t.Fatalf("unwrapped %x, err %v, want %x", got, err, data_key)
+	}
+
+	tampered := []byte(wrapped)
+	if tampered[10] == 'A' {
+		tampered[10] = 'B'
+	} else {
+		tampered[10] = 'A'
+	}
+	tests := []struct {
+		name    string
+		key_id  string
+		wrapped string
+		want    error
+	}{
+		{"unknown key", "0000000000000000", wrapped, errUnknownKey},
+		{"tampered", key_id, string(tampered), errBadWrappedKey},
+		{"not base64", key_id, "not base64!", errBadWrappedKey},
+		{"too short", key_id, "AAAA", errBadWrappedKey},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := keys.Unwrap(test.key_id, test.wrapped)
+			if !errors.Is(err, test.want) {
+				t.Errorf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestRotate(t *testing.T) {
+	keys, path := newKeyring(t)
+	data_key := newDataKey(t)
+	old_id, wrapped, err := keys.Wrap(data_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	new_id, err := keys.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if new_id == old_id {
+		t.Fatal("rotation kept the same key id")
+	}
+	current, _ := keys.Current()
+	if current != new_id {
+		t.Errorf("current key is %q after rotating, want %q", current, new_id)
+	}
+	key_id, _, err := keys.Wrap(data_key)
+	if err != nil || key_id != new_id {
+		t.Errorf("wrapped with %q, err %v, want %q", key_id, err, new_id)
+	}
+
+	// Another process loading the file sees the rotation and the old key
+	reloaded, err := LoadKeyring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := reloaded.Unwrap(old_id, wrapped)
+	if err != nil || !bytes.Equal(got, data_key) {
+		t.Errorf("unwrapping with the retired key: %x, err %v", got, err)
+	}
+	current, _ = reloaded.Current()
+	if current != new_id {
+		t.Errorf("reloaded current key is %q, want %q", current, new_id)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	tests := []struct {
+		name    string
+		in_use  func(first string) []string
+		before  time.Duration // retired_before relative to now
+		removed bool          // Whether the first key is removed
+	}{
+		{"unused and past the grace", func(string) []string { return nil }, time.Hour, true},
+		{"in use", func(first string) []string { return []string{first} }, time.Hour, false},
+		{"within the grace", func(string) []string { return nil }, -time.Hour, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keys, _ := newKeyring(t)
+			first, _ := keys.Current()
+			current, err := keys.Rotate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			removed, err := keys.Prune(test.in_use(first), time.Now().Add(test.before))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.removed != (strings.Join(removed, ",") == first) {
+				t.Errorf("removed %v, first key is %q", removed, first)
+			}
+			_, err = keys.Unwrap(first, "AAAA")
+			if test.removed != errors.Is(err, errUnknownKey) {
+				t.Errorf("unwrapping with the first key after pruning: %v", err)
+			}
+			if got, _ := keys.Current(); got != current {
+				t.Errorf("current key is %q after pruning, want %q", got, current)
+			}
+		})
+	}
+
+	// The current key and keys never retired are always kept
+	keys, path := newKeyring(t)
+	current, _ := keys.Current()
+	removed, err := keys.Prune(nil, time.Now().Add(time.Hour))
+	if err != nil || len(removed) != 0 {
+		t.Errorf("pruned %v, err %v, want nothing", removed, err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil || !strings.Contains(string(content), current) {
+		t.Errorf("key file lost the current key, err %v", err)
+	}
+}
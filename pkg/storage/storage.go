@@ -0,0 +1,326 @@
+// Stores and reads back the bytes of the files described by files_metadata.
+// Blobs live in db.DB_FILES_DIR and may be compressed and encrypted, the
+// codec and wrapped data key are recorded in the file's row so readers
+// always get the original bytes back.
+package storage
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"grpc-pedrocarlo/pkg/db"
+	"grpc-pedrocarlo/pkg/utils"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codecs of stored blobs, recorded in files_metadata.codec
+const (
+	CODEC_NONE = ""
+	CODEC_ZSTD = "zstd"
+)
+
+// Codec tried on new blobs, CODEC_NONE disables compression at rest
+var COMPRESSION = CODEC_ZSTD
+
+// Blobs are kept compressed only when it saves at least this fraction
+const MIN_SAVING = 0.1
+
+// Bytes compressed to guess whether compressing the whole file is worth it
+const sampleSize = 1 << 20
+
+// Keyring wrapping the data keys of new blobs, nil stores them in plaintext
+var KEYS *Keyring
+
+var ErrCorrupted = errors.New("stored file is corrupted")
+var errUnknownCodec = errors.New("unknown codec")
+var errNoKeyring = errors.New("file is encrypted but no key file was loaded")
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+func worthIt(original int64, compressed int64) bool {
+	return float64(compressed) <= float64(original)*(1-MIN_SAVING)
+}
+
+// Prepares the temp file at path, holding the original bytes, to be moved
+// into DB_FILES_DIR or CHUNKS_DIR. The file is compressed in place when that
+// makes it smaller and then encrypted when KEYS is set, blob is filled
+// accordingly.
+func Prepare(path string, blob *db.StoredBlob) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	*blob = db.StoredBlob{FileSize: info.Size(), Codec: CODEC_NONE}
+	err = compress(path, blob)
+	if err != nil || KEYS == nil {
+		return err
+	}
+	return encrypt(path, blob)
+}
+
+// Replaces the file at path with the output of transform applied to it,
+// unless keep refuses the size of that output. A nil keep accepts any size.
+// Returns the size of the output and whether it replaced the file.
+func rewrite(path string, transform func(w io.Writer, r io.Reader) error, keep func(size int64) bool) (int64, bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, false, err
+	}
+	defer file.Close()
+	temp_file, err := os.CreateTemp(filepath.Dir(path), utils.TEMP_PATTERN)
+	if err != nil {
+		return 0, false, err
+	}
+	defer temp_file.Close()
+	defer os.Remove(temp_file.Name())
+	err = transform(temp_file, file)
+	if err != nil {
+		return 0, false, err
+	}
+	info, err := temp_file.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+	if keep != nil && !keep(info.Size()) {
+		return info.Size(), false, nil
+	}
+	err = temp_file.Close()
+	if err != nil {
+		return 0, false, err
+	}
+	return info.Size(), true, os.Rename(temp_file.Name(), path)
+}
+
+func compress(path string, blob *db.StoredBlob) error {
+	if COMPRESSION == CODEC_NONE || blob.FileSize == 0 {
+		return nil
+	}
+	if COMPRESSION != CODEC_ZSTD {
+		return fmt.Errorf("%w: %q", errUnknownCodec, COMPRESSION)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Already compressed formats are usually recognised from their first bytes
+	counter := &countingWriter{}
+	encoder, err := zstd.NewWriter(counter, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return err
+	}
+	sampled, err := io.Copy(encoder, io.LimitReader(file, sampleSize))
+	if err != nil {
+		return err
+	}
+	err = encoder.Close()
+	if err != nil || !worthIt(sampled, counter.n) {
+		return err
+	}
+	file.Close()
+
+	// The sample was promising, the rest of the file may not be. Any saving on
+	// the whole file is kept, a file that did not shrink stays uncompressed.
+	compressed_size, kept, err := rewrite(path, func(w io.Writer, r io.Reader) error {
+		encoder.Reset(w)
+		_, err := io.Copy(encoder, r)
+		if err != nil {
+			return err
+		}
+		return encoder.Close()
+	}, func(size int64) bool { return size < blob.FileSize })
+	if err != nil {
+		return err
+	}
+	if !kept {
+		utils.Log_trace(fmt.Sprintf("Kept %d bytes uncompressed, they compressed to %d bytes", blob.FileSize, compressed_size))
+		return nil
+	}
+	utils.Log_trace(fmt.Sprintf("Compressed %d bytes to %d bytes", blob.FileSize, compressed_size))
+	blob.Codec = CODEC_ZSTD
+	return nil
+}
+
+func encrypt(path string, blob *db.StoredBlob) error {
+	data_key := make([]byte, KEY_SIZE)
+	_, err := rand.Read(data_key)
+	if err != nil {
+		return err
+	}
+	key_id, wrapped, err := KEYS.Wrap(data_key)
+	if err != nil {
+		return err
+	}
+	_, _, err = rewrite(path, func(w io.Writer, r io.Reader) error {
+		return encryptSegments(w, r, data_key)
+	}, nil)
+	if err != nil {
+		return err
+	}
+	blob.KeyId = key_id
+	blob.DataKey = wrapped
+	return nil
+}
+
+type decodingReader struct {
+	decoder *zstd.Decoder
+	file    io.Closer
+}
+
+func (r *decodingReader) Read(p []byte) (int, error) {
+	n, err := r.decoder.Read(p)
+	if err != nil && err != io.EOF && !errors.Is(err, ErrCorrupted) {
+		err = fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+	return n, err
+}
+
+func (r *decodingReader) Close() error {
+	r.decoder.Close()
+	return r.file.Close()
+}
+
+// Opens the stored file described by meta and returns its original bytes.
+// Read errors caused by damaged compressed or encrypted data, or chunks
+// not matching their hash, wrap ErrCorrupted. Files stored in a single
+// blob without compression can also be read at any offset, the returned
+// reader then implements io.ReaderAt and io.Seeker.
+func Open(conn *db.Store, meta *db.FileMetadata) (io.ReadCloser, error) {
+	if meta.Chunked == 1 {
+		return openChunked(conn, meta)
+	}
+	return openBlob(db.GetFilePath(meta), &meta.StoredBlob)
+}
+
+func openBlob(path string, blob *db.StoredBlob) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	var stored io.ReadCloser = file
+	if blob.DataKey != "" {
+		stored, err = openEncrypted(file, blob)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	switch blob.Codec {
+	case CODEC_NONE:
+		return stored, nil
+	case CODEC_ZSTD:
+		decoder, err := zstd.NewReader(stored, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			stored.Close()
+			return nil, err
+		}
+		return &decodingReader{decoder: decoder, file: stored}, nil
+	}
+	stored.Close()
+	return nil, fmt.Errorf("%w: %q", errUnknownCodec, blob.Codec)
+}
+
+func openEncrypted(file *os.File, blob *db.StoredBlob) (*segmentReader, error) {
+	if KEYS == nil {
+		return nil, errNoKeyring
+	}
+	data_key, err := KEYS.Unwrap(blob.KeyId, blob.DataKey)
+	if err != nil {
+		return nil, err
+	}
+	return openSegments(file, data_key)
+}
+
+// Returns the original size of the stored file described by meta
+func Size(meta *db.FileMetadata) (int64, error) {
+	if meta.FileSize > 0 || meta.Codec != CODEC_NONE || meta.DataKey != "" || meta.Chunked == 1 {
+		return meta.FileSize, nil
+	}
+	info, err := os.Stat(db.GetFilePath(meta))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Wraps the data keys of all stored files and chunks with the current master key of
+// keys, then removes the master keys no longer used and retired for longer
+// than KEY_RETIRE_GRACE. The files themselves are not rewritten. Returns the
+// number of data keys wrapped again.
+func RewrapKeys(conn *db.Store, keys *Keyring) (int, error) {
+	key_id, err := keys.Current()
+	if err != nil {
+		return 0, err
+	}
+	files, err := db.QueryFilesNotWrappedBy(conn, key_id)
+	if err != nil {
+		return 0, err
+	}
+	rewrapped := 0
+	for i := range files {
+		file_meta := &files[i]
+		data_key, err := keys.Unwrap(file_meta.KeyId, file_meta.DataKey)
+		if err != nil {
+			return rewrapped, fmt.Errorf("%s: %w", filepath.Join(file_meta.Folder, file_meta.Filename), err)
+		}
+		new_key_id, wrapped, err := keys.Wrap(data_key)
+		if err != nil {
+			return rewrapped, err
+		}
+		// Files replaced meanwhile already have a key wrapped by a newer key
+		updated, err := db.UpdateDataKey(conn, file_meta.Id, file_meta.DataKey, new_key_id, wrapped)
+		if err != nil {
+			return rewrapped, err
+		}
+		if updated {
+			rewrapped++
+		}
+	}
+	chunks, err := db.QueryChunksNotWrappedBy(conn, key_id)
+	if err != nil {
+		return rewrapped, err
+	}
+	for i := range chunks {
+		chunk := &chunks[i]
+		data_key, err := keys.Unwrap(chunk.KeyId, chunk.DataKey)
+		if err != nil {
+			return rewrapped, fmt.Errorf("chunk %s: %w", chunk.Hash, err)
+		}
+		new_key_id, wrapped, err := keys.Wrap(data_key)
+		if err != nil {
+			return rewrapped, err
+		}
+		updated, err := db.UpdateChunkDataKey(conn, chunk.Hash, chunk.DataKey, new_key_id, wrapped)
+		if err != nil {
+			return rewrapped, err
+		}
+		if updated {
+			rewrapped++
+		}
+	}
+	in_use, err := db.QueryKeyIdsInUse(conn)
+	if err != nil {
+		return rewrapped, err
+	}
+	removed, err := keys.Prune(in_use, time.Now().Add(-KEY_RETIRE_GRACE))
+	if err != nil {
+		return rewrapped, err
+	}
+	for _, id := range removed {
+		utils.Log_trace(fmt.Sprintf("Removed master key %s", id))
+	}
+	return rewrapped, nil
+}
@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Pattern given to os.CreateTemp for every temp file and folder, lets
+// CleanTempDir tell them apart from the other files living in the same folder
+const TEMP_PATTERN = "filesync-*"
+
+type CleanStats struct {
+	Removed int   // Temp files and folders removed
+	Bytes   int64 // Bytes reclaimed
+}
+
+// Older versions used os.CreateTemp(dir, "*"), which only produces digits,
+// and staged segmented uploads as upload-<id>
+func isTempName(name string) bool {
+	if strings.HasPrefix(name, strings.TrimSuffix(TEMP_PATTERN, "*")) || strings.HasPrefix(name, "upload-") {
+		return true
+	}
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Removes the temp files and folders of dir that were not modified for
+// max_age. A folder counts as modified when anything inside it was.
+func CleanTempDir(dir string, max_age time.Duration) (CleanStats, error) {
+	stats := CleanStats{}
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return stats, nil
+	}
+	if err != nil {
+		return stats, err
+	}
+	for _, entry := range entries {
+		if !isTempName(entry.Name()) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		modified, size, err := treeModTimeSize(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Removed by its owner while we looked at it
+				continue
+			}
+			return stats, err
+		}
+		if time.Since(modified) < max_age {
+			continue
+		}
+		err = os.RemoveAll(path)
+		if err != nil {
+			return stats, err
+		}
+		stats.Removed++
+		stats.Bytes += size
+	}
+	return stats, nil
+}
+
+// Returns the newest modification time and the total size under path
+func treeModTimeSize(path string) (time.Time, int64, error) {
+	var modified time.Time
+	var size int64
+	err := filepath.WalkDir(path, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+		if !entry.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return modified, size, err
+}
@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIsTempName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"filesync-123456", true},
+		{"filesync-upload-0123456789abcdef0123456789abcdef", true},
+		{"upload-0123456789abcdef0123456789abcdef", true},
+		{"123456", true},
+		{"", false},
+		{"files.db", false},
+		{"12a", false},
+		{"chunks", false},
+	}
+	for _, test := range tests {
+		got := isTempName(test.name)
+		if got != test.want {
+			t.Errorf("isTempName(%q) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCleanTempDir(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-48 * time.Hour)
+	files := []struct {
+		name     string
+		modified time.Time
+		removed  bool
+	}{
+		{"filesync-upload-0123456789abcdef0123456789abcdef", old, true},
+		{"upload-fedcba9876543210fedcba9876543210", old, true},
+		{"filesync-42", old, true},
+		{"filesync-upload-ffffffffffffffffffffffffffffffff", time.Now(), false},
+		{"files.db", old, false},
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, file.name)
+		err := os.WriteFile(path, []byte("data"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(path, file.modified, file.modified)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats, err := CleanTempDir(dir, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Removed != 3 || stats.Bytes != 12 {
+		t.Errorf("CleanTempDir removed %d entries and %d bytes, want 3 and 12", stats.Removed, stats.Bytes)
+	}
+	for _, file := range files {
+		_, err := os.Stat(filepath.Join(dir, file.name))
+		if file.removed != os.IsNotExist(err) {
+			t.Errorf("%s: removed = %v, want %v", file.name, os.IsNotExist(err), file.removed)
+		}
+	}
+}
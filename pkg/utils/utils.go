@@ -5,9 +5,33 @@ import (
 	"log"
 	"runtime"
 	"strings"
+	"sync/atomic"
 )
 
+// Log levels, trace logs every message and error only the errors
+const (
+	LOG_TRACE = "trace"
+	LOG_ERROR = "error"
+)
+
+var errors_only atomic.Bool
+
+func SetLogLevel(level string) error {
+	switch level {
+	case LOG_TRACE:
+		errors_only.Store(false)
+	case LOG_ERROR:
+		errors_only.Store(true)
+	default:
+		return fmt.Errorf("unknown log level %q, expected %s or %s", level, LOG_TRACE, LOG_ERROR)
+	}
+	return nil
+}
+
 func Log_trace(msg ...any) {
+	if errors_only.Load() {
+		return
+	}
 	pc := make([]uintptr, 15)
 	n := runtime.Callers(2, pc)
 	frames := runtime.CallersFrames(pc[:n])
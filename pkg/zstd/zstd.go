@@ -0,0 +1,78 @@
+// Registers a zstd compressor for gRPC messages, importing the package is
+// enough for both clients and servers to accept the "zstd" encoding.
+package zstd
+
+import (
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/grpc/encoding"
+)
+
+// Name of the encoding, as given to grpc.UseCompressor
+const NAME = "zstd"
+
+func init() {
+	encoding.RegisterCompressor(&compressor{})
+}
+
+type compressor struct {
+	encoders sync.Pool
+	decoders sync.Pool
+}
+
+func (c *compressor) Name() string {
+	return NAME
+}
+
+type writer struct {
+	*zstd.Encoder
+	pool *sync.Pool
+}
+
+func (w *writer) Close() error {
+	defer w.pool.Put(w)
+	return w.Encoder.Close()
+}
+
+func (c *compressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	if pooled, ok := c.encoders.Get().(*writer); ok {
+		pooled.Reset(w)
+		return pooled, nil
+	}
+	encoder, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return &writer{Encoder: encoder, pool: &c.encoders}, nil
+}
+
+type reader struct {
+	*zstd.Decoder
+	pool *sync.Pool
+}
+
+// Returns the decoder to the pool once the message is fully read
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.Decoder.Read(p)
+	if err == io.EOF {
+		r.pool.Put(r)
+	}
+	return n, err
+}
+
+func (c *compressor) Decompress(r io.Reader) (io.Reader, error) {
+	if pooled, ok := c.decoders.Get().(*reader); ok {
+		err := pooled.Reset(r)
+		if err != nil {
+			return nil, err
+		}
+		return pooled, nil
+	}
+	decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return &reader{Decoder: decoder, pool: &c.decoders}, nil
+}